@@ -0,0 +1,292 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/running910/gokit/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read from strings as "1m30s", plain numbers are nanoseconds
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+
+	return nil
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Load fills the struct v points to from its default tags, then file, then the environment,
+// and checks its validate tags. Fields are named by their json tags in all the formats, the
+// format is told by the extension of file: .yaml, .yml, .json or .toml. Keys unknown to v are
+// errors, to catch typos. An empty file loads the defaults and the environment only.
+//
+// A field is overridden by the variable envPrefix_PATH, PATH being the json names from v
+// joined by _ and upper cased as LOGGER_LEVEL, or by its env tag. Slices are comma separated.
+// An empty envPrefix disables the overrides.
+func Load(file string, envPrefix string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, not %T", v)
+	}
+
+	if err := applyDefaults(rv.Elem(), ""); err != nil {
+		return err
+	}
+
+	if file != "" {
+		if err := decodeFile(file, v); err != nil {
+			logger.Errorf("load config %s failed! reason:%s", file, err)
+			return err
+		}
+	}
+
+	if envPrefix != "" {
+		if err := applyEnv(rv.Elem(), envName(envPrefix)); err != nil {
+			return err
+		}
+	}
+
+	return Validate(v)
+}
+
+// decodeFile decodes file into v through json, so that one set of tags serves all formats
+func decodeFile(file string, v interface{}) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".json":
+		data = content
+	case ".yaml", ".yml":
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(content, &m); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	case ".toml":
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(content), &m); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown config format %q", ext)
+	}
+
+	// an empty yaml document
+	if len(bytes.TrimSpace(data)) == 0 || string(data) == "null" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// fieldName returns the json name of field, "" if json skips it
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	} else if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// envName upper cases name and replaces what a variable name cannot hold by _
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// walkFields calls fn for the settable leaves of the struct v with their json path joined by
+// sep, below the exported struct fields and through the embedded ones as json does
+func walkFields(v reflect.Value, path string, sep string, fn func(field reflect.StructField, value reflect.Value, path string) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := fieldName(field)
+		if name == "" {
+			continue
+		}
+
+		value := v.Field(i)
+		fieldPath := name
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			fieldPath = path
+		} else if path != "" {
+			fieldPath = path + sep + name
+		}
+
+		if value.Kind() == reflect.Struct && value.Type() != durationType && !hasTextUnmarshaler(value) {
+			if err := walkFields(value, fieldPath, sep, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(field, value, fieldPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasTextUnmarshaler(v reflect.Value) bool {
+	_, ok := v.Addr().Interface().(interface{ UnmarshalText([]byte) error })
+	return ok
+}
+
+func applyDefaults(v reflect.Value, path string) error {
+	return walkFields(v, path, ".", func(field reflect.StructField, value reflect.Value, path string) error {
+		def, ok := field.Tag.Lookup("default")
+		if !ok {
+			return nil
+		}
+		if err := setString(value, def); err != nil {
+			return fmt.Errorf("invalid default of %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	return walkFields(v, prefix, "_", func(field reflect.StructField, value reflect.Value, path string) error {
+		name := field.Tag.Get("env")
+		if name == "" {
+			name = envName(path)
+		}
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		if err := setString(value, s); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// setString parses s into v according to its kind
+func setString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		items := []string{}
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setString(slice.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Ptr:
+		value := reflect.New(v.Type().Elem())
+		if err := setString(value.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(value)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type serverConfig struct {
+	Listen  string   `json:"listen" default:":8080" validate:"required"`
+	Workers int      `json:"workers" default:"4" validate:"min=1,max=64"`
+	Timeout Duration `json:"timeout" default:"5s"`
+	Peers   []string `json:"peers"`
+	Secret  string   `json:"secret" env:"TEST_SECRET"`
+}
+
+type testConfig struct {
+	Server serverConfig `json:"server"`
+	Logger LoggerConfig `json:"logger"`
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	want := testConfig{
+		Server: serverConfig{Listen: ":9090", Workers: 4, Timeout: Duration(time.Minute), Peers: []string{"a", "b"}},
+		Logger: LoggerConfig{Level: "debug", File: "-", MaxSizeMB: 100, MaxBackups: 10, MaxAgeDays: 30, Compress: true},
+	}
+
+	for name, content := range map[string]string{
+		"app.yaml": "server:\n  listen: \":9090\"\n  timeout: 1m\n  peers: [a, b]\nlogger:\n  level: debug\n  compress: true\n",
+		"app.json": `{"server": {"listen": ":9090", "timeout": "1m", "peers": ["a", "b"]}, "logger": {"level": "debug", "compress": true}}`,
+		"app.toml": "[server]\nlisten = \":9090\"\ntimeout = \"1m\"\npeers = [\"a\", \"b\"]\n[logger]\nlevel = \"debug\"\ncompress = true\n",
+	} {
+		var c testConfig
+		if err := Load(writeFile(t, name, content), "", &c); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Fatalf("%s: got %+v, want %+v", name, c, want)
+		}
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Setenv("APP_SERVER_WORKERS", "8")
+	t.Setenv("APP_SERVER_PEERS", "x, y")
+	t.Setenv("APP_LOGGER_MAX_SIZE_MB", "20")
+	t.Setenv("TEST_SECRET", "s3cret")
+
+	var c testConfig
+	if err := Load(writeFile(t, "app.yaml", "server:\n  workers: 2\n"), "app", &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Server.Workers != 8 || !reflect.DeepEqual(c.Server.Peers, []string{"x", "y"}) ||
+		c.Logger.MaxSizeMB != 20 || c.Server.Secret != "s3cret" || c.Server.Listen != ":8080" {
+		t.Fatalf("got %+v", c)
+	}
+
+	t.Setenv("APP_SERVER_TIMEOUT", "soon")
+	if err := Load("", "app", &c); err == nil || !strings.Contains(err.Error(), "APP_SERVER_TIMEOUT") {
+		t.Fatalf("expect an error naming the variable, got %v", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	var c testConfig
+	err := Load(writeFile(t, "app.yaml", "server:\n  listen: \"\"\n  workers: 100\nlogger:\n  level: loud\n"), "", &c)
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Fields) != 3 {
+		t.Fatalf("expect 3 invalid fields, got %v", err)
+	}
+
+	if err := Load(writeFile(t, "app.json", `{"server": {"listne": ":80"}}`), "", &c); err == nil {
+		t.Fatal("expect an error for an unknown key")
+	}
+	if err := Load(writeFile(t, "app.ini", ""), "", &c); err == nil {
+		t.Fatal("expect an error for an unknown format")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	file := writeFile(t, "app.yaml", "logger:\n  level: info\n")
+
+	var c testConfig
+	if err := Load(file, "", &c); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloaded := make(chan *testConfig, 4)
+	if err := Watch(ctx, file, "", &c, func(v interface{}) { reloaded <- v.(*testConfig) }); err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid config is skipped
+	if err := os.WriteFile(file, []byte("logger:\n  level: loud\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := os.WriteFile(file, []byte("logger:\n  level: debug\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case next := <-reloaded:
+		if next.Logger.Level != "debug" || c.Logger.Level != "info" {
+			t.Fatalf("reloaded %+v, current %+v", next.Logger, c.Logger)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("config not reloaded")
+	}
+}
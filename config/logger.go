@@ -0,0 +1,67 @@
+package config
+
+import (
+	"reflect"
+
+	"github.com/running910/gokit/logger"
+)
+
+// LoggerConfig is the standard logger section of a service config, the arguments of
+// logger.LogInit, or of logger.LogInitStdout when File is -
+type LoggerConfig struct {
+	Dev   bool   `json:"dev"`
+	Level string `json:"level" default:"info" validate:"oneof=debug info warn error panic fatal"`
+	// - logs to stdout, through zap so that Level applies and reloads as for a file
+	File         string `json:"file" default:"-" validate:"required"`
+	MaxSizeMB    int    `json:"max_size_mb" default:"100" validate:"min=1"`
+	MaxBackups   int    `json:"max_backups" default:"10" validate:"min=0"`
+	MaxAgeDays   int    `json:"max_age_days" default:"30" validate:"min=0"`
+	Compress     bool   `json:"compress"`
+	FixedCstZone bool   `json:"fixed_cst_zone"`
+}
+
+// Init initializes the logger with c
+func (c *LoggerConfig) Init() {
+	if c.File == "-" {
+		logger.LogInitStdout(c.Dev, c.Level, c.FixedCstZone)
+		return
+	}
+
+	logger.LogInit(c.Dev, c.Level, c.File, c.MaxSizeMB, c.MaxBackups, c.MaxAgeDays, c.Compress, c.FixedCstZone)
+}
+
+// Apply switches the logger from the old config to c. Only the level changes live, the
+// other fields need a restart.
+func (c *LoggerConfig) Apply(old *LoggerConfig) {
+	if c.Level != old.Level {
+		logger.Infof("log level changed from %s to %s", old.Level, c.Level)
+		logger.SetLogLevel(c.Level)
+	}
+
+	rest, oldRest := *c, *old
+	rest.Level, oldRest.Level = "", ""
+	if rest != oldRest {
+		logger.Warnf("logger config changed, restart to apply it")
+	}
+}
+
+var loggerConfigType = reflect.TypeOf(LoggerConfig{})
+
+// findLoggerConfig returns the first LoggerConfig of the struct v, nil if it has none
+func findLoggerConfig(v reflect.Value) *LoggerConfig {
+	if v.Type() == loggerConfigType {
+		return v.Addr().Interface().(*LoggerConfig)
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !v.Type().Field(i).IsExported() || field.Kind() != reflect.Struct {
+			continue
+		}
+		if c := findLoggerConfig(field); c != nil {
+			return c
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists the fields of a config breaking their validate tags
+type ValidationError struct {
+	Fields []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Fields, "; ")
+}
+
+// Validate checks the validate tags of the fields of the struct v points to, a comma separated
+// list of:
+//
+//	required       not the zero value
+//	min=N, max=N   bounds of a number, of the length of a string, slice or map
+//	oneof=a b c    one of the space separated values
+//
+// Fields are named by their json path as logger.level.
+func Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, not %T", v)
+	}
+
+	var invalid []string
+	err := walkFields(rv.Elem(), "", ".", func(field reflect.StructField, value reflect.Value, path string) error {
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			return nil
+		}
+
+		for _, rule := range strings.Split(tag, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+			msg, err := checkRule(value, name, arg)
+			if err != nil {
+				return fmt.Errorf("bad validate tag of %s: %w", path, err)
+			} else if msg != "" {
+				invalid = append(invalid, path+" "+msg)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(invalid) > 0 {
+		return &ValidationError{Fields: invalid}
+	}
+	return nil
+}
+
+// checkRule returns why v breaks the rule name=arg, "" if it does not
+func checkRule(v reflect.Value, name string, arg string) (string, error) {
+	switch name {
+	case "required":
+		if v.IsZero() {
+			return "is required", nil
+		}
+
+	case "min", "max":
+		bound, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", err
+		}
+
+		var n float64
+		what := ""
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		case reflect.String, reflect.Slice, reflect.Map:
+			n = float64(v.Len())
+			what = "length "
+		default:
+			return "", fmt.Errorf("%s on %s", name, v.Type())
+		}
+
+		if name == "min" && n < bound {
+			return fmt.Sprintf("%s%v is below %s", what, n, arg), nil
+		} else if name == "max" && n > bound {
+			return fmt.Sprintf("%s%v is above %s", what, n, arg), nil
+		}
+
+	case "oneof":
+		s := fmt.Sprint(v.Interface())
+		for _, allowed := range strings.Fields(arg) {
+			if s == allowed {
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("%q is not one of %s", s, arg), nil
+
+	default:
+		return "", fmt.Errorf("unknown rule %q", name)
+	}
+
+	return "", nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/running910/gokit/fs"
+	"github.com/running910/gokit/logger"
+)
+
+// Watch loads file again into a new config of the type of v each time it changes, until ctx
+// is done. v is the config in use, as loaded by Load with the same file and envPrefix. A
+// changed config is handed to onReload, a pointer of the type of v, after its LoggerConfig
+// has been applied. A config failing to load or to validate is logged and skipped, the
+// previous one stays in use.
+func Watch(ctx context.Context, file string, envPrefix string, v interface{}, onReload func(interface{})) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, not %T", v)
+	}
+
+	w, err := fs.Watch(ctx, fs.WatchOptions{}, file)
+	if err != nil {
+		logger.Errorf("watch config %s failed! reason:%s", file, err)
+		return err
+	}
+
+	go func() {
+		current := v
+		errs := w.Errors()
+		for {
+			select {
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+				} else {
+					logger.Errorf("watch config %s failed! reason:%s", file, err)
+				}
+				continue
+			case ev, ok := <-w.Events():
+				if !ok {
+					return
+				}
+				// removed, the next create is a change
+				if ev.Op.Has(fs.WatchRemove | fs.WatchRename) {
+					continue
+				}
+			}
+
+			next := reflect.New(rv.Elem().Type()).Interface()
+			if err := Load(file, envPrefix, next); err != nil {
+				logger.Errorf("reload config %s failed, keeping the current one! reason:%s", file, err)
+				continue
+			}
+			if reflect.DeepEqual(next, current) {
+				continue
+			}
+
+			logger.Infof("config %s reloaded", file)
+			newLogger := findLoggerConfig(reflect.ValueOf(next).Elem())
+			if oldLogger := findLoggerConfig(reflect.ValueOf(current).Elem()); newLogger != nil && oldLogger != nil {
+				newLogger.Apply(oldLogger)
+			}
+
+			current = next
+			onReload(next)
+		}
+	}()
+
+	return nil
+}
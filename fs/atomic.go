@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/running910/gokit/logger"
+)
+
+// syncDir fsyncs dir so a rename or creation inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// writeAtomic writes the content of r to a temporary file next to file, applies mode and the
+// ownership of the file it replaces, and renames it over file. Readers see the old or the new
+// content, never a partial one.
+func writeAtomic(file string, r io.Reader, mode os.FileMode) error {
+	dir := filepath.Dir(file)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".tmp-*")
+	if err != nil {
+		logger.Errorf("create temporary file for %s failed! reason:%s", file, err)
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		logger.Errorf("write %s failed! reason:%s", tmp.Name(), err)
+		return err
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+
+	// keep the owner of the replaced file, which only root may change to someone else
+	if info, err := os.Stat(file); err == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := tmp.Chown(int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, os.ErrPermission) {
+				return err
+			}
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		logger.Errorf("fsync %s failed! reason:%s", tmp.Name(), err)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		logger.Errorf("rename %s to %s failed! reason:%s", tmp.Name(), file, err)
+		return err
+	}
+	tmp = nil
+
+	return syncDir(dir)
+}
+
+// WriteFileAtomic replaces file with data through a temporary file, fsync and rename, then
+// fsyncs the directory. A crash leaves the old or the new content, never a mix.
+func WriteFileAtomic(file string, data []byte, mode os.FileMode) error {
+	return writeAtomic(file, bytes.NewReader(data), mode)
+}
+
+// WriteAtomic is WriteFileAtomic with the content read from r
+func WriteAtomic(file string, r io.Reader, mode os.FileMode) error {
+	return writeAtomic(file, r, mode)
+}
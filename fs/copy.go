@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/running910/gokit/logger"
+)
+
+// preserveAttrs gives dst the owner, mode and times of src. Only root can give a file away,
+// the owner is kept as is otherwise.
+func preserveAttrs(dst string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("no stat of %s", info.Name())
+	}
+
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	// after chown, which clears the setuid and setgid bits
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+
+	atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	return os.Chtimes(dst, atime, info.ModTime())
+}
+
+func copyFile(src string, dst string, info os.FileInfo) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := writeAtomic(dst, f, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return preserveAttrs(dst, info)
+}
+
+func copySymlink(src string, dst string, info os.FileInfo) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, dst); err != nil {
+		return err
+	}
+
+	return preserveAttrs(dst, info)
+}
+
+func copyDir(src string, dst string, info os.FileInfo) error {
+	if err := MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := Copy(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	// last, the entries changed the times and a read only mode would have refused them
+	return preserveAttrs(dst, info)
+}
+
+// Copy copies src to dst with its mode, owner when running as root, and times. Directories
+// are copied recursively and symlinks as links. Regular files are written atomically, so dst
+// may be on another device than src.
+func Copy(src string, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		logger.Errorf("copy %s failed! reason:%s", src, err)
+		return err
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		err = copyFile(src, dst, info)
+	case info.Mode()&os.ModeSymlink != 0:
+		err = copySymlink(src, dst, info)
+	case info.IsDir():
+		err = copyDir(src, dst, info)
+	default:
+		err = fmt.Errorf("unsupported file type %s", info.Mode().Type())
+	}
+
+	if err != nil {
+		logger.Errorf("copy %s to %s failed! reason:%s", src, dst, err)
+		return err
+	}
+
+	return nil
+}
+
+// Move renames src to dst, or copies then removes src when they are on different devices
+func Move(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		logger.Errorf("move %s to %s failed! reason:%s", src, dst, err)
+		return err
+	}
+
+	if err := Copy(src, dst); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(src); err != nil {
+		logger.Errorf("remove %s after copy failed! reason:%s", src, err)
+		return err
+	}
+
+	return nil
+}
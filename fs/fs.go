@@ -3,10 +3,81 @@ package fs
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/running910/gokit/logger"
 )
 
-func TouchFile(file string) {
-	os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0777)
+// TouchFile creates file empty if it does not exist, or sets its access and modification
+// times to now, as touch does
+func TouchFile(file string) error {
+	f, err := os.OpenFile(file, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Errorf("touch %s failed! reason:%s", file, err)
+		return err
+	}
+	f.Close()
+
+	now := time.Now()
+	if err := os.Chtimes(file, now, now); err != nil {
+		logger.Errorf("touch %s failed! reason:%s", file, err)
+		return err
+	}
+
+	return nil
+}
+
+// MkdirAll creates dir and its missing parents with mode, not masked by the umask as
+// os.MkdirAll does. Existing directories keep their mode.
+func MkdirAll(dir string, mode os.FileMode) error {
+	dir = filepath.Clean(dir)
+
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", dir)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := MkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+		logger.Errorf("mkdir %s failed! reason:%s", dir, err)
+		return err
+	}
+
+	return os.Chmod(dir, mode)
+}
+
+// Exists tells whether path exists, a dangling symlink exists
+func Exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// IsDir tells whether path is a directory, following symlinks
+func IsDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// IsRegular tells whether path is a regular file, following symlinks
+func IsRegular(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// IsSymlink tells whether path itself is a symlink, dangling or not
+func IsSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
 }
 
 func Hello() {
@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTouchFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "touched")
+
+	if err := TouchFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if !IsRegular(file) {
+		t.Fatalf("%s not created", file)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(file, old, old)
+	if err := TouchFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(file); time.Since(info.ModTime()) > time.Minute {
+		t.Fatalf("mtime not updated: %s", info.ModTime())
+	}
+
+	if err := TouchFile(filepath.Join(file, "child")); err == nil {
+		t.Fatal("expect an error below a regular file")
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+
+	dir := filepath.Join(t.TempDir(), "a", "b")
+	if err := MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, filepath.Dir(dir)} {
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0755 {
+			t.Fatalf("%s mode %v %v", path, info.Mode(), err)
+		}
+	}
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	if err := MkdirAll(file, 0755); err == nil {
+		t.Fatal("expect an error on a regular file")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config")
+
+	if err := WriteFileAtomic(file, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(file, []byte("v2"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(file)
+	info, _ := os.Stat(file)
+	if string(content) != "v2" || info.Mode().Perm() != 0640 {
+		t.Fatalf("got %q mode %v", content, info.Mode())
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary files left: %v", entries)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "config"), nil, 0600); err == nil {
+		t.Fatal("expect an error in a missing directory")
+	}
+}
+
+func TestCopyMove(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0750)
+	os.WriteFile(filepath.Join(src, "sub", "script"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("sub/script", filepath.Join(src, "link"))
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(src, "sub", "script"), mtime, mtime)
+	os.Chmod(src, 0710)
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Copy(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "sub", "script"))
+	if err != nil || info.Mode().Perm() != 0755 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("copied script %v %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "sub/script" {
+		t.Fatalf("copied link %q %v", target, err)
+	}
+	if info, _ := os.Stat(dst); info.Mode().Perm() != 0710 {
+		t.Fatalf("copied dir mode %v", info.Mode())
+	}
+
+	// /dev/shm is usually another filesystem, making Move fall back to copy
+	moved := filepath.Join(os.TempDir(), "gokit-fs-move-test")
+	if shm, err := os.MkdirTemp("/dev/shm", "gokit-fs-"); err == nil {
+		defer os.RemoveAll(shm)
+		moved = filepath.Join(shm, "moved")
+	}
+	defer os.RemoveAll(moved)
+
+	if err := Move(dst, moved); err != nil {
+		t.Fatal(err)
+	}
+	if Exists(dst) || !IsRegular(filepath.Join(moved, "sub", "script")) || !IsSymlink(filepath.Join(moved, "link")) {
+		t.Fatal("bad move")
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), make([]byte, 10000), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 5000), 0644)
+	os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "sub", "a"))
+
+	if size, err := DirSize(dir); err != nil || size != 25000 {
+		t.Fatalf("size %d %v, want 25000", size, err)
+	}
+
+	// a and its hard link are allocated once
+	usage, err := DiskUsage(dir)
+	if err != nil || usage < 15000 || usage >= 25000+3*4096 {
+		t.Fatalf("usage %d %v", usage, err)
+	}
+
+	if fsUsage, err := GetFsUsage(dir); err != nil || fsUsage.Total <= 0 || fsUsage.Used > fsUsage.Total {
+		t.Fatalf("fs usage %+v %v", fsUsage, err)
+	}
+}
@@ -0,0 +1,263 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"golang.org/x/sys/unix"
+)
+
+// lockPollInterval is how often a blocking Lock retries, flock itself cannot be cancelled
+const lockPollInterval = 20 * time.Millisecond
+
+// FileLock is an advisory flock on a file, created if needed. The lock belongs to the open
+// file, so two FileLock on the same path exclude each other even in one process. The kernel
+// releases it when the process dies. Locking a held FileLock again is an error, except to
+// convert it between shared and exclusive.
+type FileLock struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+	// mode held, LOCK_SH or LOCK_EX
+	how int
+}
+
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) Path() string {
+	return l.path
+}
+
+// testHookLockOpened runs between opening the lock file and locking it
+var testHookLockOpened = func() {}
+
+// tryLock takes the lock how, LOCK_SH or LOCK_EX, without blocking
+func (l *FileLock) tryLock(how int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// flock on the descriptor already locked always succeeds, it would let two users of one
+	// FileLock both hold it
+	if l.f != nil && l.how == how {
+		return false, fmt.Errorf("lock %s already held", l.path)
+	}
+
+	for {
+		f := l.f
+		if f == nil {
+			var err error
+			if f, err = os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+				logger.Errorf("open lock file %s failed! reason:%s", l.path, err)
+				return false, err
+			}
+			testHookLockOpened()
+		}
+
+		// a held lock is converted, as flock does
+		err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil && l.f == nil {
+			// the file may have been removed or replaced, by PidFile.Remove, between the open
+			// and the flock: the lock is then on an inode others no longer open, retry
+			if same, err := isLockedPath(f, l.path); err != nil {
+				f.Close()
+				logger.Errorf("stat lock file %s failed! reason:%s", l.path, err)
+				return false, err
+			} else if !same {
+				f.Close()
+				continue
+			}
+		}
+		if err == nil {
+			l.f, l.how = f, how
+			return true, nil
+		}
+
+		if l.f == nil {
+			f.Close()
+		}
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return false, nil
+		}
+
+		logger.Errorf("flock %s failed! reason:%s", l.path, err)
+		return false, err
+	}
+}
+
+// isLockedPath tells whether path is still the file f has open, same device and inode
+func isLockedPath(f *os.File, path string) (bool, error) {
+	opened, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(opened, current), nil
+}
+
+func (l *FileLock) lock(ctx context.Context, how int) error {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if ok, err := l.tryLock(how); err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("lock %s: %w", l.path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Lock takes the lock exclusively, waiting until it is free or ctx is done
+func (l *FileLock) Lock(ctx context.Context) error {
+	return l.lock(ctx, unix.LOCK_EX)
+}
+
+// RLock takes the lock shared with other readers, waiting until no writer holds it or ctx
+// is done
+func (l *FileLock) RLock(ctx context.Context) error {
+	return l.lock(ctx, unix.LOCK_SH)
+}
+
+// TryLock takes the lock exclusively if it is free and tells whether it did
+func (l *FileLock) TryLock() (bool, error) {
+	return l.tryLock(unix.LOCK_EX)
+}
+
+// TryRLock takes the lock shared if no writer holds it and tells whether it did
+func (l *FileLock) TryRLock() (bool, error) {
+	return l.tryLock(unix.LOCK_SH)
+}
+
+// Unlock releases the lock, the lock file is kept
+func (l *FileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return fmt.Errorf("lock %s is not held", l.path)
+	}
+
+	// closing the last descriptor releases the flock
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// ErrAlreadyRunning is returned by CreatePidFile when another live process holds the pid file
+var ErrAlreadyRunning = errors.New("already running")
+
+// PidFile is a pid file locked by the process it names, to run a single instance per host
+type PidFile struct {
+	lock *FileLock
+}
+
+// CreatePidFile writes the pid of the process to path and keeps it locked until Remove or the
+// process exit. It fails with ErrAlreadyRunning if a live process holds it. A pid file left by
+// a dead process is not locked anymore, it is taken over.
+func CreatePidFile(path string) (*PidFile, error) {
+	lock := NewFileLock(path)
+
+	ok, err := lock.TryLock()
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		pid, _ := readPid(path)
+		return nil, fmt.Errorf("pid file %s held by pid %d: %w", path, pid, ErrAlreadyRunning)
+	}
+
+	if pid, err := readPid(path); err == nil && pid != os.Getpid() {
+		logger.Infof("pid file %s of dead pid %d is stale, taking it over", path, pid)
+	}
+
+	// in place, a rename would leave the lock on the old inode
+	f := lock.f
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt(pid, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		logger.Errorf("write pid file %s failed! reason:%s", path, err)
+		lock.Unlock()
+		return nil, err
+	}
+
+	return &PidFile{lock: lock}, nil
+}
+
+func (p *PidFile) Path() string {
+	return p.lock.Path()
+}
+
+// Remove deletes the pid file then releases it
+func (p *PidFile) Remove() error {
+	if err := os.Remove(p.lock.Path()); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("remove pid file %s failed! reason:%s", p.lock.Path(), err)
+		return err
+	}
+
+	return p.lock.Unlock()
+}
+
+func readPid(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// GetPidFileOwner returns the pid of the live process holding the pid file at path, 0 if the
+// file is missing or stale
+func GetPidFileOwner(path string) (int, error) {
+	pid, err := readPid(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("invalid pid file %s: %w", path, err)
+	}
+
+	// the lock tells a stale file from a live one whose pid was reused by another process
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB); err == nil {
+		return 0, nil
+	} else if !errors.Is(err, unix.EWOULDBLOCK) {
+		return 0, err
+	}
+
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return 0, nil
+	}
+
+	return pid, nil
+}
@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	a, b := NewFileLock(path), NewFileLock(path)
+
+	if err := a.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryRLock(); err != nil || ok {
+		t.Fatalf("shared lock taken over an exclusive one %v %v", ok, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect a deadline error, got %v", err)
+	}
+
+	// a blocked Lock gets the lock once released
+	done := make(chan error)
+	go func() { done <- b.Lock(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := a.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unlock(); err == nil {
+		t.Fatal("expect an error unlocking a free lock")
+	}
+
+	// readers share the lock, a writer waits for them
+	if ok, _ := a.TryRLock(); !ok {
+		t.Fatal("shared lock refused")
+	}
+	if ok, _ := b.TryRLock(); !ok {
+		t.Fatal("second shared lock refused")
+	}
+	if ok, _ := NewFileLock(path).TryLock(); ok {
+		t.Fatal("exclusive lock taken over shared ones")
+	}
+	a.Unlock()
+	b.Unlock()
+}
+
+func TestFileLockHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	l := NewFileLock(path)
+
+	if ok, _ := l.TryLock(); !ok {
+		t.Fatal("lock refused")
+	}
+	if ok, err := l.TryLock(); err == nil || ok {
+		t.Fatalf("held lock taken again %v %v", ok, err)
+	}
+	if err := l.Lock(context.Background()); err == nil {
+		t.Fatal("expect an error locking a held lock")
+	}
+
+	// converted to shared, another reader gets in
+	if ok, err := l.TryRLock(); err != nil || !ok {
+		t.Fatalf("conversion to shared refused %v %v", ok, err)
+	}
+	reader := NewFileLock(path)
+	if ok, _ := reader.TryRLock(); !ok {
+		t.Fatal("shared lock refused after the conversion")
+	}
+	reader.Unlock()
+	if ok, err := l.TryRLock(); err == nil || ok {
+		t.Fatalf("held shared lock taken again %v %v", ok, err)
+	}
+	l.Unlock()
+}
+
+func TestFileLockRemoved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	a, b := NewFileLock(path), NewFileLock(path)
+
+	if ok, _ := a.TryLock(); !ok {
+		t.Fatal("lock refused")
+	}
+
+	// b opens the file, then its holder removes and releases it before b locks it
+	defer func(hook func()) { testHookLockOpened = hook }(testHookLockOpened)
+	removed := false
+	testHookLockOpened = func() {
+		if !removed {
+			removed = true
+			os.Remove(path)
+			a.Unlock()
+		}
+	}
+
+	if ok, err := b.TryLock(); err != nil || !ok {
+		t.Fatalf("lock refused %v %v", ok, err)
+	}
+	if ok, _ := NewFileLock(path).TryLock(); ok {
+		t.Fatal("lock taken twice, one of them on the removed file")
+	}
+	b.Unlock()
+}
+
+func TestPidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.pid")
+
+	pidFile, err := CreatePidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := GetPidFileOwner(path); err != nil || pid != os.Getpid() {
+		t.Fatalf("owner %d %v", pid, err)
+	}
+
+	if _, err := CreatePidFile(path); !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("expect ErrAlreadyRunning, got %v", err)
+	}
+
+	if err := pidFile.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if Exists(path) {
+		t.Fatal("pid file not removed")
+	}
+
+	// left by a dead process, not locked anymore
+	os.WriteFile(path, []byte("999999\n"), 0644)
+	if pid, err := GetPidFileOwner(path); err != nil || pid != 0 {
+		t.Fatalf("stale owner %d %v", pid, err)
+	}
+
+	pidFile, err = CreatePidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pidFile.Remove()
+
+	if pid, _ := readPid(path); pid != os.Getpid() {
+		t.Fatalf("pid file holds %d", pid)
+	}
+}
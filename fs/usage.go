@@ -0,0 +1,102 @@
+package fs
+
+import (
+	iofs "io/fs"
+	"path/filepath"
+	"syscall"
+
+	"github.com/running910/gokit/logger"
+	"golang.org/x/sys/unix"
+)
+
+// DirSize returns the apparent size of the files below dir, as du --apparent-size -b does.
+// Symlinks are not followed.
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("size of %s failed! reason:%s", dir, err)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// DiskUsage returns the bytes allocated to dir and everything below it, as du -s does.
+// Hard links are counted once.
+func DiskUsage(dir string) (int64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	seen := make(map[inode]bool)
+
+	var usage int64
+	err := filepath.WalkDir(dir, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			key := inode{uint64(st.Dev), st.Ino}
+			if st.Nlink > 1 && seen[key] {
+				return nil
+			}
+			seen[key] = true
+			usage += st.Blocks * 512
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("disk usage of %s failed! reason:%s", dir, err)
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+// FsUsage is the space of the filesystem holding a path, in bytes
+type FsUsage struct {
+	Total int64
+	Free  int64
+	// free for unprivileged users, Free less the reserved blocks
+	Avail int64
+	Used  int64
+}
+
+// GetFsUsage returns the usage of the filesystem holding path, as df does
+func GetFsUsage(path string) (FsUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		logger.Errorf("statfs %s failed! reason:%s", path, err)
+		return FsUsage{}, err
+	}
+
+	bsize := int64(st.Bsize)
+	usage := FsUsage{
+		Total: int64(st.Blocks) * bsize,
+		Free:  int64(st.Bfree) * bsize,
+		Avail: int64(st.Bavail) * bsize,
+	}
+	usage.Used = usage.Total - usage.Free
+
+	return usage, nil
+}
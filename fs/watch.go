@@ -0,0 +1,580 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/running910/gokit/logger"
+	"golang.org/x/sys/unix"
+)
+
+type WatchOp uint32
+
+const (
+	WatchCreate WatchOp = 1 << iota
+	WatchWrite
+	WatchRemove
+	WatchRename
+	WatchChmod
+)
+
+func (op WatchOp) Has(o WatchOp) bool {
+	return op&o != 0
+}
+
+func (op WatchOp) String() string {
+	var names []string
+	for _, o := range []struct {
+		op   WatchOp
+		name string
+	}{{WatchCreate, "CREATE"}, {WatchWrite, "WRITE"}, {WatchRemove, "REMOVE"}, {WatchRename, "RENAME"}, {WatchChmod, "CHMOD"}} {
+		if op.Has(o.op) {
+			names = append(names, o.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// WatchEvent is a change of Path, the ops of the changes coalesced by the debouncing are
+// or'ed together
+type WatchEvent struct {
+	Path string
+	Op   WatchOp
+}
+
+type WatchOptions struct {
+	// watch the directories below the added ones too, those created later included
+	Recursive bool
+	// changes of a path are delivered once it has been quiet for Debounce, default 100ms,
+	// negative to deliver every change right away
+	Debounce time.Duration
+	// poll instead of inotify, which is also used when inotify is not available
+	Poll bool
+	// default 1s
+	PollInterval time.Duration
+}
+
+func (o WatchOptions) withDefaults() WatchOptions {
+	if o.Debounce == 0 {
+		o.Debounce = 100 * time.Millisecond
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = time.Second
+	}
+	return o
+}
+
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// dirWatch is an inotify watch of a directory, for all its entries or only some names when
+// watching files, as files are watched through their directory to survive their replacement
+type dirWatch struct {
+	dir       string
+	all       bool
+	recursive bool
+	names     map[string]bool
+}
+
+type pollRoot struct {
+	recursive bool
+}
+
+type fileState struct {
+	size  int64
+	mtime time.Time
+	mode  os.FileMode
+	ino   uint64
+}
+
+// Watcher delivers the changes of the files and directories added to it on Events, until
+// the context it was created with is done, then Events and Errors are closed
+type Watcher struct {
+	opts   WatchOptions
+	ctx    context.Context
+	events chan WatchEvent
+	errors chan error
+	raw    chan WatchEvent
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	inotify  *os.File
+	watches  map[int]*dirWatch
+	dirs     map[string]int
+	roots    map[string]pollRoot
+	snapshot map[string]fileState
+}
+
+// NewWatcher returns a watcher without paths, see Add
+func NewWatcher(ctx context.Context, opts WatchOptions) (*Watcher, error) {
+	w := &Watcher{
+		opts:     opts.withDefaults(),
+		ctx:      ctx,
+		events:   make(chan WatchEvent, 64),
+		errors:   make(chan error, 16),
+		raw:      make(chan WatchEvent, 64),
+		watches:  make(map[int]*dirWatch),
+		dirs:     make(map[string]int),
+		roots:    make(map[string]pollRoot),
+		snapshot: make(map[string]fileState),
+	}
+
+	if !w.opts.Poll {
+		fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+		if err != nil {
+			logger.Errorf("inotify init failed, polling instead! reason:%s", err)
+			w.opts.Poll = true
+		} else {
+			// non blocking, reads wait in the runtime poller and Close interrupts them
+			w.inotify = os.NewFile(uintptr(fd), "inotify")
+		}
+	}
+
+	w.wg.Add(2)
+	if w.opts.Poll {
+		go w.poll()
+	} else {
+		go w.readInotify()
+	}
+	go w.debounce()
+
+	go func() {
+		<-ctx.Done()
+		if w.inotify != nil {
+			w.inotify.Close()
+		}
+		w.wg.Wait()
+		close(w.events)
+		close(w.errors)
+	}()
+
+	return w, nil
+}
+
+// Watch returns a watcher of paths
+func Watch(ctx context.Context, opts WatchOptions, paths ...string) (*Watcher, error) {
+	w, err := NewWatcher(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		if err := w.Add(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return w, nil
+}
+
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Errors delivers the errors of the watching, as lost events, without stopping it
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+		logger.Errorf("watcher error dropped! reason:%s", err)
+	}
+}
+
+func (w *Watcher) sendRaw(events []WatchEvent) {
+	for _, ev := range events {
+		select {
+		case w.raw <- ev:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// Add watches path, a directory for its entries or a file, which may not exist yet as long
+// as its directory does. Files survive being replaced by a rename, as editors save them.
+func (w *Watcher) Add(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	isDir := err == nil && info.IsDir()
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorf("watch %s failed! reason:%s", path, err)
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opts.Poll {
+		if !isDir && !IsDir(filepath.Dir(path)) {
+			return fmt.Errorf("watch %s: %w", path, os.ErrNotExist)
+		}
+		w.roots[path] = pollRoot{recursive: isDir && w.opts.Recursive}
+		for p, state := range w.scan(path, w.roots[path]) {
+			w.snapshot[p] = state
+		}
+		return nil
+	}
+
+	if isDir {
+		_, err = w.addDir(path, "", w.opts.Recursive)
+	} else {
+		_, err = w.addDir(filepath.Dir(path), filepath.Base(path), false)
+	}
+	if err != nil {
+		logger.Errorf("watch %s failed! reason:%s", path, err)
+	}
+	return err
+}
+
+// addDir watches dir, for name only when not empty, and its subdirectories when recursive.
+// It returns the entries found in the subdirectories, which may have been created before
+// their watch.
+func (w *Watcher) addDir(dir string, name string, recursive bool) ([]string, error) {
+	wd, err := unix.InotifyAddWatch(int(w.inotify.Fd()), dir, inotifyMask)
+	if err != nil {
+		if errors.Is(err, unix.ENOSPC) {
+			return nil, fmt.Errorf("inotify watch limit reached, raise fs.inotify.max_user_watches or poll: %w", err)
+		}
+		return nil, err
+	}
+
+	watch, ok := w.watches[wd]
+	if !ok {
+		watch = &dirWatch{dir: dir, names: make(map[string]bool)}
+		w.watches[wd] = watch
+		w.dirs[dir] = wd
+	}
+	if name == "" {
+		watch.all = true
+		watch.recursive = watch.recursive || recursive
+	} else {
+		watch.names[name] = true
+	}
+
+	if name != "" || !recursive {
+		return nil, nil
+	}
+
+	var found []string
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		found = append(found, path)
+		if entry.IsDir() {
+			sub, err := w.addDir(path, "", true)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, sub...)
+		}
+	}
+
+	return found, nil
+}
+
+func (w *Watcher) readInotify() {
+	defer w.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			if w.ctx.Err() == nil && !errors.Is(err, os.ErrClosed) {
+				logger.Errorf("read inotify failed! reason:%s", err)
+				w.sendError(err)
+			}
+			return
+		}
+
+		var events []WatchEvent
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+			events = append(events, w.handleInotify(int(raw.Wd), raw.Mask, name)...)
+		}
+
+		w.sendRaw(events)
+	}
+}
+
+func (w *Watcher) handleInotify(wd int, mask uint32, name string) []WatchEvent {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		w.sendError(errors.New("inotify queue overflow, events lost"))
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watch, ok := w.watches[wd]
+	if !ok {
+		return nil
+	}
+
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+		if w.dirs[watch.dir] == wd {
+			delete(w.dirs, watch.dir)
+		}
+		return nil
+	}
+
+	if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+		// a moved directory keeps its watch under a path we do not know anymore
+		if mask&unix.IN_MOVE_SELF != 0 {
+			unix.InotifyRmWatch(int(w.inotify.Fd()), uint32(wd))
+		}
+		if watch.all {
+			return []WatchEvent{{Path: watch.dir, Op: WatchRemove}}
+		}
+		return nil
+	}
+
+	if !watch.all && !watch.names[name] {
+		return nil
+	}
+
+	path := filepath.Join(watch.dir, name)
+	var op WatchOp
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		op = WatchCreate
+	case mask&unix.IN_MODIFY != 0:
+		op = WatchWrite
+	case mask&unix.IN_DELETE != 0:
+		op = WatchRemove
+	case mask&unix.IN_MOVED_FROM != 0:
+		op = WatchRename
+	case mask&unix.IN_ATTRIB != 0:
+		op = WatchChmod
+	default:
+		return nil
+	}
+
+	// a file renamed over an added file is how editors save it, the file was written
+	if mask&unix.IN_MOVED_TO != 0 && watch.names[name] {
+		op = WatchWrite
+	}
+
+	events := []WatchEvent{{Path: path, Op: op}}
+
+	if op == WatchCreate && mask&unix.IN_ISDIR != 0 && watch.recursive {
+		found, err := w.addDir(path, "", true)
+		if err != nil {
+			w.sendError(fmt.Errorf("watch %s: %w", path, err))
+		}
+		for _, p := range found {
+			events = append(events, WatchEvent{Path: p, Op: WatchCreate})
+		}
+	}
+
+	return events
+}
+
+// scan returns the state of root and, for a directory, of its entries
+func (w *Watcher) scan(root string, r pollRoot) map[string]fileState {
+	states := make(map[string]fileState)
+
+	add := func(path string, info os.FileInfo) {
+		state := fileState{size: info.Size(), mtime: info.ModTime(), mode: info.Mode()}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			state.ino = st.Ino
+		}
+		states[path] = state
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return states
+	}
+	add(root, info)
+
+	if !info.IsDir() {
+		return states
+	}
+
+	filepath.WalkDir(root, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			add(path, info)
+		}
+		if d.IsDir() && !r.recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	return states
+}
+
+func (w *Watcher) poll() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		current := make(map[string]fileState, len(w.snapshot))
+		for root, r := range w.roots {
+			for path, state := range w.scan(root, r) {
+				current[path] = state
+			}
+		}
+
+		var events []WatchEvent
+		for path, state := range current {
+			old, ok := w.snapshot[path]
+			switch {
+			case !ok:
+				events = append(events, WatchEvent{Path: path, Op: WatchCreate})
+			case old.ino != state.ino || old.size != state.size || !old.mtime.Equal(state.mtime):
+				events = append(events, WatchEvent{Path: path, Op: WatchWrite})
+			case old.mode != state.mode:
+				events = append(events, WatchEvent{Path: path, Op: WatchChmod})
+			}
+		}
+		for path := range w.snapshot {
+			if _, ok := current[path]; !ok {
+				events = append(events, WatchEvent{Path: path, Op: WatchRemove})
+			}
+		}
+		w.snapshot = current
+		w.mu.Unlock()
+
+		w.sendRaw(events)
+	}
+}
+
+// coalesce turns the ops seen on path during the debouncing into what changed: a file
+// removed or renamed away then created again was replaced, a file created then removed did
+// not change.
+func coalesce(path string, op WatchOp) (WatchOp, bool) {
+	if !op.Has(WatchRemove | WatchRename) {
+		return op, true
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		return WatchWrite | op&WatchChmod, true
+	}
+
+	if op.Has(WatchCreate) {
+		return 0, false
+	}
+	return op & (WatchRemove | WatchRename), true
+}
+
+type pendingOp struct {
+	op   WatchOp
+	last time.Time
+}
+
+func (w *Watcher) emit(ev WatchEvent) bool {
+	select {
+	case w.events <- ev:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+func (w *Watcher) debounce() {
+	defer w.wg.Done()
+
+	debounce := w.opts.Debounce
+	pending := make(map[string]*pendingOp)
+	var order []string
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	armed := false
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+
+		case ev := <-w.raw:
+			if debounce < 0 {
+				if !w.emit(ev) {
+					return
+				}
+				continue
+			}
+
+			p, ok := pending[ev.Path]
+			if !ok {
+				p = &pendingOp{}
+				pending[ev.Path] = p
+				order = append(order, ev.Path)
+			}
+			p.op |= ev.Op
+			p.last = time.Now()
+
+			if !armed {
+				timer.Reset(debounce)
+				armed = true
+			}
+
+		case now := <-timer.C:
+			armed = false
+			next := debounce
+
+			keep := order[:0]
+			for _, path := range order {
+				p := pending[path]
+				if quiet := now.Sub(p.last); quiet < debounce {
+					keep = append(keep, path)
+					if debounce-quiet < next {
+						next = debounce - quiet
+					}
+					continue
+				}
+
+				delete(pending, path)
+				if op, ok := coalesce(path, p.op); ok {
+					if !w.emit(WatchEvent{Path: path, Op: op}) {
+						return
+					}
+				}
+			}
+			order = keep
+
+			if len(order) > 0 {
+				timer.Reset(next)
+				armed = true
+			}
+		}
+	}
+}
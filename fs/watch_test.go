@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of w for path, skipping the others
+func nextEvent(t *testing.T, w *Watcher, path string) WatchEvent {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("events closed waiting for %s", path)
+			}
+			if ev.Path == path {
+				return ev
+			}
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("no event for %s", path)
+		}
+	}
+}
+
+func testWatch(t *testing.T, opts WatchOptions) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.conf")
+	if err := os.WriteFile(file, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts.Recursive = true
+	w, err := Watch(ctx, opts, file, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an editor save, written aside then renamed over, is a write of the file
+	tmp := filepath.Join(dir, ".app.conf.swp")
+	if err := os.WriteFile(tmp, []byte("bb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w, file); ev.Op != WatchWrite {
+		t.Fatalf("replaced file got %s", ev.Op)
+	}
+
+	// files of a directory created after Watch are watched
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w, sub); !ev.Op.Has(WatchCreate) {
+		t.Fatalf("new directory got %s", ev.Op)
+	}
+	nested := filepath.Join(sub, "nested")
+	if err := os.WriteFile(nested, []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w, nested); !ev.Op.Has(WatchCreate) {
+		t.Fatalf("nested file got %s", ev.Op)
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextEvent(t, w, file); ev.Op != WatchRemove {
+		t.Fatalf("removed file got %s", ev.Op)
+	}
+
+	cancel()
+	for range w.Events() {
+	}
+	if _, ok := <-w.Errors(); ok {
+		t.Fatal("errors not closed on cancel")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	testWatch(t, WatchOptions{Debounce: 50 * time.Millisecond})
+}
+
+func TestWatchPoll(t *testing.T) {
+	testWatch(t, WatchOptions{Poll: true, PollInterval: 20 * time.Millisecond, Debounce: 50 * time.Millisecond})
+}
+
+func TestWatchOpString(t *testing.T) {
+	if s := (WatchCreate | WatchWrite).String(); s != "CREATE|WRITE" {
+		t.Fatalf("got %q", s)
+	}
+}
@@ -95,6 +95,16 @@ func LogInit(isDev bool, level string, logFile string, maxSizeMB int, maxBackups
 		Compress:   compress,
 	}
 
+	initZap(isDev, level, fixedCstZone, zapcore.AddSync(hook))
+}
+
+// LogInitStdout logs to stdout through zap, unlike LogInit with "-" the level is honoured and
+// can be changed by SetLogLevel
+func LogInitStdout(isDev bool, level string, fixedCstZone bool) {
+	initZap(isDev, level, fixedCstZone, zapcore.Lock(os.Stdout))
+}
+
+func initZap(isDev bool, level string, fixedCstZone bool, ws zapcore.WriteSyncer) {
 	encodeTimefunc := TimeEncoder
 	if fixedCstZone {
 		encodeTimefunc = TimeEncoderFixedCstZone
@@ -118,9 +128,9 @@ func LogInit(isDev bool, level string, logFile string, maxSizeMB int, maxBackups
 	atomicLevel.SetLevel(zapcore.Level(getLevel(level)))
 
 	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(encoderConfig),           // 编码器配置
-		zapcore.NewMultiWriteSyncer(zapcore.AddSync(hook)), // 打印到文件
-		atomicLevel, // 日志级别
+		zapcore.NewConsoleEncoder(encoderConfig), // 编码器配置
+		zapcore.NewMultiWriteSyncer(ws),          // 打印到文件或标准输出
+		atomicLevel,                              // 日志级别
 	)
 
 	if isDev {
@@ -0,0 +1,288 @@
+package misc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lg "github.com/running910/gokit/logger"
+	"golang.org/x/sys/unix"
+)
+
+// HugepagePool is the hugepages of one size, system wide or on one numa node
+type HugepagePool struct {
+	SizeKB int
+	// -1 for the system wide pool
+	Node  int
+	Total int
+	Free  int
+	// reserved by mappings but not faulted in yet, only reported system wide
+	Reserved int
+	Surplus  int
+}
+
+func hugepagesDir(sizeKB int, node int) string {
+	name := fmt.Sprintf("hugepages-%dkB", sizeKB)
+	if node < 0 {
+		return SysfsPath("kernel/mm/hugepages", name)
+	}
+	return SysfsPath("devices/system/node", fmt.Sprintf("node%d", node), "hugepages", name)
+}
+
+// GetHugepageSizes returns the supported hugepage sizes in kB, smallest first
+func GetHugepageSizes() ([]int, error) {
+	entries, err := os.ReadDir(SysfsPath("kernel/mm/hugepages"))
+	if err != nil {
+		lg.Errorf("read hugepage sizes failed! reason:%s", err)
+		return nil, err
+	}
+
+	var sizes []int
+	for _, entry := range entries {
+		var size int
+		if _, err := fmt.Sscanf(entry.Name(), "hugepages-%dkB", &size); err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// GetHugepages returns the pool of sizeKB pages on node, -1 for the system wide pool
+func GetHugepages(sizeKB int, node int) (HugepagePool, error) {
+	dir := hugepagesDir(sizeKB, node)
+	pool := HugepagePool{SizeKB: sizeKB, Node: node}
+
+	if _, err := os.Stat(dir); err != nil {
+		return pool, fmt.Errorf("no %dkB hugepages on node %d", sizeKB, node)
+	}
+
+	for _, attr := range []struct {
+		name  string
+		value *int
+	}{
+		{"nr_hugepages", &pool.Total},
+		{"free_hugepages", &pool.Free},
+		{"resv_hugepages", &pool.Reserved},
+		{"surplus_hugepages", &pool.Surplus},
+	} {
+		var err error
+		if *attr.value, err = readSysfsInt(filepath.Join(dir, attr.name), 0); err != nil {
+			lg.Errorf("read %s of %s failed! reason:%s", attr.name, dir, err)
+			return pool, err
+		}
+	}
+
+	return pool, nil
+}
+
+// ListHugepages returns the system wide pool of every size followed by the pools of every
+// numa node
+func ListHugepages() ([]HugepagePool, error) {
+	sizes, err := GetHugepageSizes()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := ListNumaNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var pools []HugepagePool
+	for _, node := range append([]int{-1}, nodes...) {
+		for _, size := range sizes {
+			pool, err := GetHugepages(size, node)
+			if err != nil {
+				return nil, err
+			}
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools, nil
+}
+
+// SetHugepages sets the number of sizeKB pages on node, -1 for the system wide pool. The
+// kernel may not find enough contiguous memory, it is an error to get fewer pages.
+func SetHugepages(sizeKB int, node int, count int) error {
+	if count < 0 {
+		return fmt.Errorf("invalid hugepage count %d", count)
+	}
+
+	file := filepath.Join(hugepagesDir(sizeKB, node), "nr_hugepages")
+	if err := writeSysfsString(file, strconv.Itoa(count)); err != nil {
+		lg.Errorf("set %d %dkB hugepages on node %d failed! reason:%s", count, sizeKB, node, err)
+		return err
+	}
+
+	got, err := readSysfsInt(file, 0)
+	if err != nil {
+		return err
+	} else if got < count {
+		return fmt.Errorf("got %d of %d %dkB hugepages on node %d", got, count, sizeKB, node)
+	}
+
+	lg.Infof("%d %dkB hugepages on node %d", got, sizeKB, node)
+	return nil
+}
+
+// ListNumaNodes returns the ids of the online numa nodes
+func ListNumaNodes() ([]int, error) {
+	content, err := readSysfsString(SysfsPath("devices/system/node/online"))
+	if os.IsNotExist(err) {
+		// kernel without numa support
+		return []int{0}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return ParseCpuList(content)
+}
+
+// GetNumaNodeCpus returns the cpus of node
+func GetNumaNodeCpus(node int) ([]int, error) {
+	content, err := readSysfsString(SysfsPath("devices/system/node", fmt.Sprintf("node%d", node), "cpulist"))
+	if err != nil {
+		lg.Errorf("read cpus of numa node %d failed! reason:%s", node, err)
+		return nil, err
+	}
+
+	return ParseCpuList(content)
+}
+
+// GetNicNumaNode returns the numa node of the pci device of nic, -1 when unknown
+func GetNicNumaNode(nic string) (int, error) {
+	slot, err := GetNicPciSlotId(nic)
+	if err != nil {
+		return -1, err
+	}
+
+	return readSysfsInt(SysfsPath("bus/pci/devices", slot, "numa_node"), -1)
+}
+
+// GetNicLocalCpus returns the cpus close to the pci device of nic, where its queues should
+// be polled
+func GetNicLocalCpus(nic string) ([]int, error) {
+	slot, err := GetNicPciSlotId(nic)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := readSysfsString(SysfsPath("bus/pci/devices", slot, "local_cpulist"))
+	if err != nil {
+		lg.Errorf("read local cpus of nic %s failed! reason:%s", nic, err)
+		return nil, err
+	}
+
+	return ParseCpuList(content)
+}
+
+// ParseCpuList parses a kernel cpu list as 0-3,8,10-11
+func ParseCpuList(list string) ([]int, error) {
+	var cpus []int
+
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return cpus, nil
+	}
+
+	for _, part := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// parseHugetlbfsPageSize parses the pagesize mount option, as 2M or 1G, into kB
+func parseHugetlbfsPageSize(s string) (int, error) {
+	units := map[byte]int{'K': 1, 'M': 1024, 'G': 1024 * 1024}
+	if len(s) < 2 || units[s[len(s)-1]] == 0 {
+		return 0, fmt.Errorf("invalid hugetlbfs pagesize %q", s)
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid hugetlbfs pagesize %q", s)
+	}
+
+	return n * units[s[len(s)-1]], nil
+}
+
+// hugetlbfsMountPageSize returns the page size in kB of the hugetlbfs mounted on path, 0 if
+// none is mounted there
+func hugetlbfsMountPageSize(path string) (int, error) {
+	content, err := os.ReadFile(ProcfsPath("self/mounts"))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != path || fields[2] != "hugetlbfs" {
+			continue
+		}
+
+		for _, option := range strings.Split(fields[3], ",") {
+			if strings.HasPrefix(option, "pagesize=") {
+				return parseHugetlbfsPageSize(strings.TrimPrefix(option, "pagesize="))
+			}
+		}
+		return 0, fmt.Errorf("no pagesize in hugetlbfs mount options %q of %s", fields[3], path)
+	}
+
+	return 0, nil
+}
+
+// MountHugetlbfs mounts a hugetlbfs of sizeKB pages on path, 0 for the default size. It does
+// nothing if one is already mounted there, and fails if its page size is not sizeKB.
+func MountHugetlbfs(path string, sizeKB int) error {
+	path = filepath.Clean(path)
+
+	if mountedKB, err := hugetlbfsMountPageSize(path); err != nil {
+		lg.Errorf("check hugetlbfs mount %s failed! reason:%s", path, err)
+		return err
+	} else if mountedKB != 0 {
+		if sizeKB > 0 && mountedKB != sizeKB {
+			lg.Errorf("mount hugetlbfs on %s failed! reason:mounted with %dkB pages, want %dkB", path, mountedKB, sizeKB)
+			return fmt.Errorf("hugetlbfs on %s has %dkB pages, not %dkB", path, mountedKB, sizeKB)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		lg.Errorf("create %s failed! reason:%s", path, err)
+		return err
+	}
+
+	options := ""
+	if sizeKB > 0 {
+		options = fmt.Sprintf("pagesize=%dK", sizeKB)
+	}
+
+	if err := unix.Mount("nodev", path, "hugetlbfs", 0, options); err != nil {
+		lg.Errorf("mount hugetlbfs %s on %s failed! reason:%s", options, path, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package misc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func TestParseCpuList(t *testing.T) {
+	for list, want := range map[string][]int{
+		"0":             {0},
+		"0-3,8,10-11\n": {0, 1, 2, 3, 8, 10, 11},
+		"":              nil,
+	} {
+		cpus, err := ParseCpuList(list)
+		if err != nil || !reflect.DeepEqual(cpus, want) {
+			t.Errorf("ParseCpuList(%q) = %v %v, want %v", list, cpus, err, want)
+		}
+	}
+
+	for _, list := range []string{"a", "3-1", "1-"} {
+		if _, err := ParseCpuList(list); err == nil {
+			t.Errorf("ParseCpuList(%q) expect an error", list)
+		}
+	}
+}
+
+func TestHugepages(t *testing.T) {
+	tree := sysfstest.New(t)
+	for file, content := range map[string]string{
+		"kernel/mm/hugepages/hugepages-2048kB/nr_hugepages":                    "1024",
+		"kernel/mm/hugepages/hugepages-2048kB/free_hugepages":                  "1000",
+		"kernel/mm/hugepages/hugepages-2048kB/resv_hugepages":                  "8",
+		"kernel/mm/hugepages/hugepages-1048576kB/nr_hugepages":                 "0",
+		"devices/system/node/online":                                           "0-1",
+		"devices/system/node/node0/hugepages/hugepages-2048kB/nr_hugepages":    "512",
+		"devices/system/node/node0/hugepages/hugepages-1048576kB/nr_hugepages": "0",
+		"devices/system/node/node1/hugepages/hugepages-2048kB/nr_hugepages":    "512",
+		"devices/system/node/node1/hugepages/hugepages-2048kB/free_hugepages":  "500",
+		"devices/system/node/node1/hugepages/hugepages-1048576kB/nr_hugepages": "0",
+		"devices/system/node/node1/cpulist":                                    "8-15",
+	} {
+		tree.WriteSys(file, content)
+	}
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:81:00.0", NumaNode: 1, LocalCpus: "8-15", Netdevs: []string{"ens2f0"}})
+	tree.AddMount("nodev", "/dev/hugepages", "hugetlbfs", "rw,relatime,pagesize=2M")
+	useTree(t, tree)
+
+	pools, err := ListHugepages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 6 {
+		t.Fatalf("got %d pools, want 6", len(pools))
+	}
+	if want := (HugepagePool{SizeKB: 2048, Node: -1, Total: 1024, Free: 1000, Reserved: 8}); pools[0] != want {
+		t.Fatalf("got %+v, want %+v", pools[0], want)
+	}
+	if want := (HugepagePool{SizeKB: 2048, Node: 1, Total: 512, Free: 500}); pools[4] != want {
+		t.Fatalf("got %+v, want %+v", pools[4], want)
+	}
+
+	if err := SetHugepages(2048, 1, 256); err != nil {
+		t.Fatal(err)
+	}
+	if pool, _ := GetHugepages(2048, 1); pool.Total != 256 {
+		t.Fatalf("node 1 has %d pages, want 256", pool.Total)
+	}
+	if _, err := GetHugepages(4096, -1); err == nil {
+		t.Fatal("expect an error for an unsupported size")
+	}
+
+	if cpus, err := GetNumaNodeCpus(1); err != nil || len(cpus) != 8 || cpus[0] != 8 {
+		t.Fatalf("node 1 cpus %v %v", cpus, err)
+	}
+	if node, err := GetNicNumaNode("ens2f0"); err != nil || node != 1 {
+		t.Fatalf("nic numa node %d %v", node, err)
+	}
+	if cpus, err := GetNicLocalCpus("ens2f0"); err != nil || len(cpus) != 8 || cpus[7] != 15 {
+		t.Fatalf("nic local cpus %v %v", cpus, err)
+	}
+	if err := MountHugetlbfs("/dev/hugepages", 2048); err != nil {
+		t.Fatalf("expect the mounted hugetlbfs to be kept, got %v", err)
+	}
+	if err := MountHugetlbfs("/dev/hugepages/", 0); err != nil {
+		t.Fatalf("expect the mounted hugetlbfs to serve the default size, got %v", err)
+	}
+	if err := MountHugetlbfs("/dev/hugepages", 1048576); err == nil {
+		t.Fatal("expect an error for a hugetlbfs mounted with another page size")
+	}
+
+	for option, want := range map[string]int{"64K": 64, "2M": 2048, "1G": 1048576, "2": 0, "M": 0, "0M": 0} {
+		if got, _ := parseHugetlbfsPageSize(option); got != want {
+			t.Errorf("parseHugetlbfsPageSize(%q) = %d, want %d", option, got, want)
+		}
+	}
+}
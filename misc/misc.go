@@ -18,22 +18,8 @@ func Hello() {
 	fmt.Println("this is from gokit misc package.")
 }
 
-// status orignal driverdetached vfioattached unknown
-type pci_nic struct {
-	Name   string
-	Driver string
-	SlotId string
-	Vendor string
-	Device string
-	Status int
-}
-
-func (p *pci_nic) UpdateStatus() {
-
-}
-
 func GetNicVendor(nic string) (string, error) {
-	file := fmt.Sprintf("/sys/class/net/%s/device/vendor", nic)
+	file := SysfsPath("class/net", nic, "device/vendor")
 
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -44,7 +30,7 @@ func GetNicVendor(nic string) (string, error) {
 }
 
 func GetNicDevice(nic string) (string, error) {
-	file := fmt.Sprintf("/sys/class/net/%s/device/device", nic)
+	file := SysfsPath("class/net", nic, "device/device")
 
 	content, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -57,7 +43,7 @@ func GetNicDevice(nic string) (string, error) {
 func GetNicDriver(nic string) (string, error) {
 
 	// realpath /sys/class/net/ens37/device/driver/module/
-	moduleFile := fmt.Sprintf("/sys/class/net/%s/device/driver/module", nic)
+	moduleFile := SysfsPath("class/net", nic, "device/driver/module")
 
 	devicePath, err := os.Readlink(moduleFile)
 	if err != nil {
@@ -77,51 +63,51 @@ func GetNicDriver(nic string) (string, error) {
 
 func GetNicPciSlotId(nic string) (string, error) {
 
-	interfacePath := filepath.Join("/sys/class/net", nic)
-	devicePath, err := os.Readlink(interfacePath)
+	// /sys/class/net/eth0/device is the pci device, or a child of it as virtio2 for virtio nics
+	devicePath, err := filepath.EvalSymlinks(SysfsPath("class/net", nic, "device"))
 	if err != nil {
 		return "", err
 	}
 
-	tokens := strings.Split(devicePath, "/")
-	if len(tokens) < 3 {
-		return "", fmt.Errorf("nic device path format error")
+	for path := devicePath; path != "/" && path != "."; path = filepath.Dir(path) {
+		if _, err := os.Stat(filepath.Join(path, "subsystem_vendor")); err == nil {
+			if subsystem, _ := readSysfsLinkBase(filepath.Join(path, "subsystem")); subsystem == "pci" {
+				return filepath.Base(path), nil
+			}
+		}
 	}
-	pciSlot := tokens[len(tokens)-3]
-
-	return pciSlot, nil
-}
 
-func GetPciDevDriver(pciSlotId string) (string, error) {
-	return "", nil
+	return "", fmt.Errorf("nic %s is not a pci device", nic)
 }
 
 func DetachPciDevDriver(pciSlotId string, driver string) error {
-	unbindFile := fmt.Sprintf("/sys/bus/pci/drivers/%s/unbind", driver)
+	unbindFile := SysfsPath("bus/pci/drivers", driver, "unbind")
 
-	return ioutil.WriteFile(unbindFile, []byte(pciSlotId), os.ModeExclusive)
+	return writeSysfsString(unbindFile, pciSlotId)
 }
 
 func AttachPciDevDriver(pciSlotId string, driver string) error {
-	bindFile := fmt.Sprintf("/sys/bus/pci/drivers/%s/bind", driver)
+	bindFile := SysfsPath("bus/pci/drivers", driver, "bind")
 
-	return ioutil.WriteFile(bindFile, []byte(pciSlotId), os.ModeExclusive)
+	return writeSysfsString(bindFile, pciSlotId)
 }
 
+// AttachPciDevToVfioDriver binds every device with the vendor and device ids to vfio-pci,
+// use BindToVfio to bind a single device
 func AttachPciDevToVfioDriver(vendor string, device string) error {
-	bindFile := fmt.Sprintf("/sys/bus/pci/drivers/vfio-pci/new_id")
+	bindFile := SysfsPath("bus/pci/drivers/vfio-pci/new_id")
 
 	content := fmt.Sprintf("%s %s", vendor, device)
 
-	return ioutil.WriteFile(bindFile, []byte(content), os.ModeExclusive)
+	return writeSysfsString(bindFile, content)
 }
 
 func DetachPciDevToVfioDriver(pciSlotId string) error {
-	bindFile := fmt.Sprintf("/sys/bus/pci/drivers/vfio-pci/unbind")
+	bindFile := SysfsPath("bus/pci/drivers/vfio-pci/unbind")
 
 	content := fmt.Sprintf("%s", pciSlotId)
 
-	return ioutil.WriteFile(bindFile, []byte(content), os.ModeExclusive)
+	return writeSysfsString(bindFile, content)
 }
 
 func PrettyPrint(i interface{}) string {
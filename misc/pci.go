@@ -0,0 +1,215 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lg "github.com/running910/gokit/logger"
+)
+
+type PciDevice struct {
+	// domain:bus:device.function, as 0000:03:00.0
+	Slot            string
+	Vendor          string
+	Device          string
+	SubsystemVendor string
+	SubsystemDevice string
+	// base class, subclass and programming interface, as 0x020000 for an ethernet controller
+	Class string
+	// bound driver, empty if none
+	Driver string
+	// -1 when the platform does not report it
+	NumaNode int
+	// -1 when the iommu is off
+	IommuGroup int
+	// virtual functions the device supports and has enabled, 0 when not SR-IOV capable
+	SriovTotalVfs int
+	SriovNumVfs   int
+	// slot of the physical function for a virtual function, empty otherwise
+	PhysFn string
+	// names of the network interfaces of the device
+	Netdevs []string
+}
+
+// IsNetwork reports whether the device is a network controller
+func (d *PciDevice) IsNetwork() bool {
+	return strings.HasPrefix(d.Class, "0x02")
+}
+
+// IsVf reports whether the device is an SR-IOV virtual function
+func (d *PciDevice) IsVf() bool {
+	return d.PhysFn != ""
+}
+
+// PciFilter selects devices in ListPciDevices, empty fields match any device. Ids are
+// compared without case or 0x prefix.
+type PciFilter struct {
+	Vendor string
+	Device string
+	// prefix of the class, as 0x02 for network controllers
+	Class  string
+	Driver string
+	// only devices with at least one netdev
+	HasNetdev bool
+	// only SR-IOV physical functions
+	SriovCapable bool
+}
+
+func normalizePciId(id string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(id)), "0x")
+}
+
+func (f *PciFilter) match(d *PciDevice) bool {
+	if f.Vendor != "" && normalizePciId(f.Vendor) != normalizePciId(d.Vendor) {
+		return false
+	}
+	if f.Device != "" && normalizePciId(f.Device) != normalizePciId(d.Device) {
+		return false
+	}
+	if f.Class != "" && !strings.HasPrefix(normalizePciId(d.Class), normalizePciId(f.Class)) {
+		return false
+	}
+	if f.Driver != "" && f.Driver != d.Driver {
+		return false
+	}
+	if f.HasNetdev && len(d.Netdevs) == 0 {
+		return false
+	}
+	if f.SriovCapable && d.SriovTotalVfs == 0 {
+		return false
+	}
+	return true
+}
+
+// pciDevNetdevs lists net/ of the device, and net/ of its virtio child for virtio devices
+func pciDevNetdevs(devPath string) []string {
+	var netdevs []string
+	for _, pattern := range []string{"net/*", "virtio*/net/*"} {
+		matches, _ := filepath.Glob(filepath.Join(devPath, pattern))
+		for _, match := range matches {
+			netdevs = append(netdevs, filepath.Base(match))
+		}
+	}
+
+	sort.Strings(netdevs)
+	return netdevs
+}
+
+func GetPciDevice(pciSlotId string) (*PciDevice, error) {
+	devPath := SysfsPath("bus/pci/devices", pciSlotId)
+	if _, err := os.Stat(devPath); err != nil {
+		lg.Errorf("pci device %s not found! reason:%s", pciSlotId, err)
+		return nil, err
+	}
+
+	dev := &PciDevice{Slot: pciSlotId}
+
+	for _, attr := range []struct {
+		name  string
+		value *string
+	}{
+		{"vendor", &dev.Vendor},
+		{"device", &dev.Device},
+		{"subsystem_vendor", &dev.SubsystemVendor},
+		{"subsystem_device", &dev.SubsystemDevice},
+		{"class", &dev.Class},
+	} {
+		value, err := readSysfsString(filepath.Join(devPath, attr.name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			lg.Errorf("read %s of pci device %s failed! reason:%s", attr.name, pciSlotId, err)
+			return nil, err
+		}
+		*attr.value = value
+	}
+
+	var err error
+	if dev.NumaNode, err = readSysfsInt(filepath.Join(devPath, "numa_node"), -1); err != nil {
+		return nil, err
+	}
+	if dev.SriovTotalVfs, err = readSysfsInt(filepath.Join(devPath, "sriov_totalvfs"), 0); err != nil {
+		return nil, err
+	}
+	if dev.SriovNumVfs, err = readSysfsInt(filepath.Join(devPath, "sriov_numvfs"), 0); err != nil {
+		return nil, err
+	}
+
+	if dev.Driver, err = readSysfsLinkBase(filepath.Join(devPath, "driver")); err != nil {
+		return nil, err
+	}
+	if dev.PhysFn, err = readSysfsLinkBase(filepath.Join(devPath, "physfn")); err != nil {
+		return nil, err
+	}
+
+	dev.IommuGroup = -1
+	group, err := readSysfsLinkBase(filepath.Join(devPath, "iommu_group"))
+	if err != nil {
+		return nil, err
+	} else if group != "" {
+		if dev.IommuGroup, err = strconv.Atoi(group); err != nil {
+			return nil, fmt.Errorf("pci device %s invalid iommu group %q", pciSlotId, group)
+		}
+	}
+
+	dev.Netdevs = pciDevNetdevs(devPath)
+
+	return dev, nil
+}
+
+// ListPciDevices returns the devices matching filter sorted by slot, a nil filter matches all
+func ListPciDevices(filter *PciFilter) ([]*PciDevice, error) {
+	entries, err := os.ReadDir(SysfsPath("bus/pci/devices"))
+	if err != nil {
+		lg.Errorf("list pci devices failed! reason:%s", err)
+		return nil, err
+	}
+
+	var devices []*PciDevice
+	for _, entry := range entries {
+		dev, err := GetPciDevice(entry.Name())
+		if errors.Is(err, fs.ErrNotExist) {
+			// hot removed, or a vf destroyed, since the listing
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if filter == nil || filter.match(dev) {
+			devices = append(devices, dev)
+		}
+	}
+
+	return devices, nil
+}
+
+// GetPciDevDriver returns the driver bound to the device, empty if it is not bound
+func GetPciDevDriver(pciSlotId string) (string, error) {
+	devPath := SysfsPath("bus/pci/devices", pciSlotId)
+	if _, err := os.Stat(devPath); err != nil {
+		return "", err
+	}
+
+	return readSysfsLinkBase(filepath.Join(devPath, "driver"))
+}
+
+// GetPciDevIommuGroupDevices returns the slots of the devices sharing the iommu group of the
+// device, itself included
+func GetPciDevIommuGroupDevices(pciSlotId string) ([]string, error) {
+	entries, err := os.ReadDir(SysfsPath("bus/pci/devices", pciSlotId, "iommu_group/devices"))
+	if err != nil {
+		lg.Errorf("read iommu group of pci device %s failed! reason:%s", pciSlotId, err)
+		return nil, err
+	}
+
+	slots := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		slots = append(slots, entry.Name())
+	}
+
+	return slots, nil
+}
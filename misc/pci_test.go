@@ -0,0 +1,188 @@
+package misc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func useTree(t *testing.T, tree *sysfstest.Tree) {
+	sysfsRoot, procfsRoot := SysfsRoot, ProcfsRoot
+	t.Cleanup(func() { SysfsRoot, ProcfsRoot = sysfsRoot, procfsRoot })
+
+	SysfsRoot, ProcfsRoot = tree.Sys, tree.Proc
+}
+
+func TestListPciDevices(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.AddPciDevice(sysfstest.PciDevice{
+		Slot: "0000:03:00.0", Vendor: "0x8086", Device: "0x1572", SubsystemVendor: "0x8086",
+		SubsystemDevice: "0x0006", Driver: "i40e", NumaNode: 1, IommuGroup: 12,
+		SriovTotalVfs: 64, SriovNumVfs: 1, Netdevs: []string{"ens1f0"},
+	})
+	tree.AddPciDevice(sysfstest.PciDevice{
+		Slot: "0000:03:10.0", Vendor: "0x8086", Device: "0x154c", Driver: "vfio-pci", NumaNode: 1,
+		NoIommu: true, PhysFn: "0000:03:00.0",
+	})
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:01:00.0", Vendor: "0x10de", Device: "0x1eb8", Class: "0x030200", NumaNode: -1})
+	// a device removed between the listing and the read
+	if err := os.Symlink("../../../devices/pci0000:00/0000:00:1f.0", filepath.Join(tree.Sys, "bus/pci/devices/0000:00:1f.0")); err != nil {
+		t.Fatal(err)
+	}
+	useTree(t, tree)
+
+	devices, err := ListPciDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 {
+		t.Fatalf("got %d devices, want 3", len(devices))
+	}
+
+	want := PciDevice{
+		Slot: "0000:03:00.0", Vendor: "0x8086", Device: "0x1572", SubsystemVendor: "0x8086",
+		SubsystemDevice: "0x0006", Class: "0x020000", Driver: "i40e", NumaNode: 1, IommuGroup: 12,
+		SriovTotalVfs: 64, SriovNumVfs: 1, Netdevs: []string{"ens1f0"},
+	}
+	if !reflect.DeepEqual(*devices[1], want) {
+		t.Fatalf("got %+v, want %+v", *devices[1], want)
+	}
+	if !devices[2].IsVf() || devices[2].PhysFn != "0000:03:00.0" || devices[2].IommuGroup != -1 {
+		t.Fatalf("bad vf %+v", *devices[2])
+	}
+
+	for _, tc := range []struct {
+		filter PciFilter
+		want   int
+	}{
+		{PciFilter{Class: "02"}, 2},
+		{PciFilter{Vendor: "8086", Device: "0X154C"}, 1},
+		{PciFilter{Driver: "vfio-pci"}, 1},
+		{PciFilter{HasNetdev: true}, 1},
+		{PciFilter{SriovCapable: true}, 1},
+		{PciFilter{Vendor: "0x15b3"}, 0},
+	} {
+		devices, err := ListPciDevices(&tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != tc.want {
+			t.Errorf("filter %+v got %d devices, want %d", tc.filter, len(devices), tc.want)
+		}
+	}
+
+	if driver, err := GetPciDevDriver("0000:01:00.0"); err != nil || driver != "" {
+		t.Fatalf("unbound device driver %q %v", driver, err)
+	}
+	if driver, err := GetPciDevDriver("0000:03:10.0"); err != nil || driver != "vfio-pci" {
+		t.Fatalf("vf driver %q %v", driver, err)
+	}
+	if _, err := GetPciDevDriver("0000:09:00.0"); err == nil {
+		t.Fatal("expect an error for a missing device")
+	}
+	if slot, err := GetNicPciSlotId("ens1f0"); err != nil || slot != "0000:03:00.0" {
+		t.Fatalf("nic slot %q %v", slot, err)
+	}
+	if driver, err := GetNicDriver("ens1f0"); err != nil || driver != "i40e" {
+		t.Fatalf("nic driver %q %v", driver, err)
+	}
+	if vendor, err := GetNicVendor("ens1f0"); err != nil || vendor != "0x8086" {
+		t.Fatalf("nic vendor %q %v", vendor, err)
+	}
+}
+
+// playKernel binds the device at slot to its driver_override when drivers_probe is written,
+// and to driver when its bind file is written, until done is closed. It works on the paths of
+// tree, not on SysfsRoot which the test cleanup restores.
+func playKernel(tree *sysfstest.Tree, slot string, driver string, done chan struct{}) {
+	probePath := filepath.Join(tree.Sys, "bus/pci/drivers_probe")
+	overridePath := filepath.Join(tree.Sys, "bus/pci/devices", slot, "driver_override")
+	bindPath := filepath.Join(tree.Sys, "bus/pci/drivers", driver, "bind")
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if probe, _ := readSysfsString(probePath); probe == slot {
+			override, _ := readSysfsString(overridePath)
+			tree.BindDriver(slot, override)
+			writeSysfsString(probePath, "")
+		}
+		if bind, _ := readSysfsString(bindPath); bind == slot {
+			tree.BindDriver(slot, driver)
+			writeSysfsString(bindPath, "")
+		}
+	}
+}
+
+func TestBindToVfio(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:00.0", Vendor: "0x8086", Driver: "i40e", IommuGroup: 7})
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:00.1", Vendor: "0x8086", Driver: "i40e", IommuGroup: 7})
+	tree.AddNic(sysfstest.Nic{Name: "ens1f0", Slot: "0000:03:00.0", Ifindex: 999, Up: true})
+	tree.AddDriver(VfioDriver)
+	useTree(t, tree)
+
+	VfioStateDir = t.TempDir()
+	defer func(old string) { VfioStateDir = old }(VfioStateDir)
+
+	if err := BindToVfio("0000:03:00.0"); err == nil {
+		t.Fatal("expect a refusal for an up nic")
+	}
+
+	tree.WriteSys("class/net/ens1f0/flags", "0x1002")
+	if err := BindToVfio("0000:03:00.0"); err == nil {
+		t.Fatal("expect a refusal for a shared iommu group")
+	}
+
+	if override := tree.ReadSys("bus/pci/devices/0000:03:00.0/driver_override"); override != "(null)" {
+		t.Fatalf("driver_override changed to %q by a refused bind", override)
+	}
+	if _, ok, _ := GetPciDevOriginalDriver("0000:03:00.0"); ok {
+		t.Fatal("original driver recorded by a refused bind")
+	}
+	if err := RestoreOriginalDriver("0000:03:00.0"); err == nil {
+		t.Fatal("expect an error restoring a device never bound")
+	}
+
+	// with the other function unbound the group is viable
+	tree.BindDriver("0000:03:00.1", "")
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		playKernel(tree, "0000:03:00.0", "i40e", done)
+	}()
+
+	if err := BindToVfio("0000:03:00.0"); err != nil {
+		t.Fatal(err)
+	}
+	if driver, _ := GetPciDevDriver("0000:03:00.0"); driver != VfioDriver {
+		t.Fatalf("bound to %q", driver)
+	}
+	if driver, ok, _ := GetPciDevOriginalDriver("0000:03:00.0"); !ok || driver != "i40e" {
+		t.Fatalf("recorded original driver %q %v", driver, ok)
+	}
+
+	if err := RestoreOriginalDriver("0000:03:00.0"); err != nil {
+		t.Fatal(err)
+	}
+	if driver, _ := GetPciDevDriver("0000:03:00.0"); driver != "i40e" {
+		t.Fatalf("restored to %q", driver)
+	}
+	if _, ok, _ := GetPciDevOriginalDriver("0000:03:00.0"); ok {
+		t.Fatal("original driver still recorded after restore")
+	}
+}
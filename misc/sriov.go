@@ -0,0 +1,68 @@
+package misc
+
+import (
+	"fmt"
+	"strconv"
+
+	lg "github.com/running910/gokit/logger"
+)
+
+// SetPciDevSriovNumVfs enables numVfs virtual functions on the physical function, 0 removes
+// them. The kernel refuses to change a non zero count directly, so it goes through 0.
+func SetPciDevSriovNumVfs(pciSlotId string, numVfs int) error {
+	dev, err := GetPciDevice(pciSlotId)
+	if err != nil {
+		return err
+	}
+
+	if dev.SriovTotalVfs == 0 {
+		return fmt.Errorf("pci device %s is not sr-iov capable", pciSlotId)
+	} else if numVfs < 0 || numVfs > dev.SriovTotalVfs {
+		return fmt.Errorf("pci device %s supports 0 to %d vfs, not %d", pciSlotId, dev.SriovTotalVfs, numVfs)
+	} else if numVfs == dev.SriovNumVfs {
+		return nil
+	}
+
+	numVfsFile := SysfsPath("bus/pci/devices", pciSlotId, "sriov_numvfs")
+	if dev.SriovNumVfs != 0 && numVfs != 0 {
+		if err := writeSysfsString(numVfsFile, "0"); err != nil {
+			lg.Errorf("remove vfs of %s failed! reason:%s", pciSlotId, err)
+			return err
+		}
+	}
+
+	if err := writeSysfsString(numVfsFile, strconv.Itoa(numVfs)); err != nil {
+		lg.Errorf("set %d vfs on %s failed! reason:%s", numVfs, pciSlotId, err)
+		return err
+	}
+
+	lg.Infof("pci device %s sriov_numvfs %d -> %d", pciSlotId, dev.SriovNumVfs, numVfs)
+	return nil
+}
+
+// ListPciDevVfs returns the virtual functions of the physical function, the vf index is the
+// position in the slice
+func ListPciDevVfs(pciSlotId string) ([]*PciDevice, error) {
+	dev, err := GetPciDevice(pciSlotId)
+	if err != nil {
+		return nil, err
+	}
+
+	vfs := make([]*PciDevice, 0, dev.SriovNumVfs)
+	for i := 0; i < dev.SriovNumVfs; i++ {
+		slot, err := readSysfsLinkBase(SysfsPath("bus/pci/devices", pciSlotId, fmt.Sprintf("virtfn%d", i)))
+		if err != nil {
+			return nil, err
+		} else if slot == "" {
+			return nil, fmt.Errorf("pci device %s has no vf %d", pciSlotId, i)
+		}
+
+		vf, err := GetPciDevice(slot)
+		if err != nil {
+			return nil, err
+		}
+		vfs = append(vfs, vf)
+	}
+
+	return vfs, nil
+}
@@ -0,0 +1,37 @@
+package misc
+
+import (
+	"testing"
+
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func TestPciDevSriov(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:00.0", Vendor: "0x8086", SriovTotalVfs: 8, SriovNumVfs: 2})
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:02.0", Vendor: "0x8086", Driver: "vfio-pci", PhysFn: "0000:03:00.0"})
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:02.1", Vendor: "0x8086", PhysFn: "0000:03:00.0", Netdevs: []string{"ens1f0v1"}})
+	useTree(t, tree)
+
+	vfs, err := ListPciDevVfs("0000:03:00.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vfs) != 2 || vfs[0].Slot != "0000:03:02.0" || vfs[0].Driver != "vfio-pci" ||
+		vfs[1].Slot != "0000:03:02.1" || len(vfs[1].Netdevs) != 1 || !vfs[1].IsVf() {
+		t.Fatalf("bad vfs %+v %+v", vfs[0], vfs[1])
+	}
+
+	if err := SetPciDevSriovNumVfs("0000:03:00.0", 9); err == nil {
+		t.Fatal("expect an error above sriov_totalvfs")
+	}
+	if err := SetPciDevSriovNumVfs("0000:03:02.0", 1); err == nil {
+		t.Fatal("expect an error on a device without sr-iov")
+	}
+	if err := SetPciDevSriovNumVfs("0000:03:00.0", 4); err != nil {
+		t.Fatal(err)
+	}
+	if numVfs := tree.ReadSys("bus/pci/devices/0000:03:00.0/sriov_numvfs"); numVfs != "4" {
+		t.Fatalf("sriov_numvfs is %q", numVfs)
+	}
+}
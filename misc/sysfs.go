@@ -0,0 +1,76 @@
+package misc
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysfsRoot and ProcfsRoot are where sysfs and procfs are mounted, every sysfs and procfs
+// reader of misc and network goes below them. Point them to a fake tree, as built by the
+// sysfstest package, to test the readers without the hardware.
+var (
+	SysfsRoot  = "/sys"
+	ProcfsRoot = "/proc"
+)
+
+// SysfsPath joins elem below SysfsRoot, as SysfsPath("class/net", nic, "address")
+func SysfsPath(elem ...string) string {
+	return filepath.Join(append([]string{SysfsRoot}, elem...)...)
+}
+
+// ProcfsPath joins elem below ProcfsRoot, as ProcfsPath("sys/net/ipv4/ip_forward")
+func ProcfsPath(elem ...string) string {
+	return filepath.Join(append([]string{ProcfsRoot}, elem...)...)
+}
+
+func readSysfsString(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readSysfsInt returns def when the attribute does not exist
+func readSysfsInt(path string, def int) (int, error) {
+	content, err := readSysfsString(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return def, nil
+	} else if err != nil {
+		return def, err
+	}
+
+	return strconv.Atoi(content)
+}
+
+// readSysfsLinkBase returns the last element of the symlink target, empty if there is no link
+func readSysfsLinkBase(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(target), nil
+}
+
+// writeSysfsString writes an existing sysfs attribute, it never creates the file
+func writeSysfsString(path string, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,319 @@
+// Package sysfstest builds fake sysfs and procfs trees in a temporary directory, so the sysfs
+// and procfs readers of misc and network can be tested without the hardware:
+//
+//	tree := sysfstest.New(t)
+//	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:00.0", Vendor: "0x8086", Driver: "i40e", Netdevs: []string{"ens1f0"}})
+//	misc.SysfsRoot, misc.ProcfsRoot = tree.Sys, tree.Proc
+package sysfstest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tree is a fake sysfs mounted at Sys and a fake procfs mounted at Proc
+type Tree struct {
+	Sys  string
+	Proc string
+
+	t         testing.TB
+	ifindexes int
+}
+
+// PciDevice describes a device for AddPciDevice, empty ids are written as 0x0000
+type PciDevice struct {
+	Slot            string
+	Vendor          string
+	Device          string
+	SubsystemVendor string
+	SubsystemDevice string
+	// default 0x020000, an ethernet controller
+	Class string
+	// bound driver, added to the tree if needed, empty for an unbound device
+	Driver     string
+	NumaNode   int
+	LocalCpus  string
+	IommuGroup int
+	// put the device in no iommu group, as with the iommu off
+	NoIommu bool
+
+	// a physical function reports SriovTotalVfs, a virtual function names its PhysFn, which
+	// must be added first
+	SriovTotalVfs int
+	SriovNumVfs   int
+	PhysFn        string
+
+	// network interfaces added on the device with default attributes, use AddNic for more
+	Netdevs []string
+}
+
+// Nic describes a network interface for AddNic
+type Nic struct {
+	Name string
+	// pci slot of the device of the nic, empty for a virtual nic
+	Slot string
+	// default the next free index
+	Ifindex int
+	Mac     string
+	Up      bool
+	// default 1500
+	Mtu int
+}
+
+// New returns an empty tree in a temporary directory removed at the end of the test
+func New(t testing.TB) *Tree {
+	t.Helper()
+
+	root := t.TempDir()
+	tree := &Tree{Sys: filepath.Join(root, "sys"), Proc: filepath.Join(root, "proc"), t: t, ifindexes: 1}
+
+	tree.WriteSys("bus/pci/drivers_probe", "")
+	tree.WriteProc("self/mounts", "")
+
+	return tree
+}
+
+func (tree *Tree) writeFile(path string, content string) {
+	tree.t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		tree.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		tree.t.Fatal(err)
+	}
+}
+
+// WriteSys writes content to the sysfs file path, a newline is appended to non empty content
+// as the kernel does
+func (tree *Tree) WriteSys(path string, content string) {
+	tree.t.Helper()
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	tree.writeFile(filepath.Join(tree.Sys, path), content)
+}
+
+// WriteProc writes content to the procfs file path
+func (tree *Tree) WriteProc(path string, content string) {
+	tree.t.Helper()
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	tree.writeFile(filepath.Join(tree.Proc, path), content)
+}
+
+// ReadSys returns the content of the sysfs file path without the trailing newline
+func (tree *Tree) ReadSys(path string) string {
+	tree.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(tree.Sys, path))
+	if err != nil {
+		tree.t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(content), "\n")
+}
+
+// ReadProc returns the content of the procfs file path without the trailing newline
+func (tree *Tree) ReadProc(path string) string {
+	tree.t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(tree.Proc, path))
+	if err != nil {
+		tree.t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(content), "\n")
+}
+
+// SymlinkSys makes the sysfs path a link to target, relative to the directory of path like
+// the kernel links, replacing any previous link
+func (tree *Tree) SymlinkSys(path string, target string) {
+	tree.t.Helper()
+
+	path = filepath.Join(tree.Sys, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		tree.t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		tree.t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		tree.t.Fatal(err)
+	}
+}
+
+// RemoveSys removes the sysfs path, as a driver link when a device is unbound
+func (tree *Tree) RemoveSys(path string) {
+	tree.t.Helper()
+
+	if err := os.RemoveAll(filepath.Join(tree.Sys, path)); err != nil {
+		tree.t.Fatal(err)
+	}
+}
+
+// SetSysctl writes value to the procfs file of the sysctl key, as net.ipv4.ip_forward
+func (tree *Tree) SetSysctl(key string, value string) {
+	tree.t.Helper()
+
+	tree.WriteProc(filepath.Join("sys", strings.ReplaceAll(key, ".", "/")), value)
+}
+
+// AddMount appends a line to /proc/self/mounts
+func (tree *Tree) AddMount(source string, target string, fstype string, options string) {
+	tree.t.Helper()
+
+	mounts := tree.ReadProc("self/mounts")
+	if mounts != "" {
+		mounts += "\n"
+	}
+	tree.WriteProc("self/mounts", mounts+fmt.Sprintf("%s %s %s %s 0 0", source, target, fstype, options))
+}
+
+// devicePath returns the sysfs path of the device at slot below devices/
+func devicePath(slot string) string {
+	domain := "0000"
+	if i := strings.Index(slot, ":"); i > 0 {
+		domain = slot[:i]
+	}
+	return filepath.Join("devices", "pci"+domain+":00", slot)
+}
+
+// AddDriver adds a pci driver with its bind files and module, it does nothing if the driver
+// exists
+func (tree *Tree) AddDriver(name string) {
+	tree.t.Helper()
+
+	dir := filepath.Join("bus/pci/drivers", name)
+	if _, err := os.Stat(filepath.Join(tree.Sys, dir)); err == nil {
+		return
+	}
+
+	for _, file := range []string{"bind", "unbind", "new_id", "remove_id"} {
+		tree.WriteSys(filepath.Join(dir, file), "")
+	}
+
+	module := strings.ReplaceAll(name, "-", "_")
+	tree.WriteSys(filepath.Join("module", module, "refcnt"), "1")
+	tree.SymlinkSys(filepath.Join(dir, "module"), "../../../../module/"+module)
+}
+
+// BindDriver binds the device at slot to driver, an empty driver unbinds it
+func (tree *Tree) BindDriver(slot string, driver string) {
+	tree.t.Helper()
+
+	link := filepath.Join(devicePath(slot), "driver")
+	if driver == "" {
+		tree.RemoveSys(link)
+		return
+	}
+
+	tree.AddDriver(driver)
+	tree.SymlinkSys(link, "../../../bus/pci/drivers/"+driver)
+}
+
+func orZeroId(id string) string {
+	if id == "" {
+		return "0x0000"
+	}
+	return id
+}
+
+// AddPciDevice adds a pci device with its driver, iommu group, sr-iov links and netdevs
+func (tree *Tree) AddPciDevice(dev PciDevice) {
+	tree.t.Helper()
+
+	path := devicePath(dev.Slot)
+	class := dev.Class
+	if class == "" {
+		class = "0x020000"
+	}
+	cpus := dev.LocalCpus
+	if cpus == "" {
+		cpus = "0"
+	}
+
+	for file, content := range map[string]string{
+		"vendor":           orZeroId(dev.Vendor),
+		"device":           orZeroId(dev.Device),
+		"subsystem_vendor": orZeroId(dev.SubsystemVendor),
+		"subsystem_device": orZeroId(dev.SubsystemDevice),
+		"class":            class,
+		"numa_node":        fmt.Sprint(dev.NumaNode),
+		"local_cpulist":    cpus,
+		"driver_override":  "(null)",
+	} {
+		tree.WriteSys(filepath.Join(path, file), content)
+	}
+
+	tree.SymlinkSys(filepath.Join("bus/pci/devices", dev.Slot), "../../../"+path)
+	tree.SymlinkSys(filepath.Join(path, "subsystem"), "../../../bus/pci")
+
+	if dev.Driver != "" {
+		tree.BindDriver(dev.Slot, dev.Driver)
+	}
+
+	if !dev.NoIommu {
+		group := filepath.Join("kernel/iommu_groups", fmt.Sprint(dev.IommuGroup))
+		tree.SymlinkSys(filepath.Join(path, "iommu_group"), "../../../"+group)
+		tree.SymlinkSys(filepath.Join(group, "devices", dev.Slot), "../../../../"+path)
+	}
+
+	if dev.SriovTotalVfs > 0 {
+		tree.WriteSys(filepath.Join(path, "sriov_totalvfs"), fmt.Sprint(dev.SriovTotalVfs))
+		tree.WriteSys(filepath.Join(path, "sriov_numvfs"), fmt.Sprint(dev.SriovNumVfs))
+	}
+
+	if dev.PhysFn != "" {
+		pf := devicePath(dev.PhysFn)
+		vfs, _ := filepath.Glob(filepath.Join(tree.Sys, pf, "virtfn*"))
+		tree.SymlinkSys(filepath.Join(path, "physfn"), "../"+dev.PhysFn)
+		tree.SymlinkSys(filepath.Join(pf, fmt.Sprintf("virtfn%d", len(vfs))), "../"+dev.Slot)
+	}
+
+	for _, name := range dev.Netdevs {
+		tree.AddNic(Nic{Name: name, Slot: dev.Slot})
+	}
+}
+
+// AddNic adds a network interface under class/net, on the pci device at Slot or virtual
+func (tree *Tree) AddNic(nic Nic) {
+	tree.t.Helper()
+
+	path := filepath.Join("devices/virtual/net", nic.Name)
+	if nic.Slot != "" {
+		path = filepath.Join(devicePath(nic.Slot), "net", nic.Name)
+		tree.SymlinkSys(filepath.Join(path, "device"), "../../../"+nic.Slot)
+	}
+
+	if nic.Ifindex == 0 {
+		tree.ifindexes++
+		nic.Ifindex = tree.ifindexes
+	}
+	if nic.Mtu == 0 {
+		nic.Mtu = 1500
+	}
+	if nic.Mac == "" {
+		nic.Mac = fmt.Sprintf("02:00:00:00:00:%02x", nic.Ifindex&0xff)
+	}
+	flags, operstate := "0x1002", "down"
+	if nic.Up {
+		flags, operstate = "0x1003", "up"
+	}
+
+	for file, content := range map[string]string{
+		"ifindex":   fmt.Sprint(nic.Ifindex),
+		"address":   nic.Mac,
+		"mtu":       fmt.Sprint(nic.Mtu),
+		"flags":     flags,
+		"operstate": operstate,
+	} {
+		tree.WriteSys(filepath.Join(path, file), content)
+	}
+
+	tree.SymlinkSys(filepath.Join("class/net", nic.Name), "../../"+path)
+}
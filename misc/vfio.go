@@ -0,0 +1,269 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	lg "github.com/running910/gokit/logger"
+	"github.com/vishvananda/netlink"
+)
+
+const VfioDriver = "vfio-pci"
+
+// VfioStateDir keeps the original driver of the devices bound by BindToVfio, one file per
+// slot, so another process can restore them until the next reboot.
+var VfioStateDir = "/run/gokit/vfio"
+
+// VfioBindTimeout bounds the wait for the kernel to bind or unbind a device
+var VfioBindTimeout = 5 * time.Second
+
+// checkNicUnused refuses a nic that is up or carries a default route, binding it would cut
+// the host off the network
+func checkNicUnused(nic string) error {
+	flags, err := readSysfsString(SysfsPath("class/net", nic, "flags"))
+	if err != nil {
+		return err
+	}
+	if value, err := strconv.ParseUint(flags, 0, 32); err != nil {
+		return fmt.Errorf("nic %s invalid flags %q", nic, flags)
+	} else if value&1 != 0 {
+		return fmt.Errorf("nic %s is up, set it down first", nic)
+	}
+
+	index, err := readSysfsInt(SysfsPath("class/net", nic, "ifindex"), 0)
+	if err != nil {
+		return err
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		lg.Errorf("netlink.RouteList() failed! reason:%s", err)
+		return err
+	}
+	for _, route := range routes {
+		if route.Dst != nil {
+			continue
+		}
+		if route.LinkIndex == index {
+			return fmt.Errorf("nic %s carries the default route", nic)
+		}
+		for _, nh := range route.MultiPath {
+			if nh.LinkIndex == index {
+				return fmt.Errorf("nic %s carries the default route", nic)
+			}
+		}
+	}
+
+	return nil
+}
+
+func vfioNoIommuEnabled() bool {
+	value, _ := readSysfsString(SysfsPath("module/vfio/parameters/enable_unsafe_noiommu_mode"))
+	return value == "Y" || value == "1"
+}
+
+// checkIommuGroup makes sure vfio can use the group of dev: every other device of the group
+// must be unbound or bound to vfio-pci or pci-stub, as the kernel requires for a viable group
+func checkIommuGroup(dev *PciDevice) error {
+	if dev.IommuGroup < 0 {
+		if vfioNoIommuEnabled() {
+			lg.Infof("pci device %s has no iommu group, using vfio no-iommu mode", dev.Slot)
+			return nil
+		}
+		return fmt.Errorf("pci device %s has no iommu group, enable the iommu or the vfio no-iommu mode", dev.Slot)
+	}
+
+	slots, err := GetPciDevIommuGroupDevices(dev.Slot)
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range slots {
+		if slot == dev.Slot {
+			continue
+		}
+
+		driver, err := GetPciDevDriver(slot)
+		if err != nil {
+			return err
+		}
+		switch driver {
+		case "", VfioDriver, "pci-stub", "pcieport":
+		default:
+			return fmt.Errorf("pci device %s shares iommu group %d with %s bound to %s", dev.Slot, dev.IommuGroup, slot, driver)
+		}
+	}
+
+	return nil
+}
+
+func waitPciDevDriver(pciSlotId string, driver string) error {
+	deadline := time.Now().Add(VfioBindTimeout)
+	for {
+		current, err := GetPciDevDriver(pciSlotId)
+		if err != nil {
+			return err
+		} else if current == driver {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("pci device %s bound to %q, want %q", pciSlotId, current, driver)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func vfioStateFile(pciSlotId string) string {
+	return filepath.Join(VfioStateDir, pciSlotId)
+}
+
+// GetPciDevOriginalDriver returns the driver recorded by BindToVfio, ok is false when the
+// device was not bound by it
+func GetPciDevOriginalDriver(pciSlotId string) (driver string, ok bool, err error) {
+	content, err := os.ReadFile(vfioStateFile(pciSlotId))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return strings.TrimSpace(string(content)), true, nil
+}
+
+// BindToVfio binds the device to vfio-pci through driver_override, so only this device moves
+// and not every device with the same ids as new_id does. Its netdevs must be down without the
+// default route and its iommu group must be viable. The original driver is recorded for
+// RestoreOriginalDriver, and restored if the bind fails.
+func BindToVfio(pciSlotId string) error {
+	dev, err := GetPciDevice(pciSlotId)
+	if err != nil {
+		return err
+	}
+
+	if dev.Driver == VfioDriver {
+		lg.Infof("pci device %s already bound to %s", pciSlotId, VfioDriver)
+		return nil
+	}
+
+	for _, nic := range dev.Netdevs {
+		if err := checkNicUnused(nic); err != nil {
+			lg.Errorf("BindToVfio() %s refused! reason:%s", pciSlotId, err)
+			return err
+		}
+	}
+
+	if err := checkIommuGroup(dev); err != nil {
+		lg.Errorf("BindToVfio() %s refused! reason:%s", pciSlotId, err)
+		return err
+	}
+
+	if _, err := os.Stat(SysfsPath("bus/pci/drivers", VfioDriver)); err != nil {
+		err = fmt.Errorf("driver %s is not loaded, modprobe vfio-pci first", VfioDriver)
+		lg.Errorf("BindToVfio() %s failed! reason:%s", pciSlotId, err)
+		return err
+	}
+
+	// keep the first recorded driver if a previous bind was interrupted
+	if _, ok, err := GetPciDevOriginalDriver(pciSlotId); err != nil {
+		return err
+	} else if !ok {
+		if err := os.MkdirAll(VfioStateDir, 0755); err != nil {
+			lg.Errorf("create %s failed! reason:%s", VfioStateDir, err)
+			return err
+		}
+		if err := os.WriteFile(vfioStateFile(pciSlotId), []byte(dev.Driver+"\n"), 0644); err != nil {
+			lg.Errorf("record original driver of %s failed! reason:%s", pciSlotId, err)
+			return err
+		}
+	}
+
+	err = bindPciDevOverride(pciSlotId, dev.Driver, VfioDriver)
+	if err != nil {
+		lg.Errorf("BindToVfio() %s failed! reason:%s", pciSlotId, err)
+		if rerr := RestoreOriginalDriver(pciSlotId); rerr != nil {
+			lg.Errorf("restore %s after a failed bind failed! reason:%s", pciSlotId, rerr)
+		}
+		return err
+	}
+
+	lg.Infof("pci device %s bound to %s, was %q", pciSlotId, VfioDriver, dev.Driver)
+	return nil
+}
+
+// bindPciDevOverride moves the device from driver current to driver through driver_override
+func bindPciDevOverride(pciSlotId string, current string, driver string) error {
+	devPath := SysfsPath("bus/pci/devices", pciSlotId)
+
+	if err := writeSysfsString(filepath.Join(devPath, "driver_override"), driver); err != nil {
+		return err
+	}
+
+	if current != "" {
+		if err := DetachPciDevDriver(pciSlotId, current); err != nil {
+			return err
+		}
+	}
+
+	if err := writeSysfsString(SysfsPath("bus/pci/drivers_probe"), pciSlotId); err != nil {
+		return err
+	}
+
+	return waitPciDevDriver(pciSlotId, driver)
+}
+
+// RestoreOriginalDriver undoes BindToVfio: it clears driver_override and binds the device back
+// to the driver recorded at bind time, or leaves it unbound if it had none
+func RestoreOriginalDriver(pciSlotId string) error {
+	original, ok, err := GetPciDevOriginalDriver(pciSlotId)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("no original driver recorded for pci device %s", pciSlotId)
+	}
+
+	devPath := SysfsPath("bus/pci/devices", pciSlotId)
+
+	// an empty line clears the override
+	if err := writeSysfsString(filepath.Join(devPath, "driver_override"), "\n"); err != nil {
+		lg.Errorf("clear driver_override of %s failed! reason:%s", pciSlotId, err)
+		return err
+	}
+
+	current, err := GetPciDevDriver(pciSlotId)
+	if err != nil {
+		return err
+	}
+
+	if current != original {
+		if current != "" {
+			if err := DetachPciDevDriver(pciSlotId, current); err != nil {
+				lg.Errorf("unbind %s from %s failed! reason:%s", pciSlotId, current, err)
+				return err
+			}
+		}
+
+		if original != "" {
+			if err := AttachPciDevDriver(pciSlotId, original); err != nil {
+				lg.Errorf("bind %s to %s failed! reason:%s", pciSlotId, original, err)
+				return err
+			}
+		}
+
+		if err := waitPciDevDriver(pciSlotId, original); err != nil {
+			lg.Errorf("RestoreOriginalDriver() %s failed! reason:%s", pciSlotId, err)
+			return err
+		}
+	}
+
+	if err := os.Remove(vfioStateFile(pciSlotId)); err != nil {
+		return err
+	}
+
+	lg.Infof("pci device %s restored to %q", pciSlotId, original)
+	return nil
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// NsArpProbe sends ARP requests for dst through nic of ns until a reply comes back or timeout
+// expires, and returns the mac address of dst with the round trip time. It works for hosts
+// dropping ICMP, as long as they are on the link of nic.
+func NsArpProbe(ns netns.NsHandle, nic string, dst string, timeout time.Duration) (net.HardwareAddr, time.Duration, error) {
+	target := net.ParseIP(dst).To4()
+	if target == nil {
+		return nil, 0, fmt.Errorf("invalid arp target %q, must be an ipv4 address", dst)
+	}
+
+	var iface *net.Interface
+	var src net.IP
+	fd := -1
+	err := RunInNs(ns, func() error {
+		var err error
+		if iface, err = net.InterfaceByName(nic); err != nil {
+			logger.Errorf("net.InterfaceByName() %s failed! reason:%s", nic, err)
+			return err
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				src = ipnet.IP.To4()
+				break
+			}
+		}
+		if src == nil {
+			return fmt.Errorf("nic %s has no ipv4 address", nic)
+		}
+
+		if fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP))); err != nil {
+			logger.Errorf("open arp socket failed! reason:%s", err)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return nil, 0, err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index}); err != nil {
+		logger.Errorf("bind arp socket to %s failed! reason:%s", nic, err)
+		return nil, 0, err
+	}
+
+	// htype ethernet, ptype ipv4, hlen 6, plen 4, op request
+	req := make([]byte, 0, 28)
+	req = binary.BigEndian.AppendUint16(req, 1)
+	req = binary.BigEndian.AppendUint16(req, unix.ETH_P_IP)
+	req = append(req, 6, 4)
+	req = binary.BigEndian.AppendUint16(req, 1)
+	req = append(req, iface.HardwareAddr...)
+	req = append(req, src...)
+	req = append(req, make([]byte, 6)...)
+	req = append(req, target...)
+
+	broadcast := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 128)
+
+	// resend every second, like arping
+	for time.Now().Before(deadline) {
+		sent := time.Now()
+		if err := unix.Sendto(fd, req, 0, broadcast); err != nil {
+			logger.Errorf("send arp request for %s on %s failed! reason:%s", dst, nic, err)
+			return nil, 0, err
+		}
+
+		resend := sent.Add(time.Second)
+		if resend.After(deadline) {
+			resend = deadline
+		}
+
+		for now := time.Now(); now.Before(resend); now = time.Now() {
+			tv := recvTimeval(resend.Sub(now))
+			if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+				return nil, 0, err
+			}
+
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			} else if err != nil {
+				return nil, 0, err
+			}
+
+			// a reply whose sender protocol address is the target
+			if n >= 28 && binary.BigEndian.Uint16(buf[6:8]) == 2 && bytes.Equal(buf[14:18], target) {
+				return net.HardwareAddr(append([]byte{}, buf[8:14]...)), time.Since(sent), nil
+			}
+		}
+	}
+
+	return nil, 0, fmt.Errorf("no arp reply from %s on %s", dst, nic)
+}
+
+// recvTimeval converts a receive timeout to SO_RCVTIMEO rounded up to the microsecond, as a
+// zero timeval would block forever
+func recvTimeval(d time.Duration) unix.Timeval {
+	return unix.NsecToTimeval(((d + time.Microsecond - 1) / time.Microsecond * time.Microsecond).Nanoseconds())
+}
@@ -0,0 +1,22 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecvTimeval(t *testing.T) {
+
+	for d, want := range map[time.Duration]int64{
+		1:                       1,
+		999:                     1,
+		time.Microsecond:        1,
+		time.Microsecond + 1:    2,
+		1500 * time.Millisecond: 1500000,
+	} {
+		tv := recvTimeval(d)
+		if got := int64(tv.Sec)*1000000 + int64(tv.Usec); got != want {
+			t.Errorf("recvTimeval(%d) = %dus, want %dus", d, got, want)
+		}
+	}
+}
@@ -1,31 +1,501 @@
 package network
 
 import (
+	"fmt"
+	"sync"
+	"unsafe"
+
 	"github.com/running910/gokit/logger"
 	"github.com/safchain/ethtool"
+	"golang.org/x/sys/unix"
 )
 
-func EthtoolSetFeatureOnOff(nic string, feature string, value string) error {
-	ethHandle, err := ethtool.NewEthtool()
+// ethtool commands not covered by github.com/safchain/ethtool, see uapi/linux/ethtool.h
+const (
+	ethtoolGSet         = 0x00000001
+	ethtoolSSet         = 0x00000002
+	ethtoolSCoalesce    = 0x0000000f
+	ethtoolGRingParam   = 0x00000010
+	ethtoolSRingParam   = 0x00000011
+	ethtoolGPauseParam  = 0x00000012
+	ethtoolSPauseParam  = 0x00000013
+	ethtoolGFeatures    = 0x0000003a
+	ethtoolMaxFeatBlock = (ethtool.MAX_GSTRINGS + 32 - 1) / 32
+)
+
+type (
+	EthtoolChannels   = ethtool.Channels
+	EthtoolCoalesce   = ethtool.Coalesce
+	EthtoolDriverInfo = ethtool.DrvInfo
+)
+
+// EthtoolFeature is the state of one offload feature as shown by ethtool -k
+type EthtoolFeature struct {
+	Name string
+	// the feature can't be changed, shown as [fixed] by ethtool -k
+	Fixed     bool
+	Requested bool
+	Active    bool
+}
+
+// EthtoolRings is the ring sizes as shown by ethtool -g, the Max fields are read only
+type EthtoolRings struct {
+	Cmd               uint32
+	RxMaxPending      uint32
+	RxMiniMaxPending  uint32
+	RxJumboMaxPending uint32
+	TxMaxPending      uint32
+	RxPending         uint32
+	RxMiniPending     uint32
+	RxJumboPending    uint32
+	TxPending         uint32
+}
+
+type ethtoolPauseParam struct {
+	cmd     uint32
+	autoneg uint32
+	rxPause uint32
+	txPause uint32
+}
+
+type EthtoolPause struct {
+	Autoneg bool
+	RxPause bool
+	TxPause bool
+}
+
+type EthtoolDuplex string
+
+const (
+	EthtoolDuplexHalf    EthtoolDuplex = "half"
+	EthtoolDuplexFull    EthtoolDuplex = "full"
+	EthtoolDuplexUnknown EthtoolDuplex = "unknown"
+)
+
+// EthtoolLinkSettings is the link mode as shown by ethtool, Speed is in Mb/s, 0 if unknown
+type EthtoolLinkSettings struct {
+	Speed   uint32
+	Duplex  EthtoolDuplex
+	Autoneg bool
+	// SUPPORTED_* and ADVERTISED_* bits of ethtool.h
+	Supported   uint32
+	Advertising uint32
+}
+
+type ethtoolFeaturesBlock struct {
+	available    uint32
+	requested    uint32
+	active       uint32
+	neverChanged uint32
+}
+
+type ethtoolGetFeatures struct {
+	cmd    uint32
+	size   uint32
+	blocks [ethtoolMaxFeatBlock]ethtoolFeaturesBlock
+}
+
+type ethtoolIfreq struct {
+	name [unix.IFNAMSIZ]byte
+	// a pointer, not a uintptr, so that the gc keeps the ethtool struct alive
+	data unsafe.Pointer
+}
+
+// Ethtool is a reusable ethtool handle, it is safe for concurrent use and must be closed after use
+type Ethtool struct {
+	handle *ethtool.Ethtool
+	fd     int
+}
+
+func NewEthtool() (*Ethtool, error) {
+	handle, err := ethtool.NewEthtool()
 	if err != nil {
 		logger.Errorf("ethtool.NewEthtool() failed reason:%s", err)
-		return err
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		handle.Close()
+		logger.Errorf("unix.Socket() failed reason:%s", err)
+		return nil, err
 	}
-	defer ethHandle.Close()
 
-	logger.Infof("ethtool -K %s %s %s", nic, feature, value)
+	return &Ethtool{handle: handle, fd: fd}, nil
+}
+
+func (e *Ethtool) Close() {
+	e.handle.Close()
+	unix.Close(e.fd)
+}
+
+func (e *Ethtool) ioctl(nic string, data unsafe.Pointer) error {
+	if len(nic) >= unix.IFNAMSIZ {
+		return fmt.Errorf("invalid nic name %q", nic)
+	}
+
+	ifr := ethtoolIfreq{data: data}
+	copy(ifr.name[:], nic)
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(e.fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Features returns every offload feature of nic by name, as ethtool -k does
+func (e *Ethtool) Features(nic string) (map[string]EthtoolFeature, error) {
+	names, err := e.handle.FeatureNames(nic)
+	if err != nil {
+		logger.Errorf("FeatureNames() nic:%s failed! reason:%s", nic, err)
+		return nil, err
+	}
+
+	features := make(map[string]EthtoolFeature, len(names))
+	if len(names) == 0 {
+		return features, nil
+	}
 
-	On := true
-	if value == "off" {
-		On = false
+	gfeatures := ethtoolGetFeatures{cmd: ethtoolGFeatures, size: uint32((len(names) + 31) / 32)}
+	if err := e.ioctl(nic, unsafe.Pointer(&gfeatures)); err != nil {
+		logger.Errorf("ethtool -k %s failed! reason:%s", nic, err)
+		return nil, err
 	}
 
-	if err := ethHandle.Change(nic, map[string]bool{
-		feature: On,
-	}); err != nil {
+	for name, index := range names {
+		features[name] = gfeatures.feature(name, index)
+	}
+
+	return features, nil
+}
+
+// feature decodes the state of the feature at index of the string set
+func (g *ethtoolGetFeatures) feature(name string, index uint) EthtoolFeature {
+	block, bit := g.blocks[index/32], uint32(1)<<(index%32)
+	return EthtoolFeature{
+		Name:      name,
+		Fixed:     block.available&bit == 0 || block.neverChanged&bit != 0,
+		Requested: block.requested&bit != 0,
+		Active:    block.active&bit != 0,
+	}
+}
+
+// SetFeatures changes the offload features of nic, as ethtool -K does. It fails without
+// changing anything if one of the features is unknown or fixed.
+func (e *Ethtool) SetFeatures(nic string, config map[string]bool) error {
+	features, err := e.Features(nic)
+	if err != nil {
+		return err
+	}
+
+	for name, on := range config {
+		feature, ok := features[name]
+		if !ok {
+			logger.Errorf("ethtool -K %s %s failed! reason:unsupported feature", nic, name)
+			return fmt.Errorf("nic %s does not support feature %q", nic, name)
+		} else if feature.Fixed && feature.Active != on {
+			logger.Errorf("ethtool -K %s %s failed! reason:fixed feature", nic, name)
+			return fmt.Errorf("feature %q of nic %s is fixed", name, nic)
+		}
+	}
+
+	logger.Infof("ethtool -K %s %+v", nic, config)
+	if err := e.handle.Change(nic, config); err != nil {
 		logger.Errorf("ethHandle.Change failed! reason:%s", err)
 		return err
 	}
 
 	return nil
 }
+
+func (e *Ethtool) SetFeature(nic string, feature string, on bool) error {
+	return e.SetFeatures(nic, map[string]bool{feature: on})
+}
+
+func (e *Ethtool) GetRings(nic string) (EthtoolRings, error) {
+	rings := EthtoolRings{Cmd: ethtoolGRingParam}
+	if err := e.ioctl(nic, unsafe.Pointer(&rings)); err != nil {
+		logger.Errorf("ethtool -g %s failed! reason:%s", nic, err)
+		return EthtoolRings{}, err
+	}
+
+	return rings, nil
+}
+
+// SetRings changes the rx and tx ring sizes of nic, 0 keeps the current size
+func (e *Ethtool) SetRings(nic string, rxPending uint32, txPending uint32) error {
+	rings, err := e.GetRings(nic)
+	if err != nil {
+		return err
+	}
+
+	if rxPending != 0 {
+		if rxPending > rings.RxMaxPending {
+			return fmt.Errorf("rx ring size %d of nic %s exceeds max %d", rxPending, nic, rings.RxMaxPending)
+		}
+		rings.RxPending = rxPending
+	}
+
+	if txPending != 0 {
+		if txPending > rings.TxMaxPending {
+			return fmt.Errorf("tx ring size %d of nic %s exceeds max %d", txPending, nic, rings.TxMaxPending)
+		}
+		rings.TxPending = txPending
+	}
+
+	logger.Infof("ethtool -G %s rx %d tx %d", nic, rings.RxPending, rings.TxPending)
+	rings.Cmd = ethtoolSRingParam
+	if err := e.ioctl(nic, unsafe.Pointer(&rings)); err != nil {
+		logger.Errorf("ethtool -G %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Ethtool) GetChannels(nic string) (EthtoolChannels, error) {
+	channels, err := e.handle.GetChannels(nic)
+	if err != nil {
+		logger.Errorf("ethtool -l %s failed! reason:%s", nic, err)
+		return EthtoolChannels{}, err
+	}
+
+	return channels, nil
+}
+
+// SetChannels changes the channel counts of nic, only the count fields of channels are used
+func (e *Ethtool) SetChannels(nic string, channels EthtoolChannels) error {
+	logger.Infof("ethtool -L %s rx %d tx %d other %d combined %d", nic,
+		channels.RxCount, channels.TxCount, channels.OtherCount, channels.CombinedCount)
+
+	if _, err := e.handle.SetChannels(nic, channels); err != nil {
+		logger.Errorf("ethtool -L %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Ethtool) GetCoalesce(nic string) (EthtoolCoalesce, error) {
+	coalesce, err := e.handle.GetCoalesce(nic)
+	if err != nil {
+		logger.Errorf("ethtool -c %s failed! reason:%s", nic, err)
+		return EthtoolCoalesce{}, err
+	}
+
+	return coalesce, nil
+}
+
+// SetCoalesce writes the whole coalesce config, start from GetCoalesce to change some fields only
+func (e *Ethtool) SetCoalesce(nic string, coalesce EthtoolCoalesce) error {
+	logger.Infof("ethtool -C %s %+v", nic, coalesce)
+
+	coalesce.Cmd = ethtoolSCoalesce
+	if err := e.ioctl(nic, unsafe.Pointer(&coalesce)); err != nil {
+		logger.Errorf("ethtool -C %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Ethtool) GetPause(nic string) (EthtoolPause, error) {
+	param := ethtoolPauseParam{cmd: ethtoolGPauseParam}
+	if err := e.ioctl(nic, unsafe.Pointer(&param)); err != nil {
+		logger.Errorf("ethtool -a %s failed! reason:%s", nic, err)
+		return EthtoolPause{}, err
+	}
+
+	return EthtoolPause{Autoneg: param.autoneg != 0, RxPause: param.rxPause != 0, TxPause: param.txPause != 0}, nil
+}
+
+func (e *Ethtool) SetPause(nic string, pause EthtoolPause) error {
+	param := ethtoolPauseParam{cmd: ethtoolSPauseParam}
+	if pause.Autoneg {
+		param.autoneg = 1
+	}
+	if pause.RxPause {
+		param.rxPause = 1
+	}
+	if pause.TxPause {
+		param.txPause = 1
+	}
+
+	logger.Infof("ethtool -A %s %+v", nic, pause)
+	if err := e.ioctl(nic, unsafe.Pointer(&param)); err != nil {
+		logger.Errorf("ethtool -A %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Ethtool) getCmd(nic string) (ethtool.EthtoolCmd, error) {
+	cmd := ethtool.EthtoolCmd{Cmd: ethtoolGSet}
+	if err := e.ioctl(nic, unsafe.Pointer(&cmd)); err != nil {
+		logger.Errorf("ethtool %s failed! reason:%s", nic, err)
+		return ethtool.EthtoolCmd{}, err
+	}
+
+	return cmd, nil
+}
+
+func (e *Ethtool) GetLinkSettings(nic string) (EthtoolLinkSettings, error) {
+	cmd, err := e.getCmd(nic)
+	if err != nil {
+		return EthtoolLinkSettings{}, err
+	}
+
+	settings := EthtoolLinkSettings{
+		Speed:       uint32(cmd.Speed_hi)<<16 | uint32(cmd.Speed),
+		Duplex:      EthtoolDuplexUnknown,
+		Autoneg:     cmd.Autoneg != 0,
+		Supported:   cmd.Supported,
+		Advertising: cmd.Advertising,
+	}
+
+	// SPEED_UNKNOWN
+	if settings.Speed == 0xffffffff {
+		settings.Speed = 0
+	}
+
+	switch cmd.Duplex {
+	case 0:
+		settings.Duplex = EthtoolDuplexHalf
+	case 1:
+		settings.Duplex = EthtoolDuplexFull
+	}
+
+	return settings, nil
+}
+
+// SetLinkSettings enables autoneg with the advertised modes of settings (current ones if 0),
+// or forces speed and duplex with autoneg off, as ethtool -s does.
+func (e *Ethtool) SetLinkSettings(nic string, settings EthtoolLinkSettings) error {
+	cmd, err := e.getCmd(nic)
+	if err != nil {
+		return err
+	}
+
+	if settings.Autoneg {
+		cmd.Autoneg = 1
+		if settings.Advertising != 0 {
+			cmd.Advertising = settings.Advertising
+		}
+	} else {
+		cmd.Autoneg = 0
+		if settings.Speed != 0 {
+			cmd.Speed = uint16(settings.Speed & 0xffff)
+			cmd.Speed_hi = uint16(settings.Speed >> 16)
+		}
+
+		switch settings.Duplex {
+		case EthtoolDuplexHalf:
+			cmd.Duplex = 0
+		case EthtoolDuplexFull:
+			cmd.Duplex = 1
+		}
+	}
+
+	logger.Infof("ethtool -s %s %+v", nic, settings)
+	cmd.Cmd = ethtoolSSet
+	if err := e.ioctl(nic, unsafe.Pointer(&cmd)); err != nil {
+		logger.Errorf("ethtool -s %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *Ethtool) DriverInfo(nic string) (EthtoolDriverInfo, error) {
+	info, err := e.handle.DriverInfo(nic)
+	if err != nil {
+		logger.Errorf("ethtool -i %s failed! reason:%s", nic, err)
+		return EthtoolDriverInfo{}, err
+	}
+
+	return info, nil
+}
+
+// Stats returns the driver specific counters of nic, as ethtool -S does
+func (e *Ethtool) Stats(nic string) (map[string]uint64, error) {
+	stats, err := e.handle.Stats(nic)
+	if err != nil {
+		logger.Errorf("ethtool -S %s failed! reason:%s", nic, err)
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// LinkDetected tells whether both the interface and its physical port are up
+func (e *Ethtool) LinkDetected(nic string) (bool, error) {
+	state, err := e.handle.LinkState(nic)
+	if err != nil {
+		logger.Errorf("ethtool %s link state failed! reason:%s", nic, err)
+		return false, err
+	}
+
+	return state != 0, nil
+}
+
+// PermAddr returns the permanent mac address of nic, "" if the driver does not report one
+func (e *Ethtool) PermAddr(nic string) (string, error) {
+	addr, err := e.handle.PermAddr(nic)
+	if err != nil {
+		logger.Errorf("ethtool -P %s failed! reason:%s", nic, err)
+		return "", err
+	}
+
+	return addr, nil
+}
+
+var (
+	defaultEthtoolMu sync.Mutex
+	defaultEthtool   *Ethtool
+)
+
+// getDefaultEthtool returns the package handle shared by the Ethtool* functions
+func getDefaultEthtool() (*Ethtool, error) {
+	defaultEthtoolMu.Lock()
+	defer defaultEthtoolMu.Unlock()
+
+	if defaultEthtool == nil {
+		e, err := NewEthtool()
+		if err != nil {
+			return nil, err
+		}
+		defaultEthtool = e
+	}
+
+	return defaultEthtool, nil
+}
+
+// CloseDefaultEthtool closes the handle shared by the Ethtool* functions, the next call opens
+// a new one
+func CloseDefaultEthtool() {
+	defaultEthtoolMu.Lock()
+	defer defaultEthtoolMu.Unlock()
+
+	if defaultEthtool != nil {
+		defaultEthtool.Close()
+		defaultEthtool = nil
+	}
+}
+
+// EthtoolSetFeatureOnOff is ethtool -K nic feature on|off
+func EthtoolSetFeatureOnOff(nic string, feature string, value string) error {
+	if value != "on" && value != "off" {
+		logger.Errorf("ethtool -K %s %s %s failed! reason:value must be on or off", nic, feature, value)
+		return fmt.Errorf("invalid ethtool feature value %q, must be on or off", value)
+	}
+
+	ethHandle, err := getDefaultEthtool()
+	if err != nil {
+		return err
+	}
+
+	return ethHandle.SetFeature(nic, feature, value == "on")
+}
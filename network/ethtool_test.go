@@ -0,0 +1,54 @@
+package network
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestEthtoolFeature(t *testing.T) {
+
+	var g ethtoolGetFeatures
+	// index 3: available, requested and active; index 33: active but fixed
+	g.blocks[0] = ethtoolFeaturesBlock{available: 1 << 3, requested: 1 << 3, active: 1 << 3}
+	g.blocks[1] = ethtoolFeaturesBlock{available: 1 << 1, active: 1 << 1, neverChanged: 1 << 1}
+
+	for _, tc := range []struct {
+		index uint
+		want  EthtoolFeature
+	}{
+		{3, EthtoolFeature{Name: "f", Requested: true, Active: true}},
+		{33, EthtoolFeature{Name: "f", Fixed: true, Active: true}},
+		{4, EthtoolFeature{Name: "f", Fixed: true}},
+	} {
+		if got := g.feature("f", tc.index); got != tc.want {
+			t.Errorf("feature at %d got %+v, want %+v", tc.index, got, tc.want)
+		}
+	}
+}
+
+// the structs passed to SIOCETHTOOL must match the layouts of uapi/linux/ethtool.h
+func TestEthtoolStructLayout(t *testing.T) {
+
+	var rings EthtoolRings
+	var coalesce EthtoolCoalesce
+	var g ethtoolGetFeatures
+
+	for _, tc := range []struct {
+		name       string
+		size, want uintptr
+	}{
+		{"ethtool_ringparam", unsafe.Sizeof(rings), 36},
+		{"ethtool_ringparam.tx_pending", unsafe.Offsetof(rings.TxPending), 32},
+		{"ethtool_channels", unsafe.Sizeof(EthtoolChannels{}), 36},
+		{"ethtool_coalesce", unsafe.Sizeof(coalesce), 92},
+		{"ethtool_coalesce.rate_sample_interval", unsafe.Offsetof(coalesce.RateSampleInterval), 88},
+		{"ethtool_pauseparam", unsafe.Sizeof(ethtoolPauseParam{}), 16},
+		{"ethtool_gfeatures.features", unsafe.Offsetof(g.blocks), 8},
+		{"ethtool_get_features_block", unsafe.Sizeof(ethtoolFeaturesBlock{}), 16},
+		{"ifreq.ifr_data", unsafe.Offsetof(ethtoolIfreq{}.data), 16},
+	} {
+		if tc.size != tc.want {
+			t.Errorf("%s is %d bytes, want %d", tc.name, tc.size, tc.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"unsafe"
+
+	"github.com/running910/gokit/logger"
+	"github.com/running910/gokit/misc"
+	"github.com/safchain/ethtool"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+type NicKind string
+
+const (
+	// backed by a pci device, virtual functions included
+	NicKindPhysical NicKind = "physical"
+	NicKindVlan     NicKind = "vlan"
+	NicKindMacvlan  NicKind = "macvlan"
+	NicKindBridge   NicKind = "bridge"
+	NicKindVeth     NicKind = "veth"
+	// loopback, tun, bond, dummy and every other software nic
+	NicKindVirtual NicKind = "virtual"
+)
+
+// NicInfo is the inventory entry of one nic
+type NicInfo struct {
+	Name  string
+	Index int
+	Kind  NicKind
+	// named namespace of the nic, empty for the current one
+	Netns string
+
+	Mac     string
+	PermMac string
+	Mtu     int
+	// administratively up
+	Up bool
+	// operational state as ip link shows it, up, down, lowerlayerdown...
+	State string
+	// Mbps, 0 when unknown
+	Speed uint32
+
+	Driver        string
+	DriverVersion string
+	Firmware      string
+	// nil unless the nic is physical
+	Pci *misc.PciDevice
+
+	// lower nic of a vlan or macvlan, bridge or bond of an enslaved nic
+	Parent string
+	Master string
+
+	// addresses in cidr notation
+	Addrs []string
+}
+
+type NicInventory []NicInfo
+
+func nicKind(linkType string, pci bool) NicKind {
+	switch linkType {
+	case "vlan":
+		return NicKindVlan
+	case "macvlan":
+		return NicKindMacvlan
+	case "bridge":
+		return NicKindBridge
+	case "veth":
+		return NicKindVeth
+	case "device":
+		if pci {
+			return NicKindPhysical
+		}
+	}
+	return NicKindVirtual
+}
+
+// Inventory returns every nic of the current namespace followed by those of the named
+// namespaces under /var/run/netns, all of them if none is given
+func Inventory(namespaces ...string) (NicInventory, error) {
+	inventory, err := NsInventory(netns.None(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(namespaces) == 0 {
+		if namespaces, err = ListNetns(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range namespaces {
+		ns, err := netns.GetFromName(name)
+		if err != nil {
+			logger.Errorf("netns.GetFromName() %s failed! reason:%s", name, err)
+			return nil, err
+		}
+
+		nics, err := NsInventory(ns, name)
+		ns.Close()
+		if err != nil {
+			return nil, err
+		}
+		inventory = append(inventory, nics...)
+	}
+
+	return inventory, nil
+}
+
+// NsInventory returns every nic of ns, name is reported in NicInfo.Netns
+func NsInventory(ns netns.NsHandle, name string) (NicInventory, error) {
+	var handle *netlink.Handle
+	var e *Ethtool
+
+	// the netlink and ethtool sockets are bound to ns once opened
+	err := RunInNs(ns, func() error {
+		var err error
+		if handle, err = netlink.NewHandle(); err != nil {
+			logger.Errorf("netlink.NewHandle() failed! reason:%s", err)
+			return err
+		}
+
+		if e, err = NewEthtool(); err != nil {
+			handle.Delete()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Delete()
+	defer e.Close()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		logger.Errorf("netlink.LinkList() failed! reason:%s", err)
+		return nil, err
+	}
+
+	names := make(map[int]string, len(links))
+	for _, link := range links {
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	inventory := make(NicInventory, 0, len(links))
+	for _, link := range links {
+		attrs := link.Attrs()
+		info := NicInfo{
+			Name:   attrs.Name,
+			Index:  attrs.Index,
+			Netns:  name,
+			Mac:    attrs.HardwareAddr.String(),
+			Mtu:    attrs.MTU,
+			Up:     attrs.Flags&1 != 0,
+			State:  attrs.OperState.String(),
+			Parent: names[attrs.ParentIndex],
+			Master: names[attrs.MasterIndex],
+		}
+
+		addrs, err := handle.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			logger.Errorf("netlink.AddrList() nic %s failed! reason:%s", attrs.Name, err)
+			return nil, err
+		}
+		for _, addr := range addrs {
+			info.Addrs = append(info.Addrs, addr.IPNet.String())
+		}
+
+		// software nics may not implement the ethtool calls, they are left empty
+		if drv, err := e.handle.DriverInfo(attrs.Name); err == nil {
+			info.Driver, info.DriverVersion, info.Firmware = drv.Driver, drv.Version, drv.FwVersion
+			if drv.BusInfo != "" && strings.Count(drv.BusInfo, ":") == 2 {
+				// the bus info is the pci slot, sysfs of the host knows it whatever the namespace
+				if dev, err := misc.GetPciDevice(drv.BusInfo); err == nil {
+					info.Pci = dev
+				}
+			}
+		}
+		info.Kind = nicKind(link.Type(), info.Pci != nil)
+
+		if info.Kind == NicKindPhysical {
+			if perm, err := e.handle.PermAddr(attrs.Name); err == nil {
+				info.PermMac = perm
+			}
+
+			cmd := ethtool.EthtoolCmd{Cmd: ethtoolGSet}
+			if err := e.ioctl(attrs.Name, unsafe.Pointer(&cmd)); err == nil {
+				if speed := uint32(cmd.Speed_hi)<<16 | uint32(cmd.Speed); speed != 0xffffffff {
+					info.Speed = speed
+				}
+			}
+		}
+
+		inventory = append(inventory, info)
+	}
+
+	return inventory, nil
+}
+
+func (inv NicInventory) JSON() ([]byte, error) {
+	return json.MarshalIndent(inv, "", "  ")
+}
+
+// Table renders the inventory as ip link and lshw do, one nic per line
+func (inv NicInventory) Table() string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "NETNS\tNAME\tKIND\tSTATE\tSPEED\tMAC\tDRIVER\tFIRMWARE\tPCI\tNUMA\tADDRESSES")
+	for _, nic := range inv {
+		speed, pci, numa := "-", "-", "-"
+		if nic.Speed != 0 {
+			speed = fmt.Sprintf("%dMb/s", nic.Speed)
+		}
+		if nic.Pci != nil {
+			pci = nic.Pci.Slot
+			if nic.Pci.NumaNode >= 0 {
+				numa = fmt.Sprint(nic.Pci.NumaNode)
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orDash(nic.Netns), nic.Name, nic.Kind, nic.State, speed, orDash(nic.Mac),
+			orDash(nic.Driver), orDash(nic.Firmware), pci, numa, orDash(strings.Join(nic.Addrs, ",")))
+	}
+
+	w.Flush()
+	return buf.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
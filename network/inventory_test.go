@@ -0,0 +1,86 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/running910/gokit/misc"
+)
+
+func TestNicKind(t *testing.T) {
+	for _, tc := range []struct {
+		linkType string
+		pci      bool
+		want     NicKind
+	}{
+		{"device", true, NicKindPhysical},
+		{"device", false, NicKindVirtual},
+		{"vlan", false, NicKindVlan},
+		{"macvlan", false, NicKindMacvlan},
+		{"bridge", false, NicKindBridge},
+		{"veth", false, NicKindVeth},
+		{"tuntap", false, NicKindVirtual},
+	} {
+		if kind := nicKind(tc.linkType, tc.pci); kind != tc.want {
+			t.Errorf("nicKind(%s, %v) = %s, want %s", tc.linkType, tc.pci, kind, tc.want)
+		}
+	}
+}
+
+func TestNicInventoryOutput(t *testing.T) {
+	inv := NicInventory{
+		{Name: "ens1f0", Kind: NicKindPhysical, State: "up", Speed: 10000, Mac: "3c:fd:fe:00:00:01",
+			Driver: "i40e", Firmware: "8.30", Pci: &misc.PciDevice{Slot: "0000:03:00.0", NumaNode: 1},
+			Addrs: []string{"10.0.0.1/24", "fe80::1/64"}},
+		{Name: "veth1", Kind: NicKindVeth, Netns: "blue", State: "down"},
+	}
+
+	lines := strings.Split(strings.TrimSpace(inv.Table()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), inv.Table())
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") !=
+		"- ens1f0 physical up 10000Mb/s 3c:fd:fe:00:00:01 i40e 8.30 0000:03:00.0 1 10.0.0.1/24,fe80::1/64" {
+		t.Errorf("bad physical line %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); strings.Join(fields, " ") != "blue veth1 veth down - - - - - - -" {
+		t.Errorf("bad veth line %q", lines[2])
+	}
+
+	content, err := inv.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded NicInventory
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].Pci.Slot != "0000:03:00.0" || decoded[1].Netns != "blue" {
+		t.Fatalf("bad json round trip %+v", decoded)
+	}
+}
+
+func TestListNetns(t *testing.T) {
+	defer func(dir string) { netnsDir = dir }(netnsDir)
+
+	netnsDir = filepath.Join(t.TempDir(), "netns")
+	if names, err := ListNetns(); err != nil || len(names) != 0 {
+		t.Fatalf("missing netns dir got %v %v", names, err)
+	}
+
+	os.Mkdir(netnsDir, 0755)
+	for _, name := range []string{"red", "blue"} {
+		if err := os.WriteFile(filepath.Join(netnsDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(netnsDir, "dir"), 0755)
+
+	if names, err := ListNetns(); err != nil || !reflect.DeepEqual(names, []string{"blue", "red"}) {
+		t.Fatalf("ListNetns() = %v %v", names, err)
+	}
+}
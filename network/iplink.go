@@ -139,7 +139,7 @@ func SetNsNicMacaddr(ns netns.NsHandle, nic string, macaddr string) error {
 	}
 
 	if err := handle.LinkSetHardwareAddr(link, []byte(mac)); err != nil {
-		logger.Errorf("handle.LinkSetHardwareAddr() failed!, %s, %s", nic, mac, err)
+		logger.Errorf("handle.LinkSetHardwareAddr() failed!, %s, %s, %s", nic, mac, err)
 		return err
 	}
 
@@ -177,7 +177,7 @@ func SetNicLinkDown(nic string) error {
 }
 
 func CheckIfNicExist(nic string) bool {
-	_, err := os.Stat("/sys/class/net/" + nic)
+	_, err := os.Stat(misc.SysfsPath("class/net", nic))
 	if err == nil {
 		return true
 	}
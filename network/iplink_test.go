@@ -0,0 +1,23 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/running910/gokit/misc"
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func TestCheckIfNicExist(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.AddPciDevice(sysfstest.PciDevice{Slot: "0000:03:00.0", Vendor: "0x8086", Driver: "ixgbe", Netdevs: []string{"ens33"}})
+	tree.AddNic(sysfstest.Nic{Name: "br0"})
+
+	defer func(old string) { misc.SysfsRoot = old }(misc.SysfsRoot)
+	misc.SysfsRoot = tree.Sys
+
+	for nic, want := range map[string]bool{"ens33": true, "br0": true, "eth9": false} {
+		if got := CheckIfNicExist(nic); got != want {
+			t.Errorf("CheckIfNicExist(%s) = %v, want %v", nic, got, want)
+		}
+	}
+}
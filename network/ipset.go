@@ -0,0 +1,343 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/running910/gokit/logger"
+)
+
+type IpsetType string
+
+const (
+	IpsetHashIp     IpsetType = "hash:ip"
+	IpsetHashNet    IpsetType = "hash:net"
+	IpsetHashIpPort IpsetType = "hash:ip,port"
+	IpsetBitmapPort IpsetType = "bitmap:port"
+)
+
+// ipset set names are limited to 31 characters
+const ipsetMaxNameLen = 31
+
+type IpsetOptions struct {
+	// IpProtoV6 creates an inet6 set, hash types only
+	Family IpProto
+	// default timeout of members in seconds, 0 disables timeout support of the set
+	Timeout  int
+	HashSize int
+	MaxElem  int
+	// port range of bitmap:port set, e.g. "1-65535"
+	PortRange string
+}
+
+func (o IpsetOptions) createArgs(setType IpsetType) []string {
+	args := make([]string, 0)
+
+	if setType == IpsetBitmapPort {
+		portRange := o.PortRange
+		if portRange == "" {
+			portRange = "0-65535"
+		}
+		args = append(args, "range", portRange)
+	} else {
+		family := "inet"
+		if o.Family == IpProtoV6 {
+			family = "inet6"
+		}
+		args = append(args, "family", family)
+
+		if o.HashSize > 0 {
+			args = append(args, "hashsize", strconv.Itoa(o.HashSize))
+		}
+		if o.MaxElem > 0 {
+			args = append(args, "maxelem", strconv.Itoa(o.MaxElem))
+		}
+	}
+
+	if o.Timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(o.Timeout))
+	}
+
+	return args
+}
+
+// ipsetCommand is the ipset binary
+var ipsetCommand = "ipset"
+
+func runIpset(stdin []byte, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command(ipsetCommand, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("ipset %s failed: %s %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// IpsetCreate creates the set if it does not exist yet
+func IpsetCreate(name string, setType IpsetType, opts IpsetOptions) error {
+	args := append([]string{"create", name, string(setType)}, opts.createArgs(setType)...)
+
+	if _, err := runIpset(nil, append(args, "-exist")...); err != nil {
+		logger.Errorf("IpsetCreate() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+func IpsetDestroy(name string) error {
+	if _, err := runIpset(nil, "destroy", name); err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return nil
+		}
+		logger.Errorf("IpsetDestroy() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+// IpsetAdd adds entry to the set, timeout in seconds overrides the default timeout of the set if > 0
+func IpsetAdd(name string, entry string, timeout int) error {
+	args := []string{"add", name, entry}
+	if timeout > 0 {
+		args = append(args, "timeout", strconv.Itoa(timeout))
+	}
+
+	if _, err := runIpset(nil, append(args, "-exist")...); err != nil {
+		logger.Errorf("IpsetAdd() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+func IpsetDel(name string, entry string) error {
+	if _, err := runIpset(nil, "del", name, entry, "-exist"); err != nil {
+		logger.Errorf("IpsetDel() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+func IpsetTest(name string, entry string) (bool, error) {
+	_, err := runIpset(nil, "test", name, entry)
+	if err == nil {
+		return true, nil
+	}
+
+	if strings.Contains(err.Error(), "is NOT in set") {
+		return false, nil
+	}
+
+	logger.Errorf("IpsetTest() failed! reason:%s", err)
+	return false, err
+}
+
+func IpsetFlush(name string) error {
+	if _, err := runIpset(nil, "flush", name); err != nil {
+		logger.Errorf("IpsetFlush() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+// IpsetSwap exchanges the content of two sets of the same type atomically
+func IpsetSwap(name string, other string) error {
+	if _, err := runIpset(nil, "swap", name, other); err != nil {
+		logger.Errorf("IpsetSwap() failed! reason:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+// IpsetList returns the members of the set, member timeouts are stripped
+func IpsetList(name string) ([]string, error) {
+	out, err := runIpset(nil, "list", name)
+	if err != nil {
+		logger.Errorf("IpsetList() failed! reason:%s", err)
+		return nil, err
+	}
+
+	members := make([]string, 0)
+	inMembers := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "Members:" {
+			inMembers = true
+			continue
+		}
+
+		if inMembers && line != "" {
+			members = append(members, strings.Fields(line)[0])
+		}
+	}
+
+	return members, nil
+}
+
+// IpsetReplace replaces all members of the set atomically: the entries are loaded into a
+// temporary set with ipset restore, which is then swapped with the set and destroyed.
+// The set is created if it does not exist, rules referencing it never see a partial set.
+func IpsetReplace(name string, setType IpsetType, opts IpsetOptions, entries []string) error {
+	if err := IpsetCreate(name, setType, opts); err != nil {
+		return err
+	}
+
+	tmp := name + "-tmp"
+	if len(tmp) > ipsetMaxNameLen {
+		tmp = name[:ipsetMaxNameLen-4] + "-tmp"
+	}
+
+	var batch bytes.Buffer
+	createArgs := opts.createArgs(setType)
+	fmt.Fprintf(&batch, "create %s %s %s -exist\n", tmp, setType, strings.Join(createArgs, " "))
+	fmt.Fprintf(&batch, "flush %s\n", tmp)
+	for _, entry := range entries {
+		fmt.Fprintf(&batch, "add %s %s -exist\n", tmp, entry)
+	}
+	fmt.Fprintf(&batch, "swap %s %s\n", tmp, name)
+	fmt.Fprintf(&batch, "destroy %s\n", tmp)
+
+	if _, err := runIpset(batch.Bytes(), "restore"); err != nil {
+		logger.Errorf("IpsetReplace() %s with %d entries failed! reason:%s", name, len(entries), err)
+		IpsetDestroy(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// MatchSetSpecs returns the rule specs matching set, dirs are "src" or "dst", one per set
+// dimension, e.g. "dst", "dst" for a hash:ip,port set matching destination address and port.
+// With the nftables backend the set is looked up among the nftables sets of the rule table.
+func MatchSetSpecs(name string, dirs ...string) []string {
+	if len(dirs) == 0 {
+		dirs = []string{"src"}
+	}
+
+	return []string{"-m", "set", "--match-set", name, strings.Join(dirs, ",")}
+}
+
+// EnsureSet creates a set usable with MatchSetSpecs in rules of table: an ipset for the
+// iptables backend, a named nftables set in table for the nftables backend.
+// hash:ip,port is only available with the iptables backend.
+func (i *IptablesCtx) EnsureSet(proto IpProto, table, name string, setType IpsetType, opts IpsetOptions) error {
+	nft, ok := i.getIpt(proto).(*NftablesBackend)
+	if !ok {
+		opts.Family = proto
+		return IpsetCreate(name, setType, opts)
+	}
+
+	keyType, interval, err := nftSetKeyType(proto, setType)
+	if err != nil {
+		logger.Errorf("EnsureSet() %s failed! reason:%s", name, err)
+		return err
+	}
+
+	return nft.EnsureSet(table, name, keyType, interval, time.Duration(opts.Timeout)*time.Second)
+}
+
+// ReplaceSet replaces all members of the set created by EnsureSet atomically
+func (i *IptablesCtx) ReplaceSet(proto IpProto, table, name string, setType IpsetType, opts IpsetOptions, entries []string) error {
+	nft, ok := i.getIpt(proto).(*NftablesBackend)
+	if !ok {
+		opts.Family = proto
+		return IpsetReplace(name, setType, opts, entries)
+	}
+
+	if err := i.EnsureSet(proto, table, name, setType, opts); err != nil {
+		return err
+	}
+
+	elements := make([]nftables.SetElement, 0, len(entries))
+	for _, entry := range entries {
+		elems, err := nftSetElements(proto, setType, entry)
+		if err != nil {
+			logger.Errorf("ReplaceSet() %s failed! reason:%s", name, err)
+			return err
+		}
+		elements = append(elements, elems...)
+	}
+
+	return nft.ReplaceSetElements(table, name, elements)
+}
+
+func nftSetKeyType(proto IpProto, setType IpsetType) (nftables.SetDatatype, bool, error) {
+	addrType := nftables.TypeIPAddr
+	if proto == IpProtoV6 {
+		addrType = nftables.TypeIP6Addr
+	}
+
+	switch setType {
+	case IpsetHashIp:
+		return addrType, false, nil
+	case IpsetHashNet:
+		return addrType, true, nil
+	case IpsetBitmapPort:
+		return nftables.TypeInetService, false, nil
+	}
+
+	return nftables.TypeInvalid, false, fmt.Errorf("set type %s is not supported by nftables backend", setType)
+}
+
+// nftSetElements converts an ipset entry to nftables set elements, a network becomes an interval
+func nftSetElements(proto IpProto, setType IpsetType, entry string) ([]nftables.SetElement, error) {
+	if setType == IpsetBitmapPort {
+		data, err := parsePort(entry)
+		if err != nil {
+			return nil, err
+		}
+		return []nftables.SetElement{{Key: data}}, nil
+	}
+
+	family := nftables.TableFamilyIPv4
+	if proto == IpProtoV6 {
+		family = nftables.TableFamilyIPv6
+	}
+
+	b := &nftRuleBuilder{family: family}
+	ip, mask, err := b.parseAddr(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if setType != IpsetHashNet {
+		return []nftables.SetElement{{Key: ip}}, nil
+	}
+
+	// interval end is the first address after the network
+	end := make(net.IP, len(ip))
+	carry := true
+	for k := len(ip) - 1; k >= 0; k-- {
+		end[k] = ip[k] | ^mask[k]
+		if carry {
+			end[k]++
+			carry = end[k] == 0
+		}
+	}
+
+	elements := []nftables.SetElement{{Key: ip}}
+	if !carry {
+		elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// useFakeIpset replaces the ipset binary by a script logging its arguments and stdin, it
+// returns the function reading the log
+func useFakeIpset(t *testing.T) func() []string {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := `#!/bin/sh
+echo "$*" >> ` + log + `
+case "$1" in
+restore) cat >> ` + log + ` ;;
+test) [ "$3" = 10.0.0.9 ] && { echo "ipset v7.1: Warning: 10.0.0.9 is NOT in set $2." >&2; exit 1; } ;;
+list) printf 'Name: %s\nType: hash:ip\nMembers:\n10.0.0.1 timeout 30\n10.0.0.2 timeout 29\n' "$2" ;;
+esac
+exit 0
+`
+	if err := os.WriteFile(filepath.Join(dir, "ipset"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := ipsetCommand
+	ipsetCommand = filepath.Join(dir, "ipset")
+	t.Cleanup(func() { ipsetCommand = old })
+
+	return func() []string {
+		content, _ := os.ReadFile(log)
+		os.Remove(log)
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+}
+
+func TestIpsetArgs(t *testing.T) {
+	calls := useFakeIpset(t)
+
+	IpsetCreate("x", IpsetHashIp, IpsetOptions{Timeout: 60, HashSize: 1024, MaxElem: 4096})
+	IpsetCreate("x6", IpsetHashNet, IpsetOptions{Family: IpProtoV6})
+	IpsetCreate("p", IpsetBitmapPort, IpsetOptions{Family: IpProtoV6, PortRange: "1000-2000", HashSize: 1024})
+	IpsetAdd("x", "10.0.0.1", 30)
+	IpsetAdd("x", "10.0.0.2", 0)
+	IpsetDel("x", "10.0.0.1")
+	IpsetSwap("x", "y")
+	IpsetFlush("x")
+
+	want := []string{
+		"create x hash:ip family inet hashsize 1024 maxelem 4096 timeout 60 -exist",
+		"create x6 hash:net family inet6 -exist",
+		"create p bitmap:port range 1000-2000 -exist",
+		"add x 10.0.0.1 timeout 30 -exist",
+		"add x 10.0.0.2 -exist",
+		"del x 10.0.0.1 -exist",
+		"swap x y",
+		"flush x",
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if ok, err := IpsetTest("x", "10.0.0.1"); err != nil || !ok {
+		t.Fatalf("member test %v %v", ok, err)
+	}
+	if ok, err := IpsetTest("x", "10.0.0.9"); err != nil || ok {
+		t.Fatalf("non member test %v %v", ok, err)
+	}
+	calls()
+
+	if members, err := IpsetList("x"); err != nil || !reflect.DeepEqual(members, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Fatalf("members %q %v", members, err)
+	}
+	calls()
+
+	// the temporary set name stays within the ipset limit
+	name := strings.Repeat("n", ipsetMaxNameLen)
+	if err := IpsetReplace(name, IpsetHashIp, IpsetOptions{Timeout: 10}, []string{"10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	tmp := strings.Repeat("n", ipsetMaxNameLen-4) + "-tmp"
+	want = []string{
+		"create " + name + " hash:ip family inet timeout 10 -exist",
+		"restore",
+		"create " + tmp + " hash:ip family inet timeout 10 -exist",
+		"flush " + tmp,
+		"add " + tmp + " 10.0.0.3 -exist",
+		"swap " + tmp + " " + name,
+		"destroy " + tmp,
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNftMatchSet(t *testing.T) {
+	sets := map[string]IpsetType{"ips": IpsetHashIp, "ports": IpsetBitmapPort}
+	keyType := func(name string) (nftables.SetDatatype, error) {
+		kt, _, err := nftSetKeyType(IpProtoV4, sets[name])
+		return kt, err
+	}
+
+	exprs, _, err := nftRuleExprs(nftables.TableFamilyIPv4, MatchSetSpecs("ips", "dst"), keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := exprs[0].(*expr.Payload); p.Base != expr.PayloadBaseNetworkHeader || p.Offset != 16 || p.Len != 4 {
+		t.Fatalf("address set loads %+v", p)
+	}
+
+	exprs, _, err = nftRuleExprs(nftables.TableFamilyIPv4, append([]string{"-p", "tcp"}, MatchSetSpecs("ports", "dst")...), keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := exprs[2].(*expr.Payload); p.Base != expr.PayloadBaseTransportHeader || p.Offset != 2 || p.Len != 2 {
+		t.Fatalf("port set loads %+v", p)
+	}
+
+	if _, _, err := nftRuleExprs(nftables.TableFamilyIPv4, MatchSetSpecs("ports", "dst"), keyType); err == nil {
+		t.Fatal("expect an error for a port set without protocol")
+	}
+	if _, _, err := nftRuleExprs(nftables.TableFamilyIPv4, MatchSetSpecs("ips", "dst", "dst"), keyType); err == nil {
+		t.Fatal("expect an error for a hash:ip,port match")
+	}
+	if _, _, err := nftSetKeyType(IpProtoV4, IpsetHashIpPort); err == nil {
+		t.Fatal("expect hash:ip,port to be rejected")
+	}
+}
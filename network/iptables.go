@@ -1,44 +1,269 @@
 package network
 
 import (
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/running910/gokit/logger"
 )
 
+type IptablesBackendKind string
+
+const (
+	// the backend the host uses, see DetectIptablesBackend
+	IptablesBackendAuto     IptablesBackendKind = "auto"
+	IptablesBackendIptables IptablesBackendKind = "iptables"
+	IptablesBackendNftables IptablesBackendKind = "nftables"
+)
+
+// IptablesBackend is the set of table operations IptablesCtx is built on, it is satisfied
+// by *iptables.IPTables from go-iptables and by NftablesBackend.
+type IptablesBackend interface {
+	ChainExists(table, chain string) (bool, error)
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+	ListChains(table string) ([]string, error)
+	List(table, chain string) ([]string, error)
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Append(table, chain string, rulespec ...string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+}
+
+type IptablesOptions struct {
+	Backend IptablesBackendKind
+	// owner tag appended to every rule as "-m comment --comment owner:<id>", empty means untagged
+	Owner string
+	// how long to wait for the xtables lock held by other processes, 0 waits forever
+	LockWait time.Duration
+	// retries of an operation failing with "resource temporarily unavailable", default 3
+	Retries int
+	// first retry delay, doubled on each retry, default 100ms
+	RetryBackoff time.Duration
+}
+
+// IptablesCtx is safe for concurrent use, operations on the same table are serialized
 type IptablesCtx struct {
-	ip4t *iptables.IPTables
-	ip6t *iptables.IPTables
+	ip4t IptablesBackend
+	ip6t IptablesBackend
+
+	kind IptablesBackendKind
+	opts IptablesOptions
+
+	owner string
+
+	mu sync.Mutex
+	// per proto and table locks, making check-then-act sequences atomic within the process
+	tableLocks map[string]*sync.Mutex
+}
+
+// DetectIptablesBackend returns nftables if the host has no iptables binary or if the
+// iptables binary is the nf_tables variant, otherwise iptables for the legacy xtables.
+func DetectIptablesBackend() IptablesBackendKind {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return IptablesBackendNftables
+	}
+
+	out, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		logger.Errorf("%s --version failed! reason:%s", path, err)
+		return IptablesBackendIptables
+	}
+
+	if strings.Contains(string(out), "nf_tables") {
+		return IptablesBackendNftables
+	}
+
+	return IptablesBackendIptables
 }
 
+// NewIptablesCtx returns an IptablesCtx on the backend the host uses
 func NewIptablesCtx() (*IptablesCtx, error) {
+	return NewIptablesCtxWithBackend(IptablesBackendAuto, "")
+}
+
+// NewIptablesCtxWithOwner returns an IptablesCtx whose rules and created chains are all tagged
+// with owner, so that they can be listed with ListOwned and removed with PurgeOwned or Release.
+func NewIptablesCtxWithOwner(owner string) (*IptablesCtx, error) {
+	return NewIptablesCtxWithBackend(IptablesBackendAuto, owner)
+}
 
-	ip4t, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+func NewIptablesCtxWithBackend(kind IptablesBackendKind, owner string) (*IptablesCtx, error) {
+	return NewIptablesCtxWithOptions(IptablesOptions{Backend: kind, Owner: owner})
+}
+
+func NewIptablesCtxWithOptions(opts IptablesOptions) (*IptablesCtx, error) {
+	kind := opts.Backend
+	if kind == IptablesBackendAuto || kind == "" {
+		kind = DetectIptablesBackend()
+	}
+
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+
+	i := &IptablesCtx{
+		kind:       kind,
+		opts:       opts,
+		owner:      opts.Owner,
+		tableLocks: make(map[string]*sync.Mutex),
+	}
+
+	if kind == IptablesBackendNftables {
+		ip4t, err := NewNftablesBackend(IpProtoV4)
+		if err != nil {
+			logger.Errorf("NewNftablesBackend() failed with proto ipv4! reason:%s", err)
+			return nil, err
+		}
+
+		ip6t, err := NewNftablesBackend(IpProtoV6)
+		if err != nil {
+			logger.Errorf("NewNftablesBackend() failed with proto ipv6! reason:%s", err)
+			return nil, err
+		}
+
+		i.ip4t, i.ip6t = ip4t, ip6t
+		return i, nil
+	}
+
+	wait := lockWaitSeconds(opts.LockWait)
+
+	ip4t, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4), iptables.Timeout(wait))
 	if err != nil {
 		logger.Errorf("NewWithProtocol() failed with proto ipv4! reason:%s", err)
 		return nil, err
 	}
 
-	ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	ip6t, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv6), iptables.Timeout(wait))
 	if err != nil {
 		logger.Errorf("NewWithProtocol() failed with proto ipv4! reason:%s", err)
 		return nil, err
 	}
 
-	return &IptablesCtx{ip4t: ip4t, ip6t: ip6t}, nil
+	i.ip4t, i.ip6t = ip4t, ip6t
+	return i, nil
+}
 
+// lockWaitSeconds rounds the xtables lock wait up to seconds, so that a short wait is not forever
+func lockWaitSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
 }
 
-func (i *IptablesCtx) Release() {
+func (i *IptablesCtx) BackendKind() IptablesBackendKind {
+	return i.kind
+}
 
+// Backend returns the underlying backend of proto, type assert it to *NftablesBackend for
+// nftables sets and maps.
+func (i *IptablesCtx) Backend(proto IpProto) IptablesBackend {
+	return i.getIpt(proto)
 }
 
-func (i *IptablesCtx) EnsureChain(proto IpProto, table, chain string) error {
+func (i *IptablesCtx) Owner() string {
+	return i.owner
+}
 
-	ipt := i.ip4t
+// Release removes every rule and chain tagged with the ctx owner, it does nothing for untagged ctx.
+func (i *IptablesCtx) Release() {
+	if i.owner == "" {
+		return
+	}
+
+	if err := i.PurgeOwned(i.owner); err != nil {
+		logger.Errorf("PurgeOwned() owner:%s failed! reason:%s", i.owner, err)
+	}
+}
+
+func (i *IptablesCtx) getIpt(proto IpProto) IptablesBackend {
 	if proto == IpProtoV6 {
-		ipt = i.ip6t
+		return i.ip6t
+	}
+	return i.ip4t
+}
+
+// lockTables locks the tables of proto in a fixed order and returns the unlock function
+func (i *IptablesCtx) lockTables(proto IpProto, tables ...string) func() {
+	keys := make([]string, 0, len(tables))
+	for _, table := range tables {
+		key := string(proto) + "/" + table
+		if !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	locks := make([]*sync.Mutex, 0, len(keys))
+	i.mu.Lock()
+	for _, key := range keys {
+		if i.tableLocks[key] == nil {
+			i.tableLocks[key] = &sync.Mutex{}
+		}
+		locks = append(locks, i.tableLocks[key])
+	}
+	i.mu.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+
+	return func() {
+		for k := len(locks) - 1; k >= 0; k-- {
+			locks[k].Unlock()
+		}
+	}
+}
+
+// isIptablesBusy tells whether err is a transient failure caused by a concurrent writer
+func isIptablesBusy(err error) bool {
+	if e, ok := err.(*iptables.Error); ok && e.ExitStatus() == 4 {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "resource temporarily unavailable") ||
+		strings.Contains(msg, "xtables lock") ||
+		strings.Contains(msg, "device or resource busy")
+}
+
+// retry runs op again with exponential backoff while it fails with a transient error
+func (i *IptablesCtx) retry(op func() error) error {
+	backoff := i.opts.RetryBackoff
+
+	err := op()
+	for k := 0; k < i.opts.Retries && err != nil && isIptablesBusy(err); k++ {
+		logger.Infof("iptables busy, retry in %s. reason:%s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		err = op()
+	}
+
+	return err
+}
+
+// ownedSpecs appends the owner comment match to specs if the ctx is tagged
+func (i *IptablesCtx) ownedSpecs(specs []string) []string {
+	if i.owner == "" {
+		return specs
 	}
 
+	return append(append([]string{}, specs...), ownerCommentSpecs(i.owner)...)
+}
+
+func (i *IptablesCtx) EnsureChain(proto IpProto, table, chain string) error {
+
+	ipt := i.getIpt(proto)
+	defer i.lockTables(proto, table)()
+
 	exist, err := ipt.ChainExists(table, chain)
 	if err != nil {
 		logger.Errorf("ChainExists for existing chain failed: %v\n", err)
@@ -46,11 +271,19 @@ func (i *IptablesCtx) EnsureChain(proto IpProto, table, chain string) error {
 	} else if !exist {
 		logger.Errorf("ChainExists doesn't find existing chain")
 
-		err = ipt.ClearChain(table, chain)
+		err = i.retry(func() error { return ipt.ClearChain(table, chain) })
 		if err != nil {
 			logger.Errorf("ClearChain (of empty) failed: %v\n", err)
 			return err
 		}
+
+		if i.owner != "" {
+			err = i.retry(func() error { return ipt.Append(table, chain, chainMarkerSpecs(i.owner)...) })
+			if err != nil {
+				logger.Errorf("Append owner marker to chain %s failed: %v\n", chain, err)
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -59,10 +292,9 @@ func (i *IptablesCtx) EnsureChain(proto IpProto, table, chain string) error {
 
 func (i *IptablesCtx) EnsureRuleAppended(proto IpProto, table, chain string, specs ...string) error {
 
-	ipt := i.ip4t
-	if proto == IpProtoV6 {
-		ipt = i.ip6t
-	}
+	ipt := i.getIpt(proto)
+	specs = i.ownedSpecs(specs)
+	defer i.lockTables(proto, table)()
 
 	exist, err := ipt.Exists(table, chain, specs...)
 	if err != nil {
@@ -71,7 +303,7 @@ func (i *IptablesCtx) EnsureRuleAppended(proto IpProto, table, chain string, spe
 	} else if !exist {
 		logger.Errorf("Exists doesn't find existing rule")
 
-		err = ipt.Append(table, chain, specs...)
+		err = i.retry(func() error { return ipt.Append(table, chain, specs...) })
 		//err = ipt.Insert(table, chain, 1, specs...)
 		if err != nil {
 			logger.Errorf("Append failed: %v\n", err)
@@ -84,10 +316,9 @@ func (i *IptablesCtx) EnsureRuleAppended(proto IpProto, table, chain string, spe
 
 func (i *IptablesCtx) EnsureRuleInserted(proto IpProto, table, chain string, specs ...string) error {
 
-	ipt := i.ip4t
-	if proto == IpProtoV6 {
-		ipt = i.ip6t
-	}
+	ipt := i.getIpt(proto)
+	specs = i.ownedSpecs(specs)
+	defer i.lockTables(proto, table)()
 
 	exist, err := ipt.Exists(table, chain, specs...)
 	if err != nil {
@@ -97,7 +328,7 @@ func (i *IptablesCtx) EnsureRuleInserted(proto IpProto, table, chain string, spe
 		logger.Errorf("Exists doesn't find existing rule")
 
 		//err = ipt.Append(table, chain, specs...)
-		err = ipt.Insert(table, chain, 1, specs...)
+		err = i.retry(func() error { return ipt.Insert(table, chain, 1, specs...) })
 		if err != nil {
 			logger.Errorf("Append failed: %v\n", err)
 			return err
@@ -109,12 +340,11 @@ func (i *IptablesCtx) EnsureRuleInserted(proto IpProto, table, chain string, spe
 
 func (i *IptablesCtx) DeleteRule(proto IpProto, table, chain string, specs ...string) error {
 
-	ipt := i.ip4t
-	if proto == IpProtoV6 {
-		ipt = i.ip6t
-	}
+	ipt := i.getIpt(proto)
+	specs = i.ownedSpecs(specs)
+	defer i.lockTables(proto, table)()
 
-	err := ipt.DeleteIfExists(table, chain, specs...)
+	err := i.retry(func() error { return ipt.DeleteIfExists(table, chain, specs...) })
 	if err != nil {
 		logger.Errorf("DeleteIfExists %s table %s chain specs:%+v failed! reason:%s", table, chain, specs, err)
 		return err
@@ -125,12 +355,10 @@ func (i *IptablesCtx) DeleteRule(proto IpProto, table, chain string, specs ...st
 
 func (i *IptablesCtx) DeleteChain(proto IpProto, table, chain string) error {
 
-	ipt := i.ip4t
-	if proto == IpProtoV6 {
-		ipt = i.ip6t
-	}
+	ipt := i.getIpt(proto)
+	defer i.lockTables(proto, table)()
 
-	err := ipt.ClearAndDeleteChain(table, chain)
+	err := i.retry(func() error { return ipt.ClearAndDeleteChain(table, chain) })
 	if err != nil {
 		logger.Errorf("ClearAndDeleteChain %s table %s chain failed! reason: %s", table, chain, err)
 		return err
@@ -0,0 +1,247 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/running910/gokit/logger"
+)
+
+type iptablesBatchOpKind int
+
+const (
+	iptablesBatchEnsureChain iptablesBatchOpKind = iota
+	iptablesBatchAppend
+	iptablesBatchInsert
+	iptablesBatchDelete
+)
+
+type iptablesBatchOp struct {
+	kind  iptablesBatchOpKind
+	table string
+	chain string
+	specs []string
+}
+
+// IptablesBatch queues rule changes of one proto and commits them at once. With the iptables
+// backend the changes of all tables are written by a single iptables-restore --noflush call,
+// so other processes never see them half applied.
+type IptablesBatch struct {
+	i     *IptablesCtx
+	proto IpProto
+	ops   []iptablesBatchOp
+}
+
+func (i *IptablesCtx) NewBatch(proto IpProto) *IptablesBatch {
+	return &IptablesBatch{i: i, proto: proto, ops: make([]iptablesBatchOp, 0)}
+}
+
+func (b *IptablesBatch) EnsureChain(table, chain string) *IptablesBatch {
+	b.ops = append(b.ops, iptablesBatchOp{kind: iptablesBatchEnsureChain, table: table, chain: chain})
+	return b
+}
+
+func (b *IptablesBatch) EnsureRuleAppended(table, chain string, specs ...string) *IptablesBatch {
+	b.ops = append(b.ops, iptablesBatchOp{kind: iptablesBatchAppend, table: table, chain: chain, specs: b.i.ownedSpecs(specs)})
+	return b
+}
+
+func (b *IptablesBatch) EnsureRuleInserted(table, chain string, specs ...string) *IptablesBatch {
+	b.ops = append(b.ops, iptablesBatchOp{kind: iptablesBatchInsert, table: table, chain: chain, specs: b.i.ownedSpecs(specs)})
+	return b
+}
+
+func (b *IptablesBatch) DeleteRule(table, chain string, specs ...string) *IptablesBatch {
+	b.ops = append(b.ops, iptablesBatchOp{kind: iptablesBatchDelete, table: table, chain: chain, specs: b.i.ownedSpecs(specs)})
+	return b
+}
+
+func (b *IptablesBatch) tables() []string {
+	tables := make([]string, 0)
+	for _, op := range b.ops {
+		if !containsString(tables, op.table) {
+			tables = append(tables, op.table)
+		}
+	}
+	return tables
+}
+
+// Commit applies the queued changes, the batch is emptied on success
+func (b *IptablesBatch) Commit() error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	tables := b.tables()
+	defer b.i.lockTables(b.proto, tables...)()
+
+	var err error
+	if _, ok := b.i.getIpt(b.proto).(*NftablesBackend); ok {
+		err = b.commitOneByOne()
+	} else {
+		err = b.commitRestore(tables)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	b.ops = b.ops[:0]
+
+	return nil
+}
+
+func (b *IptablesBatch) commitOneByOne() error {
+	ipt := b.i.getIpt(b.proto)
+
+	for _, op := range b.ops {
+		var err error
+
+		switch op.kind {
+		case iptablesBatchEnsureChain:
+			var exist bool
+			if exist, err = ipt.ChainExists(op.table, op.chain); err == nil && !exist {
+				err = b.i.retry(func() error { return ipt.ClearChain(op.table, op.chain) })
+				if err == nil && b.i.owner != "" {
+					err = b.i.retry(func() error { return ipt.Append(op.table, op.chain, chainMarkerSpecs(b.i.owner)...) })
+				}
+			}
+		case iptablesBatchAppend, iptablesBatchInsert:
+			var exist bool
+			if exist, err = ipt.Exists(op.table, op.chain, op.specs...); err == nil && !exist {
+				if op.kind == iptablesBatchAppend {
+					err = b.i.retry(func() error { return ipt.Append(op.table, op.chain, op.specs...) })
+				} else {
+					err = b.i.retry(func() error { return ipt.Insert(op.table, op.chain, 1, op.specs...) })
+				}
+			}
+		case iptablesBatchDelete:
+			err = b.i.retry(func() error { return ipt.DeleteIfExists(op.table, op.chain, op.specs...) })
+		}
+
+		if err != nil {
+			logger.Errorf("batch %s table %s chain specs:%+v failed! reason:%s", op.table, op.chain, op.specs, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitRestore checks which changes are needed, then writes them all with iptables-restore
+func (b *IptablesBatch) commitRestore(tables []string) error {
+	ipt := b.i.getIpt(b.proto)
+
+	newChains := make(map[string][]string)
+	lines := make(map[string][]string)
+	added := make(map[string]bool)
+
+	for _, op := range b.ops {
+		key := op.table + " " + op.chain + " " + joinIptablesArgs(op.specs)
+		chainIsNew := containsString(newChains[op.table], op.chain)
+
+		switch op.kind {
+		case iptablesBatchEnsureChain:
+			if chainIsNew {
+				continue
+			}
+			exist, err := ipt.ChainExists(op.table, op.chain)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				newChains[op.table] = append(newChains[op.table], op.chain)
+			}
+			continue
+		case iptablesBatchAppend, iptablesBatchInsert:
+			if added[key] {
+				continue
+			}
+
+			if !chainIsNew {
+				exist, err := ipt.Exists(op.table, op.chain, op.specs...)
+				if err != nil {
+					return err
+				} else if exist {
+					continue
+				}
+			}
+
+			added[key] = true
+			if op.kind == iptablesBatchAppend {
+				lines[op.table] = append(lines[op.table], "-A "+op.chain+" "+joinIptablesArgs(op.specs))
+			} else {
+				lines[op.table] = append(lines[op.table], "-I "+op.chain+" 1 "+joinIptablesArgs(op.specs))
+			}
+		case iptablesBatchDelete:
+			exist := added[key]
+			if !exist && !chainIsNew {
+				var err error
+				if exist, err = ipt.Exists(op.table, op.chain, op.specs...); err != nil {
+					return err
+				}
+			}
+
+			if exist {
+				delete(added, key)
+				lines[op.table] = append(lines[op.table], "-D "+op.chain+" "+joinIptablesArgs(op.specs))
+			}
+		}
+	}
+
+	var script bytes.Buffer
+	for _, table := range tables {
+		if len(newChains[table]) == 0 && len(lines[table]) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&script, "*%s\n", table)
+		for _, chain := range newChains[table] {
+			fmt.Fprintf(&script, ":%s - [0:0]\n", chain)
+		}
+		if b.i.owner != "" {
+			for _, chain := range newChains[table] {
+				script.WriteString("-A " + chain + " " + joinIptablesArgs(chainMarkerSpecs(b.i.owner)) + "\n")
+			}
+		}
+		for _, line := range lines[table] {
+			script.WriteString(line + "\n")
+		}
+		script.WriteString("COMMIT\n")
+	}
+
+	if script.Len() == 0 {
+		return nil
+	}
+
+	return b.i.retry(func() error { return b.i.runRestore(b.proto, script.Bytes(), true) })
+}
+
+// runRestore feeds data to iptables-restore, waiting for the xtables lock as configured
+func (i *IptablesCtx) runRestore(proto IpProto, data []byte, noflush bool) error {
+	args := make([]string, 0)
+	if noflush {
+		args = append(args, "--noflush")
+	}
+
+	if wait := lockWaitSeconds(i.opts.LockWait); wait > 0 {
+		args = append(args, "--wait", strconv.Itoa(wait))
+	} else {
+		args = append(args, "--wait")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(iptablesSaveCommand(proto, true), args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		logger.Errorf("%s failed! reason:%s %s", iptablesSaveCommand(proto, true), err, strings.TrimSpace(stderr.String()))
+		return fmt.Errorf("%s failed: %s %s", iptablesSaveCommand(proto, true), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
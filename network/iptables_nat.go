@@ -0,0 +1,280 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	IptablesDnatChain = "GOKIT-DNAT"
+	IptablesSnatChain = "GOKIT-SNAT"
+)
+
+type PortForward struct {
+	// "tcp" or "udp"
+	Protocol string
+	// only forward packets received on InNic, empty means any
+	InNic string
+	// only forward packets sent to DstIp, empty means any local address
+	DstIp   string
+	DstPort int
+	ToIp    string
+	// 0 means the same as DstPort
+	ToPort int
+	// masquerade the forwarded connections coming from HairpinSrc, the side of ToIp, so that
+	// replies come back through us instead of going straight to the client
+	Hairpin bool
+	// internal prefix hairpinned, default the subnet of the local address reaching ToIp. Set
+	// it if the addresses may change before RemovePortForward.
+	HairpinSrc string
+}
+
+func ipProtoOf(addr string) IpProto {
+	if strings.Contains(addr, ":") {
+		return IpProtoV6
+	}
+	return IpProtoV4
+}
+
+func (p PortForward) toAddr() string {
+	toPort := p.ToPort
+	if toPort == 0 {
+		toPort = p.DstPort
+	}
+
+	return net.JoinHostPort(p.ToIp, strconv.Itoa(toPort))
+}
+
+func (p PortForward) dnatSpecs() []string {
+	specs := make([]string, 0)
+
+	if p.InNic != "" {
+		specs = append(specs, "-i", p.InNic)
+	}
+
+	if p.DstIp != "" {
+		specs = append(specs, "-d", p.DstIp)
+	} else {
+		specs = append(specs, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+
+	return append(specs, "-p", p.Protocol, "--dport", strconv.Itoa(p.DstPort), "-j", "DNAT", "--to-destination", p.toAddr())
+}
+
+// hairpinSource returns HairpinSrc, or the subnet of the local address on the nic ToIp is
+// reached through. External clients are not masqueraded, backends keep seeing their address.
+func (p PortForward) hairpinSource() (string, error) {
+	if p.HairpinSrc != "" {
+		return p.HairpinSrc, nil
+	}
+
+	toIp := net.ParseIP(p.ToIp)
+	routes, err := netlink.RouteGet(toIp)
+	if err != nil || len(routes) == 0 {
+		return "", fmt.Errorf("no route to hairpin address %s: %v", p.ToIp, err)
+	}
+
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return "", err
+	}
+
+	family := netlink.FAMILY_V4
+	if toIp.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlink.AddrList(link, family)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if addr.IPNet.Contains(toIp) {
+			subnet := net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+			return subnet.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("hairpin address %s is not on a local subnet, set HairpinSrc", p.ToIp)
+}
+
+func (p PortForward) hairpinSpecs(src string) []string {
+	toPort := p.ToPort
+	if toPort == 0 {
+		toPort = p.DstPort
+	}
+
+	return []string{"-s", src, "-d", p.ToIp, "-p", p.Protocol, "--dport", strconv.Itoa(toPort),
+		"-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"}
+}
+
+// ensureNatChains creates the gokit nat chains and the jumps to them
+func (i *IptablesCtx) ensureNatChains(proto IpProto) error {
+	for _, chain := range []string{IptablesDnatChain, IptablesSnatChain} {
+		if err := i.EnsureChain(proto, "nat", chain); err != nil {
+			return err
+		}
+	}
+
+	if err := i.EnsureRuleInserted(proto, "nat", "PREROUTING", "-j", IptablesDnatChain); err != nil {
+		return err
+	}
+
+	// locally generated connections to local addresses are forwarded too
+	if err := i.EnsureRuleInserted(proto, "nat", "OUTPUT", "-m", "addrtype", "--dst-type", "LOCAL", "-j", IptablesDnatChain); err != nil {
+		return err
+	}
+
+	return i.EnsureRuleInserted(proto, "nat", "POSTROUTING", "-j", IptablesSnatChain)
+}
+
+// enableForwarding turns on the sysctls needed to forward to toIp
+func enableForwarding(proto IpProto, toIp string) error {
+	if ip := net.ParseIP(toIp); ip != nil && ip.IsLoopback() {
+		if proto == IpProtoV6 {
+			return fmt.Errorf("ipv6 does not support forwarding to loopback address %s", toIp)
+		}
+		return SetSysctl("net.ipv4.conf.all.route_localnet", "1")
+	}
+
+	if proto == IpProtoV6 {
+		return SetSysctl("net.ipv6.conf.all.forwarding", "1")
+	}
+	return SetSysctl("net.ipv4.ip_forward", "1")
+}
+
+func (p PortForward) validate() error {
+	if p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("port forward protocol must be tcp or udp, got %q", p.Protocol)
+	}
+
+	if p.DstPort <= 0 || p.DstPort > 65535 || p.ToPort < 0 || p.ToPort > 65535 {
+		return fmt.Errorf("invalid port forward ports %d -> %d", p.DstPort, p.ToPort)
+	}
+
+	if net.ParseIP(p.ToIp) == nil {
+		return fmt.Errorf("invalid port forward address %q", p.ToIp)
+	}
+
+	return nil
+}
+
+// AddPortForward DNATs DstIp:DstPort to ToIp:ToPort, e.g. into a namespace behind a veth or bridge
+func (i *IptablesCtx) AddPortForward(p PortForward) error {
+	if err := p.validate(); err != nil {
+		logger.Errorf("AddPortForward() failed! reason:%s", err)
+		return err
+	}
+
+	var hairpinSrc string
+	if p.Hairpin {
+		var err error
+		if hairpinSrc, err = p.hairpinSource(); err != nil {
+			logger.Errorf("AddPortForward() failed! reason:%s", err)
+			return err
+		}
+	}
+
+	proto := ipProtoOf(p.ToIp)
+	if err := enableForwarding(proto, p.ToIp); err != nil {
+		return err
+	}
+
+	if err := i.ensureNatChains(proto); err != nil {
+		return err
+	}
+
+	if err := i.EnsureRuleAppended(proto, "nat", IptablesDnatChain, p.dnatSpecs()...); err != nil {
+		return err
+	}
+
+	if p.Hairpin {
+		return i.EnsureRuleAppended(proto, "nat", IptablesSnatChain, p.hairpinSpecs(hairpinSrc)...)
+	}
+
+	return nil
+}
+
+func (i *IptablesCtx) RemovePortForward(p PortForward) error {
+	if err := p.validate(); err != nil {
+		logger.Errorf("RemovePortForward() failed! reason:%s", err)
+		return err
+	}
+
+	proto := ipProtoOf(p.ToIp)
+	if err := i.DeleteRule(proto, "nat", IptablesDnatChain, p.dnatSpecs()...); err != nil {
+		return err
+	}
+
+	if p.Hairpin {
+		hairpinSrc, err := p.hairpinSource()
+		if err != nil {
+			logger.Errorf("RemovePortForward() failed! reason:%s", err)
+			return err
+		}
+		return i.DeleteRule(proto, "nat", IptablesSnatChain, p.hairpinSpecs(hairpinSrc)...)
+	}
+
+	return nil
+}
+
+func masqueradeSpecs(srcPrefix string, outNic string) []string {
+	specs := []string{"-s", srcPrefix}
+	if outNic != "" {
+		specs = append(specs, "-o", outNic)
+	}
+
+	return append(specs, "-j", "MASQUERADE")
+}
+
+// AddMasquerade masquerades traffic from srcPrefix leaving through outNic, any nic if empty
+func (i *IptablesCtx) AddMasquerade(srcPrefix string, outNic string) error {
+	proto := ipProtoOf(srcPrefix)
+
+	if err := enableForwarding(proto, ""); err != nil {
+		return err
+	}
+
+	if err := i.ensureNatChains(proto); err != nil {
+		return err
+	}
+
+	return i.EnsureRuleAppended(proto, "nat", IptablesSnatChain, masqueradeSpecs(srcPrefix, outNic)...)
+}
+
+func (i *IptablesCtx) RemoveMasquerade(srcPrefix string, outNic string) error {
+	return i.DeleteRule(ipProtoOf(srcPrefix), "nat", IptablesSnatChain, masqueradeSpecs(srcPrefix, outNic)...)
+}
+
+func snatSpecs(srcPrefix string, outNic string, toSource string) []string {
+	specs := []string{"-s", srcPrefix}
+	if outNic != "" {
+		specs = append(specs, "-o", outNic)
+	}
+
+	return append(specs, "-j", "SNAT", "--to-source", toSource)
+}
+
+// AddSnat rewrites the source of traffic from srcPrefix leaving through outNic to toSource
+func (i *IptablesCtx) AddSnat(srcPrefix string, outNic string, toSource string) error {
+	proto := ipProtoOf(srcPrefix)
+
+	if err := enableForwarding(proto, ""); err != nil {
+		return err
+	}
+
+	if err := i.ensureNatChains(proto); err != nil {
+		return err
+	}
+
+	return i.EnsureRuleAppended(proto, "nat", IptablesSnatChain, snatSpecs(srcPrefix, outNic, toSource)...)
+}
+
+func (i *IptablesCtx) RemoveSnat(srcPrefix string, outNic string, toSource string) error {
+	return i.DeleteRule(ipProtoOf(srcPrefix), "nat", IptablesSnatChain, snatSpecs(srcPrefix, outNic, toSource)...)
+}
@@ -0,0 +1,109 @@
+package network
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/running910/gokit/misc"
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func TestNatSpecs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  []string
+		want string
+	}{
+		{
+			"dnat to any local address",
+			PortForward{Protocol: "tcp", DstPort: 8080, ToIp: "10.0.0.2"}.dnatSpecs(),
+			"-m addrtype --dst-type LOCAL -p tcp --dport 8080 -j DNAT --to-destination 10.0.0.2:8080",
+		},
+		{
+			"dnat of a nic and address",
+			PortForward{Protocol: "udp", InNic: "eth0", DstIp: "192.0.2.1", DstPort: 53, ToIp: "fd00::2", ToPort: 5353}.dnatSpecs(),
+			"-i eth0 -d 192.0.2.1 -p udp --dport 53 -j DNAT --to-destination [fd00::2]:5353",
+		},
+		{
+			"hairpin",
+			PortForward{Protocol: "tcp", DstPort: 80, ToIp: "10.0.0.2", ToPort: 8080}.hairpinSpecs("10.0.0.0/24"),
+			"-s 10.0.0.0/24 -d 10.0.0.2 -p tcp --dport 8080 -m conntrack --ctstate DNAT -j MASQUERADE",
+		},
+		{"masquerade", masqueradeSpecs("10.0.0.0/24", ""), "-s 10.0.0.0/24 -j MASQUERADE"},
+		{"masquerade out of a nic", masqueradeSpecs("10.0.0.0/24", "eth0"), "-s 10.0.0.0/24 -o eth0 -j MASQUERADE"},
+		{"snat", snatSpecs("10.0.0.0/24", "eth0", "192.0.2.1"), "-s 10.0.0.0/24 -o eth0 -j SNAT --to-source 192.0.2.1"},
+	} {
+		if got := strings.Join(tc.got, " "); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	for _, p := range []PortForward{
+		{Protocol: "icmp", DstPort: 80, ToIp: "10.0.0.2"},
+		{Protocol: "tcp", DstPort: 0, ToIp: "10.0.0.2"},
+		{Protocol: "tcp", DstPort: 80, ToIp: "10.0.0.2", ToPort: 70000},
+		{Protocol: "tcp", DstPort: 80, ToIp: "backend"},
+	} {
+		if p.validate() == nil {
+			t.Errorf("expect %+v to be invalid", p)
+		}
+	}
+}
+
+func TestHairpinSource(t *testing.T) {
+	// the default is the subnet of the local address reaching ToIp, never any source
+	src, err := PortForward{ToIp: "127.0.0.5"}.hairpinSource()
+	if err != nil || src != "127.0.0.0/8" {
+		t.Fatalf("hairpin source %q %v", src, err)
+	}
+
+	if src, _ := (PortForward{ToIp: "127.0.0.5", HairpinSrc: "127.0.0.0/24"}).hairpinSource(); src != "127.0.0.0/24" {
+		t.Fatalf("explicit hairpin source %q", src)
+	}
+}
+
+func TestAddPortForward(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.SetSysctl("net.ipv4.ip_forward", "0")
+	defer func(old string) { misc.ProcfsRoot = old }(misc.ProcfsRoot)
+	misc.ProcfsRoot = tree.Proc
+
+	f := newFakeIptables()
+	i := newFakeIptablesCtx("", f)
+
+	p := PortForward{Protocol: "tcp", DstPort: 80, ToIp: "10.0.0.2", ToPort: 8080, Hairpin: true, HairpinSrc: "10.0.0.0/24"}
+	for k := 0; k < 2; k++ {
+		if err := i.AddPortForward(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := i.AddMasquerade("10.0.0.0/24", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := tree.ReadProc("sys/net/ipv4/ip_forward"); value != "1" {
+		t.Fatalf("ip_forward is %s", value)
+	}
+	if rules, _ := f.List("nat", IptablesDnatChain); !reflect.DeepEqual(rules, []string{"-N " + IptablesDnatChain, "-A " + IptablesDnatChain + " " + strings.Join(p.dnatSpecs(), " ")}) {
+		t.Fatalf("dnat rules %q", rules)
+	}
+	if rules, _ := f.List("nat", IptablesSnatChain); len(rules) != 3 {
+		t.Fatalf("snat rules %q", rules)
+	}
+	if rules, _ := f.List("nat", "PREROUTING"); len(rules) != 2 {
+		t.Fatalf("prerouting rules %q", rules)
+	}
+
+	if err := i.RemovePortForward(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.RemoveMasquerade("10.0.0.0/24", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range []string{IptablesDnatChain, IptablesSnatChain} {
+		if rules, _ := f.List("nat", chain); len(rules) != 1 {
+			t.Fatalf("%s rules left %q", chain, rules)
+		}
+	}
+}
@@ -0,0 +1,1466 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/running910/gokit/logger"
+	"golang.org/x/sys/unix"
+)
+
+// nftRuleCommentPrefix marks the rules created by gokit, the iptables style specs of the rule
+// follow the prefix in the rule comment so that nft list ruleset shows where it comes from.
+const nftRuleCommentPrefix = "gokit: "
+
+// nftRuleCommentMaxLen is the max length of a rule comment, including the trailing NUL
+const nftRuleCommentMaxLen = 255
+
+// nftSetIDBase keeps anonymous set ids away from the ones allocated by the nftables package
+const nftSetIDBase = 0x10000000
+
+var nftSetID uint32 = nftSetIDBase
+
+type nftBaseChain struct {
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+	kind     nftables.ChainType
+}
+
+// nftBaseChains maps the iptables builtin chains onto nftables base chains,
+// as iptables-nft does.
+var nftBaseChains = map[string]map[string]nftBaseChain{
+	"filter": {
+		"INPUT":   {nftables.ChainHookInput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"FORWARD": {nftables.ChainHookForward, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"OUTPUT":  {nftables.ChainHookOutput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+	},
+	"nat": {
+		"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"INPUT":       {nftables.ChainHookInput, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT},
+		"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT},
+	},
+	"mangle": {
+		"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"INPUT":       {nftables.ChainHookInput, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"FORWARD":     {nftables.ChainHookForward, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+		"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityMangle, nftables.ChainTypeRoute},
+		"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityMangle, nftables.ChainTypeFilter},
+	},
+	"raw": {
+		"PREROUTING": {nftables.ChainHookPrerouting, nftables.ChainPriorityRaw, nftables.ChainTypeFilter},
+		"OUTPUT":     {nftables.ChainHookOutput, nftables.ChainPriorityRaw, nftables.ChainTypeFilter},
+	},
+	"security": {
+		"INPUT":   {nftables.ChainHookInput, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+		"FORWARD": {nftables.ChainHookForward, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+		"OUTPUT":  {nftables.ChainHookOutput, nftables.ChainPrioritySecurity, nftables.ChainTypeFilter},
+	},
+}
+
+var nftL4Protos = map[string]byte{
+	"icmp":      unix.IPPROTO_ICMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"gre":       unix.IPPROTO_GRE,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"icmpv6":    unix.IPPROTO_ICMPV6,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+}
+
+var nftAddrTypes = map[string]uint32{
+	"UNICAST":   unix.RTN_UNICAST,
+	"LOCAL":     unix.RTN_LOCAL,
+	"BROADCAST": unix.RTN_BROADCAST,
+	"ANYCAST":   unix.RTN_ANYCAST,
+	"MULTICAST": unix.RTN_MULTICAST,
+}
+
+// IPS_SRC_NAT and IPS_DST_NAT of the conntrack status
+var nftCtStatus = map[string]uint32{
+	"SNAT": 0x10,
+	"DNAT": 0x20,
+}
+
+var nftCtStates = map[string]uint32{
+	"INVALID":     expr.CtStateBitINVALID,
+	"ESTABLISHED": expr.CtStateBitESTABLISHED,
+	"RELATED":     expr.CtStateBitRELATED,
+	"NEW":         expr.CtStateBitNEW,
+	"UNTRACKED":   expr.CtStateBitUNTRACKED,
+}
+
+// NftablesBackend talks to nftables over netlink and accepts the same iptables style rule
+// specs as the iptables binary. Tables and chains keep their iptables names, builtin chains
+// are created as base chains on first use. Only the commonly used matches and targets are
+// supported, an error is returned for anything else.
+//
+// It shares the tables with iptables-nft: Exists and DeleteIfExists also find the rules of
+// other tools made of the same expressions, and List translates them back when it can.
+// iptables-nft may not list the native expressions it writes for the matches it implements
+// with xtables extensions.
+type NftablesBackend struct {
+	// a Flush sends every message queued on conn, whatever the table, so operations are
+	// serialized for the batch of one not to carry the messages of another
+	mu     sync.Mutex
+	conn   *nftables.Conn
+	family nftables.TableFamily
+}
+
+func NewNftablesBackend(proto IpProto) (*NftablesBackend, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		logger.Errorf("nftables.New() failed! reason:%s", err)
+		return nil, err
+	}
+
+	family := nftables.TableFamilyIPv4
+	if proto == IpProtoV6 {
+		family = nftables.TableFamilyIPv6
+	}
+
+	// make sure nftables is usable before handing the backend out
+	if _, err := conn.ListTablesOfFamily(family); err != nil {
+		logger.Errorf("nftables ListTablesOfFamily() failed! reason:%s", err)
+		return nil, err
+	}
+
+	return &NftablesBackend{conn: conn, family: family}, nil
+}
+
+func (n *NftablesBackend) table(table string) *nftables.Table {
+	return &nftables.Table{Name: table, Family: n.family}
+}
+
+func (n *NftablesBackend) chain(table, chain string) *nftables.Chain {
+	c := &nftables.Chain{Name: chain, Table: n.table(table)}
+
+	if base, ok := nftBaseChains[table][chain]; ok {
+		c.Hooknum = base.hook
+		c.Priority = base.priority
+		c.Type = base.kind
+	}
+
+	return c
+}
+
+// ensureChain creates the table and, for builtin chains, the base chain, user chains must
+// be created explicitly as iptables requires.
+func (n *NftablesBackend) ensureChain(table, chain string) {
+	n.conn.AddTable(n.table(table))
+
+	if _, ok := nftBaseChains[table][chain]; ok {
+		n.conn.AddChain(n.chain(table, chain))
+	}
+}
+
+func (n *NftablesBackend) getChains(table string) ([]*nftables.Chain, error) {
+	chains, err := n.conn.ListChainsOfTableFamily(n.family)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*nftables.Chain, 0)
+	for _, c := range chains {
+		if c.Table.Name == table {
+			result = append(result, c)
+		}
+	}
+
+	return result, nil
+}
+
+func (n *NftablesBackend) ListChains(table string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.listChains(table)
+}
+
+func (n *NftablesBackend) ChainExists(table, chain string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.chainExists(table, chain)
+}
+
+func (n *NftablesBackend) listChains(table string) ([]string, error) {
+	chains, err := n.getChains(table)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(chains))
+	for _, c := range chains {
+		names = append(names, c.Name)
+	}
+
+	return names, nil
+}
+
+func (n *NftablesBackend) chainExists(table, chain string) (bool, error) {
+	chains, err := n.listChains(table)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range chains {
+		if c == chain {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (n *NftablesBackend) ClearChain(table, chain string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conn.AddTable(n.table(table))
+	n.conn.AddChain(n.chain(table, chain))
+	n.conn.FlushChain(n.chain(table, chain))
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) DeleteChain(table, chain string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conn.DelChain(n.chain(table, chain))
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) ClearAndDeleteChain(table, chain string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	exist, err := n.chainExists(table, chain)
+	if err != nil || !exist {
+		return err
+	}
+
+	n.conn.FlushChain(n.chain(table, chain))
+	n.conn.DelChain(n.chain(table, chain))
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) getRules(table, chain string) ([]*nftables.Rule, error) {
+	exist, err := n.chainExists(table, chain)
+	if err != nil {
+		return nil, err
+	} else if !exist {
+		return nil, nil
+	}
+
+	return n.conn.GetRules(n.table(table), n.chain(table, chain))
+}
+
+// findRule returns the rule whose comment carries specs, or the rule of another tool, as
+// iptables-nft, with the same expressions and comment. nil if there is none.
+func (n *NftablesBackend) findRule(table, chain string, specs []string) (*nftables.Rule, error) {
+	rules, err := n.getRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	comment := nftRuleCommentPrefix + joinIptablesArgs(specs)
+	for _, r := range rules {
+		if nftRuleComment(r.UserData) == comment {
+			return r, nil
+		}
+	}
+
+	exprs, sets, err := nftRuleExprs(n.family, specs, n.setKeyType(table))
+	if err != nil || len(sets) > 0 {
+		return nil, nil
+	}
+	for _, r := range rules {
+		other := nftRuleComment(r.UserData)
+		if !strings.HasPrefix(other, nftRuleCommentPrefix) && other == specsComment(specs) && nftExprsEqual(r.Exprs, exprs) {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (n *NftablesBackend) setKeyType(table string) nftSetKeyTypeFunc {
+	return func(name string) (nftables.SetDatatype, error) {
+		set, err := n.getSet(table, name)
+		if err != nil {
+			return nftables.TypeInvalid, err
+		}
+		return set.KeyType, nil
+	}
+}
+
+func (n *NftablesBackend) Exists(table, chain string, rulespec ...string) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r, err := n.findRule(table, chain, rulespec)
+	if err != nil {
+		return false, err
+	}
+
+	return r != nil, nil
+}
+
+// newRule translates rulespec and queues the anonymous sets it needs
+func (n *NftablesBackend) newRule(table, chain string, rulespec []string) (*nftables.Rule, error) {
+	comment := nftRuleCommentPrefix + joinIptablesArgs(rulespec)
+	if len(comment)+1 > nftRuleCommentMaxLen {
+		return nil, fmt.Errorf("rule spec too long for nftables backend: %s", comment)
+	}
+
+	exprs, sets, err := nftRuleExprs(n.family, rulespec, n.setKeyType(table))
+	if err != nil {
+		return nil, err
+	}
+
+	n.ensureChain(table, chain)
+
+	for _, s := range sets {
+		s.set.Table = n.table(table)
+		if err := n.conn.AddSet(s.set, s.elements); err != nil {
+			return nil, err
+		}
+	}
+
+	return &nftables.Rule{
+		Table:    n.table(table),
+		Chain:    n.chain(table, chain),
+		Exprs:    exprs,
+		UserData: nftMarshalRuleComment(comment),
+	}, nil
+}
+
+func (n *NftablesBackend) Append(table, chain string, rulespec ...string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r, err := n.newRule(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+
+	n.conn.AddRule(r)
+
+	return n.conn.Flush()
+}
+
+// Insert inserts the rule at position pos, starting from 1 as iptables does
+func (n *NftablesBackend) Insert(table, chain string, pos int, rulespec ...string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rules, err := n.getRules(table, chain)
+	if err != nil {
+		return err
+	}
+
+	r, err := n.newRule(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case pos <= 1 || len(rules) == 0:
+		n.conn.InsertRule(r)
+	case pos > len(rules):
+		n.conn.AddRule(r)
+	default:
+		r.Position = rules[pos-1].Handle
+		n.conn.InsertRule(r)
+	}
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) DeleteIfExists(table, chain string, rulespec ...string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r, err := n.findRule(table, chain, rulespec)
+	if err != nil || r == nil {
+		return err
+	}
+
+	if err := n.conn.DelRule(r); err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+// List returns the rules of chain in iptables -S format. The rules of other tools are
+// translated back when they only use what the backend supports, the others are listed with
+// their nftables handle as comment.
+func (n *NftablesBackend) List(table, chain string) ([]string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rules, err := n.getRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{"-N " + chain}
+	if _, ok := nftBaseChains[table][chain]; ok {
+		lines = []string{"-P " + chain + " ACCEPT"}
+	}
+
+	for _, r := range rules {
+		lines = append(lines, "-A "+chain+" "+joinIptablesArgs(n.ruleSpecs(r)))
+	}
+
+	return lines, nil
+}
+
+// ruleSpecs returns the iptables style specs of r as List shows them
+func (n *NftablesBackend) ruleSpecs(r *nftables.Rule) []string {
+	comment := nftRuleComment(r.UserData)
+	if strings.HasPrefix(comment, nftRuleCommentPrefix) {
+		return splitIptablesArgs(strings.TrimPrefix(comment, nftRuleCommentPrefix))
+	} else if specs, ok := nftRuleSpecs(n.family, r.Exprs, comment); ok {
+		return specs
+	}
+
+	return []string{"-m", "comment", "--comment", fmt.Sprintf("nft-handle:%d", r.Handle)}
+}
+
+// RuleCounters returns the counters of the rules in every chain of table, rules are named as
+// List does.
+func (n *NftablesBackend) RuleCounters(table string) ([]IptablesRuleCounter, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	chains, err := n.listChains(table)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := IpProtoV4
+	if n.family == nftables.TableFamilyIPv6 {
+		proto = IpProtoV6
+	}
+
+	counters := make([]IptablesRuleCounter, 0)
+	for _, chain := range chains {
+		rules, err := n.getRules(table, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range rules {
+			counter := IptablesRuleCounter{IptablesRule: IptablesRule{Proto: proto, Table: table, Chain: chain}}
+
+			counter.Specs = n.ruleSpecs(r)
+
+			for _, e := range r.Exprs {
+				if c, ok := e.(*expr.Counter); ok {
+					counter.Packets += c.Packets
+					counter.Bytes += c.Bytes
+				}
+			}
+			counters = append(counters, counter)
+		}
+	}
+
+	return counters, nil
+}
+
+// EnsureSet creates a named set in table, rules reference it with -m set --match-set.
+// keyType is one of the nftables.Type* datatypes, timeout 0 means elements never expire.
+func (n *NftablesBackend) EnsureSet(table, name string, keyType nftables.SetDatatype, interval bool, timeout time.Duration) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conn.AddTable(n.table(table))
+
+	set := &nftables.Set{
+		Table:      n.table(table),
+		Name:       name,
+		KeyType:    keyType,
+		Interval:   interval,
+		HasTimeout: timeout > 0,
+		Timeout:    timeout,
+	}
+
+	if err := n.conn.AddSet(set, nil); err != nil {
+		logger.Errorf("nftables AddSet() %s failed! reason:%s", name, err)
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+// EnsureMap creates a named map in table, a verdict map is created if dataType is nftables.TypeVerdict
+func (n *NftablesBackend) EnsureMap(table, name string, keyType nftables.SetDatatype, dataType nftables.SetDatatype) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conn.AddTable(n.table(table))
+
+	set := &nftables.Set{
+		Table:    n.table(table),
+		Name:     name,
+		IsMap:    true,
+		KeyType:  keyType,
+		DataType: dataType,
+	}
+
+	if err := n.conn.AddSet(set, nil); err != nil {
+		logger.Errorf("nftables AddSet() map %s failed! reason:%s", name, err)
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) getSet(table, name string) (*nftables.Set, error) {
+	set, err := n.conn.GetSetByName(n.table(table), name)
+	if err != nil {
+		logger.Errorf("nftables GetSetByName() %s failed! reason:%s", name, err)
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func (n *NftablesBackend) AddSetElements(table, name string, elements []nftables.SetElement) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return err
+	}
+
+	if err := n.conn.SetAddElements(set, elements); err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) DelSetElements(table, name string, elements []nftables.SetElement) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return err
+	}
+
+	if err := n.conn.SetDeleteElements(set, elements); err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+// ReplaceSetElements flushes the set and adds elements in one nftables transaction
+func (n *NftablesBackend) ReplaceSetElements(table, name string, elements []nftables.SetElement) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return err
+	}
+
+	n.conn.FlushSet(set)
+	if err := n.conn.SetAddElements(set, elements); err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) GetSetElements(table, name string) ([]nftables.SetElement, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.conn.GetSetElements(set)
+}
+
+func (n *NftablesBackend) FlushSet(table, name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return err
+	}
+
+	n.conn.FlushSet(set)
+
+	return n.conn.Flush()
+}
+
+func (n *NftablesBackend) DeleteSet(table, name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(table, name)
+	if err != nil {
+		return err
+	}
+
+	n.conn.DelSet(set)
+
+	return n.conn.Flush()
+}
+
+// nftMarshalRuleComment encodes comment as NFTNL_UDATA_RULE_COMMENT, the same way nft does
+func nftMarshalRuleComment(comment string) []byte {
+	value := append([]byte(comment), 0)
+	return append([]byte{0, byte(len(value))}, value...)
+}
+
+// nftRuleComment decodes the NFTNL_UDATA_RULE_COMMENT from rule user data
+func nftRuleComment(udata []byte) string {
+	for len(udata) >= 2 {
+		kind, size := udata[0], int(udata[1])
+		if len(udata) < 2+size {
+			break
+		}
+
+		if kind == 0 {
+			return strings.TrimRight(string(udata[2:2+size]), "\x00")
+		}
+		udata = udata[2+size:]
+	}
+
+	return ""
+}
+
+type nftAnonSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+}
+
+type nftRuleBuilder struct {
+	family     nftables.TableFamily
+	setKeyType nftSetKeyTypeFunc
+	exprs      []expr.Any
+	sets       []nftAnonSet
+	l4proto    string
+	neg        bool
+}
+
+// nftTargetOptions are the options of the supported targets, true for those taking a value
+var nftTargetOptions = map[string]map[string]bool{
+	"REJECT":     {"--reject-with": true},
+	"MASQUERADE": {"--to-ports": true, "--random": false, "--random-fully": false},
+	"DNAT":       {"--to-destination": true},
+	"SNAT":       {"--to-source": true},
+	"REDIRECT":   {"--to-ports": true},
+	"LOG":        {"--log-prefix": true},
+}
+
+// nftSetKeyTypeFunc returns the key type of the named set of the rule table
+type nftSetKeyTypeFunc func(name string) (nftables.SetDatatype, error)
+
+// nftRuleExprs translates iptables style rule specs into nftables expressions. Matches may
+// follow the target as iptables allows, anything not understood is an error.
+func nftRuleExprs(family nftables.TableFamily, specs []string, setKeyType nftSetKeyTypeFunc) ([]expr.Any, []nftAnonSet, error) {
+	b := &nftRuleBuilder{family: family, setKeyType: setKeyType}
+
+	target, isGoto := "", false
+	targetOpts := make([]string, 0)
+
+	next := func(k *int) (string, error) {
+		if *k+1 >= len(specs) {
+			return "", fmt.Errorf("option %s requires a value", specs[*k])
+		}
+		*k++
+		return specs[*k], nil
+	}
+
+	for k := 0; k < len(specs); k++ {
+		var err error
+		var value string
+
+		switch opt := specs[k]; opt {
+		case "!":
+			b.neg = true
+			continue
+		case "-p", "--protocol":
+			if value, err = next(&k); err == nil {
+				err = b.protocol(value)
+			}
+		case "-s", "--source", "-d", "--destination":
+			if value, err = next(&k); err == nil {
+				err = b.address(opt == "-s" || opt == "--source", value)
+			}
+		case "-i", "--in-interface", "-o", "--out-interface":
+			if value, err = next(&k); err == nil {
+				b.iface(opt == "-i" || opt == "--in-interface", value)
+			}
+		case "-m", "--match":
+			if value, err = next(&k); err == nil {
+				switch value {
+				case "tcp", "udp", "sctp", "icmp", "icmp6", "comment", "multiport", "conntrack", "state", "set", "addrtype":
+				default:
+					err = fmt.Errorf("unsupported match module %s", value)
+				}
+			}
+		case "--comment":
+			_, err = next(&k)
+		case "--dport", "--destination-port", "--sport", "--source-port":
+			if value, err = next(&k); err == nil {
+				err = b.port(opt == "--sport" || opt == "--source-port", value)
+			}
+		case "--dports", "--destination-ports", "--sports", "--source-ports":
+			if value, err = next(&k); err == nil {
+				err = b.ports(opt == "--sports" || opt == "--source-ports", value)
+			}
+		case "--ctstate", "--state":
+			if value, err = next(&k); err == nil {
+				err = b.ctstate(value)
+			}
+		case "--src-type", "--dst-type":
+			if value, err = next(&k); err == nil {
+				err = b.addrtype(opt == "--src-type", value)
+			}
+		case "--match-set":
+			var dirs string
+			if value, err = next(&k); err == nil {
+				if dirs, err = next(&k); err == nil {
+					err = b.matchSet(value, dirs)
+				}
+			}
+		case "-j", "--jump", "-g", "--goto":
+			if target != "" {
+				err = fmt.Errorf("more than one target")
+			} else if value, err = next(&k); err == nil {
+				target, isGoto = value, opt == "-g" || opt == "--goto"
+			}
+		default:
+			takesValue, ok := nftTargetOptions[target][opt]
+			switch {
+			case !ok:
+				err = fmt.Errorf("unsupported option %s", opt)
+			case takesValue:
+				if value, err = next(&k); err == nil {
+					targetOpts = append(targetOpts, opt, value)
+				}
+			default:
+				targetOpts = append(targetOpts, opt)
+			}
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("nftables backend: %s, rule: %s", err, strings.Join(specs, " "))
+		}
+		b.neg = false
+	}
+
+	if target != "" {
+		b.exprs = append(b.exprs, &expr.Counter{})
+		if err := b.target(target, isGoto, targetOpts); err != nil {
+			return nil, nil, fmt.Errorf("nftables backend: %s, rule: %s", err, strings.Join(specs, " "))
+		}
+	}
+
+	return b.exprs, b.sets, nil
+}
+
+func (b *nftRuleBuilder) cmpOp() expr.CmpOp {
+	if b.neg {
+		return expr.CmpOpNeq
+	}
+	return expr.CmpOpEq
+}
+
+func (b *nftRuleBuilder) protocol(name string) error {
+	name = strings.ToLower(name)
+	if name == "all" {
+		return nil
+	}
+
+	proto, ok := nftL4Protos[name]
+	if !ok {
+		num, err := strconv.ParseUint(name, 10, 8)
+		if err != nil {
+			return fmt.Errorf("unknown protocol %s", name)
+		}
+		proto = byte(num)
+	}
+
+	b.l4proto = name
+	b.exprs = append(b.exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: b.cmpOp(), Register: 1, Data: []byte{proto}},
+	)
+
+	return nil
+}
+
+func (b *nftRuleBuilder) addrOffset(src bool) (uint32, uint32) {
+	if b.family == nftables.TableFamilyIPv6 {
+		if src {
+			return 8, net.IPv6len
+		}
+		return 24, net.IPv6len
+	}
+
+	if src {
+		return 12, net.IPv4len
+	}
+	return 16, net.IPv4len
+}
+
+func (b *nftRuleBuilder) parseAddr(value string) (net.IP, net.IPMask, error) {
+	if !strings.Contains(value, "/") {
+		if b.family == nftables.TableFamilyIPv6 {
+			value += "/128"
+		} else {
+			value += "/32"
+		}
+	}
+
+	ip, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b.family == nftables.TableFamilyIPv6 {
+		return ipnet.IP.To16(), ipnet.Mask, nil
+	}
+
+	if ip.To4() == nil {
+		return nil, nil, fmt.Errorf("%s is not an ipv4 address", value)
+	}
+	return ipnet.IP.To4(), ipnet.Mask, nil
+}
+
+func (b *nftRuleBuilder) address(src bool, value string) error {
+	ip, mask, err := b.parseAddr(value)
+	if err != nil {
+		return err
+	}
+
+	offset, size := b.addrOffset(src)
+	b.exprs = append(b.exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          size,
+	})
+
+	if ones, bits := mask.Size(); ones != bits {
+		b.exprs = append(b.exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            size,
+			Mask:           mask,
+			Xor:            make([]byte, size),
+		})
+	}
+
+	b.exprs = append(b.exprs, &expr.Cmp{Op: b.cmpOp(), Register: 1, Data: ip})
+
+	return nil
+}
+
+func (b *nftRuleBuilder) iface(in bool, name string) {
+	key := expr.MetaKeyOIFNAME
+	if in {
+		key = expr.MetaKeyIIFNAME
+	}
+
+	b.exprs = append(b.exprs, &expr.Meta{Key: key, Register: 1})
+
+	// "eth+" matches every interface name starting with "eth"
+	if strings.HasSuffix(name, "+") {
+		b.exprs = append(b.exprs, &expr.Cmp{Op: b.cmpOp(), Register: 1, Data: []byte(strings.TrimSuffix(name, "+"))})
+		return
+	}
+
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	b.exprs = append(b.exprs, &expr.Cmp{Op: b.cmpOp(), Register: 1, Data: data})
+}
+
+func (b *nftRuleBuilder) loadPort(src bool) error {
+	switch b.l4proto {
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("port match requires -p tcp, udp or sctp")
+	}
+
+	offset := uint32(2)
+	if src {
+		offset = 0
+	}
+
+	b.exprs = append(b.exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       offset,
+		Len:          2,
+	})
+
+	return nil
+}
+
+func parsePort(value string) ([]byte, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", value)
+	}
+
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(port))
+	return data, nil
+}
+
+func (b *nftRuleBuilder) port(src bool, value string) error {
+	if err := b.loadPort(src); err != nil {
+		return err
+	}
+
+	if from, to, ok := strings.Cut(value, ":"); ok {
+		fromData, err := parsePort(from)
+		if err != nil {
+			return err
+		}
+		toData, err := parsePort(to)
+		if err != nil {
+			return err
+		}
+
+		b.exprs = append(b.exprs, &expr.Range{Op: b.cmpOp(), Register: 1, FromData: fromData, ToData: toData})
+		return nil
+	}
+
+	data, err := parsePort(value)
+	if err != nil {
+		return err
+	}
+
+	b.exprs = append(b.exprs, &expr.Cmp{Op: b.cmpOp(), Register: 1, Data: data})
+	return nil
+}
+
+func (b *nftRuleBuilder) ports(src bool, value string) error {
+	if err := b.loadPort(src); err != nil {
+		return err
+	}
+
+	set := &nftables.Set{
+		ID:        atomic.AddUint32(&nftSetID, 1),
+		Name:      "__set%d",
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeInetService,
+	}
+
+	elements := make([]nftables.SetElement, 0)
+	for _, p := range strings.Split(value, ",") {
+		if strings.Contains(p, ":") {
+			return fmt.Errorf("port ranges in multiport are not supported")
+		}
+
+		data, err := parsePort(p)
+		if err != nil {
+			return err
+		}
+		elements = append(elements, nftables.SetElement{Key: data})
+	}
+
+	b.sets = append(b.sets, nftAnonSet{set: set, elements: elements})
+	b.exprs = append(b.exprs, &expr.Lookup{SourceRegister: 1, SetID: set.ID, SetName: set.Name, Invert: b.neg})
+
+	return nil
+}
+
+// ctstate matches conntrack states, the DNAT and SNAT pseudo states match the conntrack status
+func (b *nftRuleBuilder) ctstate(value string) error {
+	var bits uint32
+	key := expr.CtKeySTATE
+
+	for k, s := range strings.Split(value, ",") {
+		bit, ok := nftCtStates[strings.ToUpper(s)]
+		if status, isStatus := nftCtStatus[strings.ToUpper(s)]; isStatus {
+			if k > 0 && key != expr.CtKeySTATUS {
+				return fmt.Errorf("conntrack states can not be mixed with %s", s)
+			}
+			key, bit, ok = expr.CtKeySTATUS, status, true
+		} else if key == expr.CtKeySTATUS {
+			return fmt.Errorf("conntrack states can not be mixed with DNAT/SNAT")
+		}
+
+		if !ok {
+			return fmt.Errorf("unknown conntrack state %s", s)
+		}
+		bits |= bit
+	}
+
+	op := expr.CmpOpNeq
+	if b.neg {
+		op = expr.CmpOpEq
+	}
+
+	b.exprs = append(b.exprs,
+		&expr.Ct{Register: 1, Key: key},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(bits),
+			Xor:            make([]byte, 4),
+		},
+		&expr.Cmp{Op: op, Register: 1, Data: make([]byte, 4)},
+	)
+
+	return nil
+}
+
+func (b *nftRuleBuilder) addrtype(src bool, value string) error {
+	addrType, ok := nftAddrTypes[strings.ToUpper(value)]
+	if !ok {
+		return fmt.Errorf("unsupported address type %s", value)
+	}
+
+	b.exprs = append(b.exprs,
+		&expr.Fib{Register: 1, ResultADDRTYPE: true, FlagSADDR: src, FlagDADDR: !src},
+		&expr.Cmp{Op: b.cmpOp(), Register: 1, Data: binaryutil.NativeEndian.PutUint32(addrType)},
+	)
+
+	return nil
+}
+
+// matchSet looks the address up in a named set of the same table, created with EnsureSet
+func (b *nftRuleBuilder) matchSet(name string, dirs string) error {
+	if strings.Contains(dirs, ",") {
+		return fmt.Errorf("multi dimension set match is not supported")
+	}
+	if dirs != "src" && dirs != "dst" {
+		return fmt.Errorf("invalid set match direction %s", dirs)
+	}
+	if b.setKeyType == nil {
+		return fmt.Errorf("set %s cannot be resolved", name)
+	}
+
+	// the key loaded from the packet must be of the set type
+	keyType, err := b.setKeyType(name)
+	if err != nil {
+		return err
+	}
+
+	var load *expr.Payload
+	switch keyType.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		offset, size := b.addrOffset(dirs == "src")
+		load = &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size}
+	case nftables.TypeInetService.Name:
+		if b.l4proto != "tcp" && b.l4proto != "udp" && b.l4proto != "sctp" {
+			return fmt.Errorf("port set %s requires -p tcp, udp or sctp", name)
+		}
+		offset := uint32(2)
+		if dirs == "src" {
+			offset = 0
+		}
+		load = &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2}
+	default:
+		return fmt.Errorf("set %s of type %s is not supported", name, keyType.Name)
+	}
+
+	b.exprs = append(b.exprs, load, &expr.Lookup{SourceRegister: 1, SetName: name, Invert: b.neg})
+
+	return nil
+}
+
+// natTarget parses "ip[:port[-port]]" of --to-destination/--to-source into registers 1 and 2
+func (b *nftRuleBuilder) natTarget(natType expr.NATType, value string) error {
+	host, port := value, ""
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return fmt.Errorf("invalid nat address %s", value)
+		}
+		host = value[1:end]
+		port = strings.TrimPrefix(value[end+1:], ":")
+	} else if strings.Count(value, ":") == 1 {
+		host, port, _ = strings.Cut(value, ":")
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid nat address %s", value)
+	}
+
+	nat := &expr.NAT{Type: natType, Family: unix.NFPROTO_IPV4, RegAddrMin: 1}
+	data := []byte(ip.To4())
+	if b.family == nftables.TableFamilyIPv6 {
+		nat.Family = unix.NFPROTO_IPV6
+		data = ip.To16()
+	}
+	b.exprs = append(b.exprs, &expr.Immediate{Register: 1, Data: data})
+
+	if port != "" {
+		from, to, _ := strings.Cut(port, "-")
+		fromData, err := parsePort(from)
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs, &expr.Immediate{Register: 2, Data: fromData})
+		nat.RegProtoMin = 2
+
+		if to != "" {
+			toData, err := parsePort(to)
+			if err != nil {
+				return err
+			}
+			b.exprs = append(b.exprs, &expr.Immediate{Register: 3, Data: toData})
+			nat.RegProtoMax = 3
+		}
+	}
+
+	b.exprs = append(b.exprs, nat)
+
+	return nil
+}
+
+func (b *nftRuleBuilder) target(target string, isGoto bool, opts []string) error {
+	optValue := func(names ...string) string {
+		for k := 0; k < len(opts)-1; k++ {
+			for _, name := range names {
+				if opts[k] == name {
+					return opts[k+1]
+				}
+			}
+		}
+		return ""
+	}
+	hasOpt := func(name string) bool {
+		for _, o := range opts {
+			if o == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch target {
+	case "ACCEPT":
+		b.exprs = append(b.exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case "DROP":
+		b.exprs = append(b.exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case "RETURN":
+		b.exprs = append(b.exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+	case "REJECT":
+		reject := &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 3}
+		if b.family == nftables.TableFamilyIPv6 {
+			reject.Code = 4
+		}
+		switch with := optValue("--reject-with"); with {
+		case "", "icmp-port-unreachable", "icmp6-port-unreachable":
+		case "tcp-reset":
+			reject = &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}
+		default:
+			return fmt.Errorf("unsupported --reject-with %s", with)
+		}
+		b.exprs = append(b.exprs, reject)
+	case "MASQUERADE":
+		masq := &expr.Masq{Random: hasOpt("--random"), FullyRandom: hasOpt("--random-fully")}
+		if ports := optValue("--to-ports"); ports != "" {
+			data, err := parsePort(ports)
+			if err != nil {
+				return err
+			}
+			b.exprs = append(b.exprs, &expr.Immediate{Register: 1, Data: data})
+			masq.ToPorts = true
+			masq.RegProtoMin = 1
+		}
+		b.exprs = append(b.exprs, masq)
+	case "DNAT":
+		return b.natTarget(expr.NATTypeDestNAT, optValue("--to-destination"))
+	case "SNAT":
+		return b.natTarget(expr.NATTypeSourceNAT, optValue("--to-source"))
+	case "REDIRECT":
+		data, err := parsePort(optValue("--to-ports"))
+		if err != nil {
+			return err
+		}
+		b.exprs = append(b.exprs,
+			&expr.Immediate{Register: 1, Data: data},
+			&expr.Redir{RegisterProtoMin: 1},
+		)
+	case "LOG":
+		log := &expr.Log{}
+		if prefix := optValue("--log-prefix"); prefix != "" {
+			log.Key = 1 << unix.NFTA_LOG_PREFIX
+			log.Data = []byte(prefix)
+		}
+		b.exprs = append(b.exprs, log)
+	default:
+		kind := expr.VerdictJump
+		if isGoto {
+			kind = expr.VerdictGoto
+		}
+		b.exprs = append(b.exprs, &expr.Verdict{Kind: kind, Chain: target})
+	}
+
+	return nil
+}
+
+// nftRuleGroups splits exprs into the matches ending with a comparison and the statements
+// that follow them, counters aside. ok is false if a match uses an anonymous set whose
+// content can not be compared.
+func nftRuleGroups(exprs []expr.Any) (matches [][]expr.Any, statements []expr.Any, ok bool) {
+	pending := make([]expr.Any, 0)
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Counter:
+			continue
+		case *expr.Lookup:
+			if strings.HasPrefix(e.SetName, "__set") {
+				return nil, nil, false
+			}
+			matches = append(matches, append(pending, e))
+			pending = make([]expr.Any, 0)
+		case *expr.Cmp, *expr.Range:
+			matches = append(matches, append(pending, e))
+			pending = make([]expr.Any, 0)
+		default:
+			pending = append(pending, e)
+		}
+	}
+
+	return matches, pending, true
+}
+
+// nftExprsEqual tells whether two rules match the same packets the same way, whatever the
+// order of their matches, as iptables-nft and gokit order them differently
+func nftExprsEqual(a, b []expr.Any) bool {
+	am, as, ok := nftRuleGroups(a)
+	if !ok {
+		return false
+	}
+	bm, bs, ok := nftRuleGroups(b)
+	if !ok || len(am) != len(bm) || !reflect.DeepEqual(as, bs) {
+		return false
+	}
+
+	used := make([]bool, len(bm))
+	for _, g := range am {
+		found := false
+		for k, h := range bm {
+			if !used[k] && reflect.DeepEqual(g, h) {
+				used[k], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// specsComment returns the value of the --comment option of specs, "" if there is none
+func specsComment(specs []string) string {
+	for k := 0; k < len(specs)-1; k++ {
+		if specs[k] == "--comment" {
+			return specs[k+1]
+		}
+	}
+	return ""
+}
+
+// nftRuleSpecs translates the expressions of a rule created by another tool, as iptables-nft,
+// back into iptables style specs. ok is false if the rule uses anything nftRuleExprs does not
+// produce.
+func nftRuleSpecs(family nftables.TableFamily, exprs []expr.Any, comment string) ([]string, bool) {
+	matches, statements, ok := nftRuleGroups(exprs)
+	if !ok {
+		return nil, false
+	}
+
+	b := &nftRuleBuilder{family: family}
+	specs := make([]string, 0)
+	for _, g := range matches {
+		var neg bool
+		var opt, value string
+		switch cmp := g[len(g)-1].(type) {
+		case *expr.Cmp:
+			if cmp.Register != 1 || (cmp.Op != expr.CmpOpEq && cmp.Op != expr.CmpOpNeq) {
+				return nil, false
+			}
+			neg = cmp.Op == expr.CmpOpNeq
+			opt, value = b.matchSpec(g[:len(g)-1], cmp.Data)
+		case *expr.Range:
+			if len(g) != 2 || (cmp.Op != expr.CmpOpEq && cmp.Op != expr.CmpOpNeq) {
+				return nil, false
+			}
+			neg = cmp.Op == expr.CmpOpNeq
+			if opt, _ = b.matchSpec(g[:1], cmp.FromData); opt == "--sport" || opt == "--dport" {
+				value = fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(cmp.FromData), binary.BigEndian.Uint16(cmp.ToData))
+			} else {
+				opt = ""
+			}
+		}
+		if opt == "" {
+			return nil, false
+		}
+
+		if opt == "-p" {
+			b.l4proto = value
+		} else if opt == "--sport" || opt == "--dport" {
+			specs = append(specs, "-m", b.l4proto)
+		}
+		if neg {
+			specs = append(specs, "!")
+		}
+		specs = append(specs, opt, value)
+	}
+
+	if comment != "" {
+		specs = append(specs, "-m", "comment", "--comment", comment)
+	}
+
+	switch {
+	case len(statements) == 0:
+	case len(statements) == 1:
+		target, ok := nftTargetSpecs(statements[0])
+		if !ok {
+			return nil, false
+		}
+		specs = append(specs, target...)
+	default:
+		return nil, false
+	}
+
+	return specs, true
+}
+
+// matchSpec returns the option and value of the match loading with load and comparing to
+// data, "" if it is not one of the plain matches
+func (b *nftRuleBuilder) matchSpec(load []expr.Any, data []byte) (string, string) {
+	switch e := load[0].(type) {
+	case *expr.Meta:
+		if len(load) != 1 {
+			return "", ""
+		}
+		switch e.Key {
+		case expr.MetaKeyL4PROTO:
+			if len(data) != 1 {
+				return "", ""
+			}
+			for name, proto := range nftL4Protos {
+				if proto == data[0] && name != "icmpv6" {
+					return "-p", name
+				}
+			}
+			return "-p", strconv.Itoa(int(data[0]))
+		case expr.MetaKeyIIFNAME, expr.MetaKeyOIFNAME:
+			opt := "-o"
+			if e.Key == expr.MetaKeyIIFNAME {
+				opt = "-i"
+			}
+			name := strings.TrimRight(string(data), "\x00")
+			if len(name) == len(data) {
+				name += "+"
+			}
+			return opt, name
+		}
+
+	case *expr.Payload:
+		if e.Base == expr.PayloadBaseTransportHeader && e.Len == 2 && len(load) == 1 && len(data) == 2 {
+			if b.l4proto != "tcp" && b.l4proto != "udp" && b.l4proto != "sctp" {
+				return "", ""
+			}
+			port := strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+			switch e.Offset {
+			case 0:
+				return "--sport", port
+			case 2:
+				return "--dport", port
+			}
+			return "", ""
+		}
+
+		if e.Base != expr.PayloadBaseNetworkHeader || len(data) != int(e.Len) {
+			return "", ""
+		}
+		srcOffset, size := b.addrOffset(true)
+		dstOffset, _ := b.addrOffset(false)
+		if e.Len != size || (e.Offset != srcOffset && e.Offset != dstOffset) {
+			return "", ""
+		}
+
+		mask := net.CIDRMask(int(size)*8, int(size)*8)
+		if len(load) == 2 {
+			bitwise, ok := load[1].(*expr.Bitwise)
+			if !ok || len(bitwise.Mask) != int(size) {
+				return "", ""
+			}
+			mask = net.IPMask(bitwise.Mask)
+		} else if len(load) != 1 {
+			return "", ""
+		}
+		if ones, _ := mask.Size(); ones == 0 && len(load) == 2 {
+			return "", ""
+		}
+
+		opt := "-s"
+		if e.Offset == dstOffset {
+			opt = "-d"
+		}
+		return opt, (&net.IPNet{IP: net.IP(data), Mask: mask}).String()
+	}
+
+	return "", ""
+}
+
+// nftTargetSpecs returns the -j or -g option of the final statement of a rule
+func nftTargetSpecs(statement expr.Any) ([]string, bool) {
+	switch e := statement.(type) {
+	case *expr.Verdict:
+		switch e.Kind {
+		case expr.VerdictAccept:
+			return []string{"-j", "ACCEPT"}, true
+		case expr.VerdictDrop:
+			return []string{"-j", "DROP"}, true
+		case expr.VerdictReturn:
+			return []string{"-j", "RETURN"}, true
+		case expr.VerdictJump:
+			return []string{"-j", e.Chain}, true
+		case expr.VerdictGoto:
+			return []string{"-g", e.Chain}, true
+		}
+	case *expr.Masq:
+		if !e.ToPorts && !e.Random && !e.FullyRandom && !e.Persistent {
+			return []string{"-j", "MASQUERADE"}, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,286 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/running910/gokit/logger"
+)
+
+const (
+	iptablesOwnerPrefix      = "owner:"
+	iptablesChainOwnerPrefix = "owner-chain:"
+)
+
+var iptablesTables = []string{"raw", "mangle", "nat", "filter", "security"}
+
+// IptablesRule is a rule as listed by iptables -S, without the leading "-A <chain>"
+type IptablesRule struct {
+	Proto IpProto
+	Table string
+	Chain string
+	Specs []string
+}
+
+func (r IptablesRule) String() string {
+	return fmt.Sprintf("%s -t %s -A %s %s", r.Proto, r.Table, r.Chain, strings.Join(r.Specs, " "))
+}
+
+// Target returns the -j/-g target of the rule, or empty string if there is none
+func (r IptablesRule) Target() string {
+	for k := 0; k < len(r.Specs)-1; k++ {
+		if r.Specs[k] == "-j" || r.Specs[k] == "--jump" || r.Specs[k] == "-g" || r.Specs[k] == "--goto" {
+			return r.Specs[k+1]
+		}
+	}
+	return ""
+}
+
+// Owner returns the owner id carried by the rule comment, or empty string if untagged
+func (r IptablesRule) Owner() string {
+	for k := 0; k < len(r.Specs)-1; k++ {
+		if r.Specs[k] == "--comment" && strings.HasPrefix(r.Specs[k+1], iptablesOwnerPrefix) {
+			return strings.TrimPrefix(r.Specs[k+1], iptablesOwnerPrefix)
+		}
+	}
+	return ""
+}
+
+// ChainOwner returns the owner id if the rule is the marker of a chain created by an owner,
+// or empty string otherwise
+func (r IptablesRule) ChainOwner() string {
+	for k := 0; k < len(r.Specs)-1; k++ {
+		if r.Specs[k] == "--comment" && strings.HasPrefix(r.Specs[k+1], iptablesChainOwnerPrefix) {
+			return strings.TrimPrefix(r.Specs[k+1], iptablesChainOwnerPrefix)
+		}
+	}
+	return ""
+}
+
+func ownerCommentSpecs(owner string) []string {
+	return []string{"-m", "comment", "--comment", iptablesOwnerPrefix + owner}
+}
+
+// chainMarkerSpecs is the rule tagging a chain created by owner, it has no target so it does
+// not change what the chain does
+func chainMarkerSpecs(owner string) []string {
+	return []string{"-m", "comment", "--comment", iptablesChainOwnerPrefix + owner}
+}
+
+// listRules returns all rules of table for proto, tables unsupported by the kernel are skipped
+func (i *IptablesCtx) listRules(proto IpProto, table string) ([]IptablesRule, error) {
+	ipt := i.getIpt(proto)
+
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		logger.Debugf("ListChains %s table %s failed, skip it. reason:%s", proto, table, err)
+		return nil, nil
+	}
+
+	rules := make([]IptablesRule, 0)
+	for _, chain := range chains {
+		lines, err := ipt.List(table, chain)
+		if err != nil {
+			logger.Errorf("List %s table %s chain failed! reason:%s", table, chain, err)
+			return nil, err
+		}
+
+		for _, line := range lines {
+			rule, ok := parseIptablesRuleLine(line)
+			if !ok {
+				continue
+			}
+			rule.Proto = proto
+			rule.Table = table
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// listOwned lists all ipv4 and ipv6 rules tagged with owner, and the marker rules of the
+// chains created by owner
+func (i *IptablesCtx) listOwned(owner string) ([]IptablesRule, []IptablesRule, error) {
+	owned := make([]IptablesRule, 0)
+	markers := make([]IptablesRule, 0)
+
+	for _, proto := range []IpProto{IpProtoV4, IpProtoV6} {
+		for _, table := range iptablesTables {
+			rules, err := i.listRules(proto, table)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, rule := range rules {
+				if rule.Owner() == owner {
+					owned = append(owned, rule)
+				} else if rule.ChainOwner() == owner {
+					markers = append(markers, rule)
+				}
+			}
+		}
+	}
+
+	return owned, markers, nil
+}
+
+// ListOwned lists all ipv4 and ipv6 rules tagged with owner
+func (i *IptablesCtx) ListOwned(owner string) ([]IptablesRule, error) {
+	owned, _, err := i.listOwned(owner)
+	return owned, err
+}
+
+// PurgeOwned deletes all rules tagged with owner, then the chains created by owner as long as
+// nothing but their owner marker is left in them and no rule jumps to them. Chains are found
+// by their marker, so a restarted process purges what a crashed one left. It keeps going on
+// failure and returns the first error.
+func (i *IptablesCtx) PurgeOwned(owner string) error {
+	var firstErr error
+
+	rules, markers, err := i.listOwned(owner)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		ipt := i.getIpt(rule.Proto)
+
+		logger.Infof("purge owner %s rule: %s", owner, rule)
+		unlock := i.lockTables(rule.Proto, rule.Table)
+		err := i.retry(func() error { return ipt.DeleteIfExists(rule.Table, rule.Chain, rule.Specs...) })
+		unlock()
+		if err != nil {
+			logger.Errorf("DeleteIfExists %s table %s chain specs:%+v failed! reason:%s", rule.Table, rule.Chain, rule.Specs, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	// chains may reference each other, retry until no more chain can be deleted
+	candidates := markers
+	for len(candidates) > 0 {
+		remain := make([]IptablesRule, 0)
+		for _, marker := range candidates {
+			deleted, err := i.purgeOwnedChain(owner, marker)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else if !deleted {
+				remain = append(remain, marker)
+			}
+		}
+
+		if len(remain) == len(candidates) {
+			for _, marker := range remain {
+				err := fmt.Errorf("chain %s in %s table %s is not empty or still referenced", marker.Chain, marker.Proto, marker.Table)
+				logger.Errorf("purge owner %s failed! reason:%s", owner, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			break
+		}
+		candidates = remain
+	}
+
+	return firstErr
+}
+
+// purgeOwnedChain deletes the chain of marker if only owner markers are left in it and no rule
+// jumps to it, it tells whether the chain is gone
+func (i *IptablesCtx) purgeOwnedChain(owner string, marker IptablesRule) (bool, error) {
+	ipt := i.getIpt(marker.Proto)
+	defer i.lockTables(marker.Proto, marker.Table)()
+
+	rules, err := i.listRules(marker.Proto, marker.Table)
+	if err != nil {
+		return false, err
+	}
+
+	for _, rule := range rules {
+		if rule.Chain == marker.Chain && rule.ChainOwner() != owner {
+			return false, nil
+		}
+		if rule.Target() == marker.Chain {
+			return false, nil
+		}
+	}
+
+	err = i.retry(func() error { return ipt.ClearAndDeleteChain(marker.Table, marker.Chain) })
+	if err != nil {
+		logger.Errorf("ClearAndDeleteChain %s table %s chain failed! reason:%s", marker.Table, marker.Chain, err)
+		return false, err
+	}
+
+	logger.Infof("purge owner %s chain: %s -t %s %s", owner, marker.Proto, marker.Table, marker.Chain)
+	return true, nil
+}
+
+// parseIptablesRuleLine parses a "-A <chain> <specs...>" line as printed by iptables -S
+func parseIptablesRuleLine(line string) (IptablesRule, bool) {
+	tokens := splitIptablesArgs(line)
+	if len(tokens) < 2 || tokens[0] != "-A" {
+		return IptablesRule{}, false
+	}
+
+	return IptablesRule{Chain: tokens[1], Specs: tokens[2:]}, true
+}
+
+// splitIptablesArgs splits an iptables -S/iptables-save line into arguments, honoring
+// double quotes and backslash escapes used for comments with spaces.
+func splitIptablesArgs(line string) []string {
+	args := make([]string, 0)
+
+	var cur strings.Builder
+	inQuote := false
+	hasToken := false
+
+	for k := 0; k < len(line); k++ {
+		c := line[k]
+		switch {
+		case c == '\\' && k+1 < len(line):
+			k++
+			cur.WriteByte(line[k])
+			hasToken = true
+		case c == '"':
+			inQuote = !inQuote
+			hasToken = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if hasToken {
+				args = append(args, cur.String())
+				cur.Reset()
+				hasToken = false
+			}
+		default:
+			cur.WriteByte(c)
+			hasToken = true
+		}
+	}
+
+	if hasToken {
+		args = append(args, cur.String())
+	}
+
+	return args
+}
+
+// joinIptablesArgs is the reverse of splitIptablesArgs, arguments with spaces or quotes are quoted
+func joinIptablesArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if arg != "" && !strings.ContainsAny(arg, " \t\"\\") {
+			quoted = append(quoted, arg)
+			continue
+		}
+
+		arg = strings.ReplaceAll(arg, `\`, `\\`)
+		arg = strings.ReplaceAll(arg, `"`, `\"`)
+		quoted = append(quoted, `"`+arg+`"`)
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIptables is an in memory IptablesBackend, with iptables semantics for chain deletion
+type fakeIptables struct {
+	mu     sync.Mutex
+	chains map[string]map[string][][]string
+	// order of the user chains per table, for a stable listing
+	order map[string][]string
+	// number of calls failing as if another writer held the xtables lock
+	busy int
+	// time spent in Exists after the check, widening check-then-act races
+	delay time.Duration
+}
+
+func newFakeIptables() *fakeIptables {
+	f := &fakeIptables{chains: make(map[string]map[string][][]string), order: make(map[string][]string)}
+	for _, table := range iptablesTables {
+		f.chains[table] = make(map[string][][]string)
+		for _, chain := range fakeBuiltinChains {
+			f.chains[table][chain] = nil
+		}
+	}
+	return f
+}
+
+func newFakeIptablesCtx(owner string, f *fakeIptables) *IptablesCtx {
+	return &IptablesCtx{
+		ip4t:       f,
+		ip6t:       newFakeIptables(),
+		kind:       IptablesBackendIptables,
+		opts:       IptablesOptions{Retries: 3, RetryBackoff: time.Millisecond},
+		owner:      owner,
+		tableLocks: make(map[string]*sync.Mutex),
+	}
+}
+
+func (f *fakeIptables) takeBusy() error {
+	if f.busy > 0 {
+		f.busy--
+		return errors.New("iptables: Resource temporarily unavailable.")
+	}
+	return nil
+}
+
+var fakeBuiltinChains = []string{"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"}
+
+func (f *fakeIptables) isBuiltin(chain string) bool {
+	for _, c := range fakeBuiltinChains {
+		if c == chain {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeIptables) ChainExists(table, chain string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.chains[table][chain]
+	return ok, nil
+}
+
+func (f *fakeIptables) ClearChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeBusy(); err != nil {
+		return err
+	}
+	if _, ok := f.chains[table][chain]; !ok {
+		f.order[table] = append(f.order[table], chain)
+	}
+	f.chains[table][chain] = nil
+	return nil
+}
+
+func (f *fakeIptables) DeleteChain(table, chain string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeBusy(); err != nil {
+		return err
+	}
+	if len(f.chains[table][chain]) > 0 {
+		return fmt.Errorf("chain %s is not empty", chain)
+	}
+	for _, rules := range f.chains[table] {
+		for _, rule := range rules {
+			if (IptablesRule{Specs: rule}).Target() == chain {
+				return fmt.Errorf("chain %s is referenced", chain)
+			}
+		}
+	}
+
+	delete(f.chains[table], chain)
+	for k, c := range f.order[table] {
+		if c == chain {
+			f.order[table] = append(f.order[table][:k], f.order[table][k+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeIptables) ClearAndDeleteChain(table, chain string) error {
+	if exist, _ := f.ChainExists(table, chain); !exist {
+		return nil
+	}
+
+	f.mu.Lock()
+	f.chains[table][chain] = nil
+	f.mu.Unlock()
+
+	return f.DeleteChain(table, chain)
+}
+
+func (f *fakeIptables) ListChains(table string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	chains := make([]string, 0)
+	for chain := range f.chains[table] {
+		if f.isBuiltin(chain) {
+			chains = append(chains, chain)
+		}
+	}
+	return append(chains, f.order[table]...), nil
+}
+
+func (f *fakeIptables) List(table, chain string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rules, ok := f.chains[table][chain]
+	if !ok {
+		return nil, fmt.Errorf("no chain %s", chain)
+	}
+
+	lines := []string{"-N " + chain}
+	if f.isBuiltin(chain) {
+		lines = []string{"-P " + chain + " ACCEPT"}
+	}
+	for _, rule := range rules {
+		lines = append(lines, "-A "+chain+" "+joinIptablesArgs(rule))
+	}
+	return lines, nil
+}
+
+func (f *fakeIptables) find(table, chain string, rulespec []string) int {
+	for k, rule := range f.chains[table][chain] {
+		if reflect.DeepEqual(rule, rulespec) {
+			return k
+		}
+	}
+	return -1
+}
+
+func (f *fakeIptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	f.mu.Lock()
+	exist := f.find(table, chain, rulespec) >= 0
+	f.mu.Unlock()
+
+	time.Sleep(f.delay)
+	return exist, nil
+}
+
+func (f *fakeIptables) Append(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeBusy(); err != nil {
+		return err
+	}
+	if _, ok := f.chains[table][chain]; !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	f.chains[table][chain] = append(f.chains[table][chain], append([]string{}, rulespec...))
+	return nil
+}
+
+func (f *fakeIptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeBusy(); err != nil {
+		return err
+	}
+	if _, ok := f.chains[table][chain]; !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	rules := f.chains[table][chain]
+	f.chains[table][chain] = append([][]string{append([]string{}, rulespec...)}, rules...)
+	return nil
+}
+
+func (f *fakeIptables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.takeBusy(); err != nil {
+		return err
+	}
+	if k := f.find(table, chain, rulespec); k >= 0 {
+		rules := f.chains[table][chain]
+		f.chains[table][chain] = append(rules[:k:k], rules[k+1:]...)
+	}
+	return nil
+}
+
+func TestSplitIptablesArgs(t *testing.T) {
+
+	line := `-A INPUT -p udp -m comment --comment "owner:my agent" -m comment --comment owner:x\"y -j ACCEPT`
+	want := []string{"-A", "INPUT", "-p", "udp", "-m", "comment", "--comment", "owner:my agent", "-m", "comment", "--comment", `owner:x"y`, "-j", "ACCEPT"}
+
+	args := splitIptablesArgs(line)
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("split %q got %q", line, args)
+	}
+
+	if again := splitIptablesArgs(joinIptablesArgs(args)); !reflect.DeepEqual(again, want) {
+		t.Fatalf("join/split round trip got %q", again)
+	}
+}
+
+func TestIptablesRuleOwner(t *testing.T) {
+
+	rule, ok := parseIptablesRuleLine(`-A hellochain -p udp -m comment --comment "owner:agent" -j KUBE-MARK`)
+	if !ok {
+		t.Fatalf("parse rule line failed")
+	}
+
+	if rule.Chain != "hellochain" || rule.Owner() != "agent" || rule.Target() != "KUBE-MARK" || rule.ChainOwner() != "" {
+		t.Fatalf("unexpected rule chain:%s owner:%s target:%s", rule.Chain, rule.Owner(), rule.Target())
+	}
+
+	marker, _ := parseIptablesRuleLine("-A hellochain " + joinIptablesArgs(chainMarkerSpecs("agent")))
+	if marker.ChainOwner() != "agent" || marker.Owner() != "" || marker.Target() != "" {
+		t.Fatalf("unexpected chain marker %+v", marker)
+	}
+
+	if _, ok := parseIptablesRuleLine("-N hellochain"); ok {
+		t.Fatalf("chain line parsed as rule")
+	}
+}
+
+func TestPurgeOwnedAfterCrash(t *testing.T) {
+
+	f := newFakeIptables()
+	crashed := newFakeIptablesCtx("agent", f)
+
+	for _, chain := range []string{"AGENT-IN", "AGENT-SUB", "AGENT-EMPTY", "AGENT-SHARED"} {
+		if err := crashed.EnsureChain(IpProtoV4, "filter", chain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crashed.EnsureRuleInserted(IpProtoV4, "filter", "INPUT", "-j", "AGENT-IN")
+	crashed.EnsureRuleAppended(IpProtoV4, "filter", "AGENT-IN", "-p", "tcp", "-j", "AGENT-SUB")
+	crashed.EnsureRuleAppended(IpProtoV4, "filter", "AGENT-SUB", "-j", "ACCEPT")
+
+	// left alone: an empty chain of another component, and a rule another one added to a chain
+	// of the agent
+	other := newFakeIptablesCtx("", f)
+	other.EnsureChain(IpProtoV4, "filter", "OTHER-EMPTY")
+	other.EnsureRuleAppended(IpProtoV4, "filter", "AGENT-SHARED", "-j", "DROP")
+	other.EnsureRuleAppended(IpProtoV4, "filter", "INPUT", "-j", "OTHER-EMPTY")
+
+	// the restarted process knows nothing of the chains created before the crash
+	restarted := newFakeIptablesCtx("agent", f)
+	err := restarted.PurgeOwned("agent")
+	if err == nil || !strings.Contains(err.Error(), "AGENT-SHARED") {
+		t.Fatalf("expect an error for the chain still holding a foreign rule, got %v", err)
+	}
+
+	chains, _ := f.ListChains("filter")
+	for _, chain := range chains {
+		if strings.HasPrefix(chain, "AGENT-") && chain != "AGENT-SHARED" {
+			t.Fatalf("chain %s not purged", chain)
+		}
+	}
+	if exist, _ := f.ChainExists("filter", "OTHER-EMPTY"); !exist {
+		t.Fatal("chain of another component purged")
+	}
+	if rules, _ := f.List("filter", "INPUT"); len(rules) != 2 {
+		t.Fatalf("unexpected INPUT rules %q", rules)
+	}
+	if rules, _ := f.List("filter", "AGENT-SHARED"); len(rules) != 3 {
+		t.Fatalf("marker of a kept chain removed %q", rules)
+	}
+}
@@ -0,0 +1,604 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/running910/gokit/logger"
+)
+
+type IptablesChainSnapshot struct {
+	Name string
+	// policy of builtin chains, "-" for user chains
+	Policy string
+	// rule specs without the leading "-A <chain>"
+	Rules [][]string
+}
+
+type IptablesTableSnapshot struct {
+	Name   string
+	Chains []*IptablesChainSnapshot
+}
+
+// IptablesSnapshot is the parsed form of iptables-save output
+type IptablesSnapshot struct {
+	Proto  IpProto
+	Tables []*IptablesTableSnapshot
+}
+
+func (s *IptablesSnapshot) Table(name string) *IptablesTableSnapshot {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *IptablesTableSnapshot) Chain(name string) *IptablesChainSnapshot {
+	for _, c := range t.Chains {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// String renders the snapshot in iptables-save format, accepted by iptables-restore
+func (s *IptablesSnapshot) String() string {
+	var b strings.Builder
+
+	for _, t := range s.Tables {
+		fmt.Fprintf(&b, "*%s\n", t.Name)
+		for _, c := range t.Chains {
+			fmt.Fprintf(&b, ":%s %s [0:0]\n", c.Name, c.Policy)
+		}
+		for _, c := range t.Chains {
+			for _, rule := range c.Rules {
+				fmt.Fprintf(&b, "-A %s %s\n", c.Name, joinIptablesArgs(rule))
+			}
+		}
+		b.WriteString("COMMIT\n")
+	}
+
+	return b.String()
+}
+
+// ParseIptablesSave parses iptables-save output, packet counters are dropped
+func ParseIptablesSave(proto IpProto, data []byte) (*IptablesSnapshot, error) {
+	snapshot := &IptablesSnapshot{Proto: proto, Tables: make([]*IptablesTableSnapshot, 0)}
+
+	var table *IptablesTableSnapshot
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "*"):
+			table = &IptablesTableSnapshot{Name: line[1:], Chains: make([]*IptablesChainSnapshot, 0)}
+			snapshot.Tables = append(snapshot.Tables, table)
+			continue
+		case table == nil:
+			return nil, fmt.Errorf("line %d: %q outside of table", lineNo, line)
+		case line == "COMMIT":
+			table = nil
+		case strings.HasPrefix(line, ":"):
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: invalid chain %q", lineNo, line)
+			}
+			table.Chains = append(table.Chains, &IptablesChainSnapshot{Name: fields[0], Policy: fields[1], Rules: make([][]string, 0)})
+		default:
+			// rules may be prefixed with counters when saved with -c
+			if strings.HasPrefix(line, "[") {
+				if end := strings.Index(line, "]"); end > 0 {
+					line = strings.TrimSpace(line[end+1:])
+				}
+			}
+
+			rule, ok := parseIptablesRuleLine(line)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid rule %q", lineNo, line)
+			}
+
+			chain := table.Chain(rule.Chain)
+			if chain == nil {
+				return nil, fmt.Errorf("line %d: rule of undeclared chain %s", lineNo, rule.Chain)
+			}
+			chain.Rules = append(chain.Rules, rule.Specs)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func iptablesSaveCommand(proto IpProto, restore bool) string {
+	cmd := "iptables"
+	if proto == IpProtoV6 {
+		cmd = "ip6tables"
+	}
+
+	if restore {
+		return cmd + "-restore"
+	}
+	return cmd + "-save"
+}
+
+// Save returns a snapshot of tables, or of every table if none is given
+func (i *IptablesCtx) Save(proto IpProto, tables ...string) (*IptablesSnapshot, error) {
+	if _, ok := i.getIpt(proto).(*NftablesBackend); ok {
+		return i.saveFromBackend(proto, tables)
+	}
+
+	if len(tables) == 0 {
+		out, err := exec.Command(iptablesSaveCommand(proto, false)).Output()
+		if err != nil {
+			logger.Errorf("%s failed! reason:%s", iptablesSaveCommand(proto, false), err)
+			return nil, err
+		}
+		return ParseIptablesSave(proto, out)
+	}
+
+	snapshot := &IptablesSnapshot{Proto: proto, Tables: make([]*IptablesTableSnapshot, 0)}
+	for _, table := range tables {
+		out, err := exec.Command(iptablesSaveCommand(proto, false), "-t", table).Output()
+		if err != nil {
+			logger.Errorf("%s -t %s failed! reason:%s", iptablesSaveCommand(proto, false), table, err)
+			return nil, err
+		}
+
+		s, err := ParseIptablesSave(proto, out)
+		if err != nil {
+			logger.Errorf("ParseIptablesSave() %s table %s failed! reason:%s", proto, table, err)
+			return nil, err
+		}
+		snapshot.Tables = append(snapshot.Tables, s.Tables...)
+	}
+
+	return snapshot, nil
+}
+
+func (i *IptablesCtx) saveFromBackend(proto IpProto, tables []string) (*IptablesSnapshot, error) {
+	ipt := i.getIpt(proto)
+	if len(tables) == 0 {
+		tables = iptablesTables
+	}
+
+	snapshot := &IptablesSnapshot{Proto: proto, Tables: make([]*IptablesTableSnapshot, 0)}
+	for _, table := range tables {
+		chains, err := ipt.ListChains(table)
+		if err != nil || len(chains) == 0 {
+			continue
+		}
+
+		t := &IptablesTableSnapshot{Name: table, Chains: make([]*IptablesChainSnapshot, 0)}
+		for _, chain := range chains {
+			lines, err := ipt.List(table, chain)
+			if err != nil {
+				logger.Errorf("List %s table %s chain failed! reason:%s", table, chain, err)
+				return nil, err
+			}
+
+			c := &IptablesChainSnapshot{Name: chain, Policy: "-", Rules: make([][]string, 0)}
+			for _, line := range lines {
+				if strings.HasPrefix(line, "-P ") {
+					c.Policy = strings.Fields(line)[2]
+				} else if rule, ok := parseIptablesRuleLine(line); ok {
+					c.Rules = append(c.Rules, rule.Specs)
+				}
+			}
+			t.Chains = append(t.Chains, c)
+		}
+		snapshot.Tables = append(snapshot.Tables, t)
+	}
+
+	return snapshot, nil
+}
+
+// missingFrom returns the chains and rules of s missing from live. Chains existing in live
+// are kept only to hold their missing rules, with an empty Policy, and a rule present n times
+// in live covers n of its copies in s.
+func (s *IptablesSnapshot) missingFrom(live *IptablesSnapshot) *IptablesSnapshot {
+	missing := &IptablesSnapshot{Proto: s.Proto, Tables: make([]*IptablesTableSnapshot, 0)}
+
+	for _, t := range s.Tables {
+		liveTable := live.Table(t.Name)
+		mt := &IptablesTableSnapshot{Name: t.Name, Chains: make([]*IptablesChainSnapshot, 0)}
+
+		for _, c := range t.Chains {
+			var liveChain *IptablesChainSnapshot
+			if liveTable != nil {
+				liveChain = liveTable.Chain(c.Name)
+			}
+
+			// builtin chains exist as soon as the table does
+			mc := &IptablesChainSnapshot{Name: c.Name, Rules: make([][]string, 0)}
+			if liveChain == nil && c.Policy == "-" {
+				mc.Policy = "-"
+			}
+
+			present := make(map[string]int)
+			if liveChain != nil {
+				for _, rule := range liveChain.Rules {
+					present[joinIptablesArgs(rule)]++
+				}
+			}
+			for _, rule := range c.Rules {
+				if key := joinIptablesArgs(rule); present[key] > 0 {
+					present[key]--
+				} else {
+					mc.Rules = append(mc.Rules, rule)
+				}
+			}
+
+			if mc.Policy != "" || len(mc.Rules) > 0 {
+				mt.Chains = append(mt.Chains, mc)
+			}
+		}
+
+		if len(mt.Chains) > 0 {
+			missing.Tables = append(missing.Tables, mt)
+		}
+	}
+
+	return missing
+}
+
+// noflushScript renders the output of missingFrom for iptables-restore --noflush. Only the
+// new chains are declared, as declaring an existing chain flushes it, so the policies of the
+// builtin chains are left alone.
+func (s *IptablesSnapshot) noflushScript() []byte {
+	var b strings.Builder
+
+	for _, t := range s.Tables {
+		fmt.Fprintf(&b, "*%s\n", t.Name)
+		for _, c := range t.Chains {
+			if c.Policy != "" {
+				fmt.Fprintf(&b, ":%s %s [0:0]\n", c.Name, c.Policy)
+			}
+		}
+		for _, c := range t.Chains {
+			for _, rule := range c.Rules {
+				fmt.Fprintf(&b, "-A %s %s\n", c.Name, joinIptablesArgs(rule))
+			}
+		}
+		b.WriteString("COMMIT\n")
+	}
+
+	return []byte(b.String())
+}
+
+// Restore applies snapshot with iptables-restore. With flush the chains of the snapshot tables
+// are replaced entirely. Otherwise the missing chains are created and the rules not already
+// present are appended to their chain, existing rules and builtin policies are left alone.
+func (i *IptablesCtx) Restore(proto IpProto, snapshot *IptablesSnapshot, flush bool) error {
+	if _, ok := i.getIpt(proto).(*NftablesBackend); ok {
+		return i.restoreToBackend(proto, snapshot, flush)
+	}
+
+	tables := make([]string, 0, len(snapshot.Tables))
+	for _, t := range snapshot.Tables {
+		tables = append(tables, t.Name)
+	}
+	defer i.lockTables(proto, tables...)()
+
+	if flush {
+		return i.retry(func() error { return i.runRestore(proto, []byte(snapshot.String()), false) })
+	}
+
+	live, err := i.Save(proto, tables...)
+	if err != nil {
+		return err
+	}
+
+	missing := snapshot.missingFrom(live)
+	if len(missing.Tables) == 0 {
+		return nil
+	}
+
+	return i.retry(func() error { return i.runRestore(proto, missing.noflushScript(), true) })
+}
+
+func (i *IptablesCtx) restoreToBackend(proto IpProto, snapshot *IptablesSnapshot, flush bool) error {
+	ipt := i.getIpt(proto)
+
+	tables := make([]string, 0, len(snapshot.Tables))
+	for _, t := range snapshot.Tables {
+		tables = append(tables, t.Name)
+	}
+	defer i.lockTables(proto, tables...)()
+
+	if !flush {
+		live, err := i.saveFromBackend(proto, tables)
+		if err != nil {
+			return err
+		}
+		snapshot = snapshot.missingFrom(live)
+	}
+
+	for _, t := range snapshot.Tables {
+		for _, c := range t.Chains {
+			if flush || c.Policy != "" {
+				if err := ipt.ClearChain(t.Name, c.Name); err != nil {
+					logger.Errorf("ClearChain %s table %s chain failed! reason:%s", t.Name, c.Name, err)
+					return err
+				}
+			}
+		}
+
+		for _, c := range t.Chains {
+			for _, rule := range c.Rules {
+				if err := ipt.Append(t.Name, c.Name, rule...); err != nil {
+					logger.Errorf("Append %s table %s chain specs:%+v failed! reason:%s", t.Name, c.Name, rule, err)
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+type IptablesChainDrift struct {
+	Table string
+	Chain string
+	// rules only in the live ruleset
+	Added [][]string
+	// rules only in the expected snapshot
+	Missing [][]string
+	// rules in both, but at a different position relative to the other rules
+	Reordered [][]string
+}
+
+// Drift compares the live rules of the snapshot tables against expected, chains without
+// differences are not reported.
+func (i *IptablesCtx) Drift(expected *IptablesSnapshot) ([]IptablesChainDrift, error) {
+	tables := make([]string, 0, len(expected.Tables))
+	for _, t := range expected.Tables {
+		tables = append(tables, t.Name)
+	}
+
+	live, err := i.Save(expected.Proto, tables...)
+	if err != nil {
+		return nil, err
+	}
+
+	return CompareIptablesSnapshots(expected, live), nil
+}
+
+// CompareIptablesSnapshots lists per chain the rules added, missing and reordered in live
+// compared to expected.
+func CompareIptablesSnapshots(expected, live *IptablesSnapshot) []IptablesChainDrift {
+	drifts := make([]IptablesChainDrift, 0)
+
+	empty := &IptablesTableSnapshot{}
+	for _, t := range mergeTableNames(expected, live) {
+		et, lt := expected.Table(t), live.Table(t)
+		if et == nil {
+			et = empty
+		}
+		if lt == nil {
+			lt = empty
+		}
+
+		for _, c := range mergeChainNames(et, lt) {
+			var expectedRules, liveRules [][]string
+			if ec := et.Chain(c); ec != nil {
+				expectedRules = ec.Rules
+			}
+			if lc := lt.Chain(c); lc != nil {
+				liveRules = lc.Rules
+			}
+
+			drift := compareIptablesRules(expectedRules, liveRules)
+			if len(drift.Added) > 0 || len(drift.Missing) > 0 || len(drift.Reordered) > 0 {
+				drift.Table, drift.Chain = t, c
+				drifts = append(drifts, drift)
+			}
+		}
+	}
+
+	return drifts
+}
+
+func mergeTableNames(a, b *IptablesSnapshot) []string {
+	names := make([]string, 0)
+	for _, t := range append(append([]*IptablesTableSnapshot{}, a.Tables...), b.Tables...) {
+		if !containsString(names, t.Name) {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+func mergeChainNames(a, b *IptablesTableSnapshot) []string {
+	names := make([]string, 0)
+	for _, c := range append(append([]*IptablesChainSnapshot{}, a.Chains...), b.Chains...) {
+		if !containsString(names, c.Name) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compareIptablesRules matches rules as multisets for added/missing, then the common rules
+// not on the longest common subsequence of both orders are the reordered ones.
+func compareIptablesRules(expected, live [][]string) IptablesChainDrift {
+	drift := IptablesChainDrift{Added: make([][]string, 0), Missing: make([][]string, 0), Reordered: make([][]string, 0)}
+
+	liveCount := make(map[string]int)
+	for _, r := range live {
+		liveCount[joinIptablesArgs(r)]++
+	}
+
+	expectedCount := make(map[string]int)
+	commonExpected := make([]string, 0)
+	for _, r := range expected {
+		key := joinIptablesArgs(r)
+		if liveCount[key] > expectedCount[key] {
+			commonExpected = append(commonExpected, key)
+		} else {
+			drift.Missing = append(drift.Missing, r)
+		}
+		expectedCount[key]++
+	}
+
+	seen := make(map[string]int)
+	commonLive := make([]string, 0)
+	for _, r := range live {
+		key := joinIptablesArgs(r)
+		if seen[key] < expectedCount[key] {
+			commonLive = append(commonLive, key)
+		} else {
+			drift.Added = append(drift.Added, r)
+		}
+		seen[key]++
+	}
+
+	// longest common subsequence of the common rules
+	n, m := len(commonExpected), len(commonLive)
+	lcs := make([][]int, n+1)
+	for k := range lcs {
+		lcs[k] = make([]int, m+1)
+	}
+	for a := n - 1; a >= 0; a-- {
+		for b := m - 1; b >= 0; b-- {
+			if commonExpected[a] == commonLive[b] {
+				lcs[a][b] = lcs[a+1][b+1] + 1
+			} else if lcs[a+1][b] >= lcs[a][b+1] {
+				lcs[a][b] = lcs[a+1][b]
+			} else {
+				lcs[a][b] = lcs[a][b+1]
+			}
+		}
+	}
+
+	inOrder := make(map[string]int)
+	for a, b := 0, 0; a < n && b < m; {
+		switch {
+		case commonExpected[a] == commonLive[b]:
+			inOrder[commonExpected[a]]++
+			a++
+			b++
+		case lcs[a+1][b] >= lcs[a][b+1]:
+			a++
+		default:
+			b++
+		}
+	}
+
+	for _, key := range commonLive {
+		if inOrder[key] > 0 {
+			inOrder[key]--
+			continue
+		}
+		drift.Reordered = append(drift.Reordered, splitIptablesArgs(key))
+	}
+
+	return drift
+}
+
+type IptablesRuleCounter struct {
+	IptablesRule
+	Packets uint64
+	Bytes   uint64
+}
+
+// ParseIptablesSaveCounters returns the rules of iptables-save -c output with their counters
+func ParseIptablesSaveCounters(proto IpProto, data []byte) ([]IptablesRuleCounter, error) {
+	counters := make([]IptablesRuleCounter, 0)
+
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, "["):
+			end := strings.Index(line, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: invalid counters %q", lineNo, line)
+			}
+
+			var packets, bytes uint64
+			if _, err := fmt.Sscanf(line[1:end], "%d:%d", &packets, &bytes); err != nil {
+				return nil, fmt.Errorf("line %d: invalid counters %q", lineNo, line)
+			}
+
+			rule, ok := parseIptablesRuleLine(strings.TrimSpace(line[end+1:]))
+			if !ok {
+				continue
+			}
+			rule.Proto, rule.Table = proto, table
+			counters = append(counters, IptablesRuleCounter{IptablesRule: rule, Packets: packets, Bytes: bytes})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return counters, nil
+}
+
+// RuleCounters returns the packet and byte counters of every rule in tables, or in every
+// table if none is given.
+func (i *IptablesCtx) RuleCounters(proto IpProto, tables ...string) ([]IptablesRuleCounter, error) {
+	if len(tables) == 0 {
+		tables = iptablesTables
+	}
+
+	if nft, ok := i.getIpt(proto).(*NftablesBackend); ok {
+		counters := make([]IptablesRuleCounter, 0)
+		for _, table := range tables {
+			c, err := nft.RuleCounters(table)
+			if err != nil {
+				logger.Errorf("nftables RuleCounters() %s table %s failed! reason:%s", proto, table, err)
+				return nil, err
+			}
+			counters = append(counters, c...)
+		}
+		return counters, nil
+	}
+
+	counters := make([]IptablesRuleCounter, 0)
+	for _, table := range tables {
+		out, err := exec.Command(iptablesSaveCommand(proto, false), "-c", "-t", table).Output()
+		if err != nil {
+			// the table module is not loaded
+			continue
+		}
+
+		c, err := ParseIptablesSaveCounters(proto, out)
+		if err != nil {
+			logger.Errorf("ParseIptablesSaveCounters() %s table %s failed! reason:%s", proto, table, err)
+			return nil, err
+		}
+		counters = append(counters, c...)
+	}
+
+	return counters, nil
+}
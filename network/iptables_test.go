@@ -0,0 +1,356 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestNftRuleExprs(t *testing.T) {
+
+	specs := []string{"-p", "udp", "-m", "multiport", "--dports", "100,200,300", "-s", "10.0.0.0/8", "-j", "ACCEPT"}
+	exprs, sets, err := nftRuleExprs(nftables.TableFamilyIPv4, specs, nil)
+	if err != nil {
+		t.Fatalf("nftRuleExprs failed: %s", err)
+	}
+
+	if len(sets) != 1 || len(sets[0].elements) != 3 {
+		t.Fatalf("expect one anonymous set with 3 ports, got %+v", sets)
+	}
+
+	// meta+cmp, payload+lookup, payload+bitwise+cmp, counter, verdict
+	if len(exprs) != 9 {
+		t.Fatalf("expect 9 expressions, got %d", len(exprs))
+	}
+
+	if _, _, err := nftRuleExprs(nftables.TableFamilyIPv4, []string{"--dport", "80", "-j", "ACCEPT"}, nil); err == nil {
+		t.Fatalf("port match without protocol should fail")
+	}
+
+	// target options and matches may follow the target, as owner comments do
+	specs2 := []string{"-p", "tcp", "-j", "REDIRECT", "--to-ports", "8080", "-m", "comment", "--comment", "owner:agent"}
+	if exprs, _, err := nftRuleExprs(nftables.TableFamilyIPv4, specs2, nil); err != nil || len(exprs) != 5 {
+		t.Fatalf("expect 5 expressions, got %d %v", len(exprs), err)
+	}
+
+	for _, bad := range [][]string{
+		{"-j", "ACCEPT", "--to-ports", "80"},
+		{"-j", "LOG", "--log-level", "4"},
+		{"-j", "ACCEPT", "-j", "DROP"},
+		{"-j", "REJECT", "--reject-with", "icmp-host-prohibited"},
+	} {
+		if _, _, err := nftRuleExprs(nftables.TableFamilyIPv4, bad, nil); err == nil {
+			t.Fatalf("expect an error for %q", bad)
+		}
+	}
+
+	if exprs, _, err := nftRuleExprs(nftables.TableFamilyIPv4, chainMarkerSpecs("agent"), nil); err != nil || len(exprs) != 0 {
+		t.Fatalf("chain marker got %d expressions %v", len(exprs), err)
+	}
+
+	comment := nftRuleCommentPrefix + joinIptablesArgs(specs)
+	if got := nftRuleComment(nftMarshalRuleComment(comment)); got != comment {
+		t.Fatalf("rule comment round trip got %q", got)
+	}
+}
+
+func TestNftForeignRules(t *testing.T) {
+
+	translate := func(specs ...string) []expr.Any {
+		exprs, _, err := nftRuleExprs(nftables.TableFamilyIPv4, specs, nil)
+		if err != nil {
+			t.Fatalf("nftRuleExprs(%q) failed: %s", specs, err)
+		}
+		return exprs
+	}
+
+	// iptables-nft orders the matches its own way
+	ours := translate("-p", "tcp", "--dport", "22", "-s", "10.0.0.0/8", "-i", "eth+", "-j", "ACCEPT")
+	theirs := translate("-i", "eth+", "-s", "10.0.0.0/8", "-p", "tcp", "--dport", "22", "-j", "ACCEPT")
+	if !nftExprsEqual(ours, theirs) {
+		t.Fatal("same matches in another order are not equal")
+	}
+	if nftExprsEqual(ours, translate("-p", "tcp", "--dport", "22", "-s", "10.0.0.0/8", "-i", "eth+", "-j", "DROP")) {
+		t.Fatal("rules with different targets are equal")
+	}
+	if nftExprsEqual(ours, translate("-p", "tcp", "--dport", "22", "-i", "eth+", "-j", "ACCEPT")) {
+		t.Fatal("rules with different matches are equal")
+	}
+	multiport := translate("-p", "udp", "-m", "multiport", "--dports", "1,2", "-j", "ACCEPT")
+	if nftExprsEqual(multiport, multiport) {
+		t.Fatal("anonymous set contents can not be compared")
+	}
+
+	for _, tc := range []struct {
+		specs []string
+		want  string
+	}{
+		{[]string{"-s", "10.0.0.0/8", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"}, "-s 10.0.0.0/8 -p tcp -m tcp --dport 22 -m comment --comment owner:agent -j ACCEPT"},
+		{[]string{"!", "-d", "192.168.1.1", "-o", "eth0", "-j", "MASQUERADE"}, "! -d 192.168.1.1/32 -o eth0 -m comment --comment owner:agent -j MASQUERADE"},
+		{[]string{"-i", "veth+", "-p", "udp", "!", "--sport", "1000:2000", "-g", "OTHER"}, "-i veth+ -p udp -m udp ! --sport 1000:2000 -m comment --comment owner:agent -g OTHER"},
+	} {
+		specs, ok := nftRuleSpecs(nftables.TableFamilyIPv4, translate(tc.specs...), "owner:agent")
+		if got := joinIptablesArgs(specs); !ok || got != tc.want {
+			t.Errorf("nftRuleSpecs(%q) = %q %v, want %q", tc.specs, got, ok, tc.want)
+		}
+	}
+
+	if _, ok := nftRuleSpecs(nftables.TableFamilyIPv4, translate("-m", "addrtype", "--dst-type", "LOCAL", "-j", "ACCEPT"), ""); ok {
+		t.Fatal("unsupported match translated back")
+	}
+}
+
+func TestIptablesSnapshotDrift(t *testing.T) {
+
+	saved := `# Generated by iptables-save
+*filter
+:INPUT ACCEPT [10:200]
+:hellochain - [0:0]
+-A INPUT -j hellochain
+-A hellochain -p udp -m comment --comment "owner:my agent" -j ACCEPT
+-A hellochain -p tcp --dport 22 -j ACCEPT
+-A hellochain -p tcp --dport 80 -j ACCEPT
+COMMIT
+`
+	expected, err := ParseIptablesSave(IpProtoV4, []byte(saved))
+	if err != nil {
+		t.Fatalf("ParseIptablesSave failed: %s", err)
+	}
+
+	again, err := ParseIptablesSave(IpProtoV4, []byte(expected.String()))
+	if err != nil || !reflect.DeepEqual(again, expected) {
+		t.Fatalf("render/parse round trip failed: %v", err)
+	}
+
+	if drifts := CompareIptablesSnapshots(expected, again); len(drifts) != 0 {
+		t.Fatalf("expect no drift, got %+v", drifts)
+	}
+
+	chain := again.Table("filter").Chain("hellochain")
+	chain.Rules = [][]string{chain.Rules[2], chain.Rules[0], chain.Rules[1], {"-j", "DROP"}}
+	again.Table("filter").Chain("INPUT").Rules = nil
+
+	drifts := CompareIptablesSnapshots(expected, again)
+	if len(drifts) != 2 {
+		t.Fatalf("expect 2 drifted chains, got %+v", drifts)
+	}
+
+	if d := drifts[0]; d.Chain != "INPUT" || len(d.Missing) != 1 || len(d.Added) != 0 {
+		t.Fatalf("unexpected INPUT drift %+v", d)
+	}
+
+	d := drifts[1]
+	if len(d.Added) != 1 || len(d.Missing) != 0 || len(d.Reordered) != 1 || d.Reordered[0][3] != "80" {
+		t.Fatalf("unexpected hellochain drift %+v", d)
+	}
+}
+
+func TestIptablesRestoreNoflush(t *testing.T) {
+
+	// iptables-save prints the live rules, iptables-restore logs its arguments and input
+	dir := t.TempDir()
+	live := `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:hellochain - [0:0]
+-A INPUT -j hellochain
+-A hellochain -p tcp --dport 22 -j ACCEPT
+COMMIT
+`
+	for name, script := range map[string]string{
+		"iptables-save":    "#!/bin/sh\ncat <<'EOF'\n" + live + "EOF\n",
+		"iptables-restore": "#!/bin/sh\necho \"$*\" >> " + filepath.Join(dir, "log") + "\ncat >> " + filepath.Join(dir, "log") + "\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	snapshot, err := ParseIptablesSave(IpProtoV4, []byte(`*filter
+:INPUT DROP [0:0]
+:FORWARD ACCEPT [0:0]
+:hellochain - [0:0]
+:newchain - [0:0]
+-A INPUT -j hellochain
+-A hellochain -p tcp --dport 22 -j ACCEPT
+-A hellochain -p tcp --dport 80 -j ACCEPT
+-A newchain -j DROP
+COMMIT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := newFakeIptablesCtx("", newFakeIptables())
+	if err := i.Restore(IpProtoV4, snapshot, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// existing chains are not declared, which would flush them and reset the policies, and
+	// the rules already there are not added twice
+	want := `--noflush --wait
+*filter
+:newchain - [0:0]
+-A hellochain -p tcp --dport 80 -j ACCEPT
+-A newchain -j DROP
+COMMIT
+`
+	content, _ := os.ReadFile(filepath.Join(dir, "log"))
+	if string(content) != want {
+		t.Fatalf("got restore input\n%s\nwant\n%s", content, want)
+	}
+
+	// nothing to add, iptables-restore is not run
+	os.Remove(filepath.Join(dir, "log"))
+	liveSnapshot, _ := ParseIptablesSave(IpProtoV4, []byte(live))
+	if err := i.Restore(IpProtoV4, liveSnapshot, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "log")); !os.IsNotExist(err) {
+		t.Fatal("iptables-restore run without any missing rule")
+	}
+
+	if err := i.Restore(IpProtoV4, snapshot, true); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "log")); string(content) != "--wait\n"+snapshot.String() {
+		t.Fatalf("got flush restore input\n%s", content)
+	}
+}
+
+func TestParseIptablesSaveCounters(t *testing.T) {
+
+	saved := `*filter
+:INPUT ACCEPT [10:200]
+[5:300] -A INPUT -p tcp --dport 22 -j ACCEPT
+[0:0] -A INPUT -m comment --comment "owner:my agent" -j DROP
+COMMIT
+`
+	counters, err := ParseIptablesSaveCounters(IpProtoV4, []byte(saved))
+	if err != nil {
+		t.Fatalf("ParseIptablesSaveCounters failed: %s", err)
+	}
+
+	if len(counters) != 2 || counters[0].Packets != 5 || counters[0].Bytes != 300 || counters[0].Table != "filter" {
+		t.Fatalf("unexpected counters %+v", counters)
+	}
+
+	if counters[1].Owner() != "my agent" {
+		t.Fatalf("unexpected rule %+v", counters[1].IptablesRule)
+	}
+}
+
+func TestIsIptablesBusy(t *testing.T) {
+
+	err := exec.Command("sh", "-c", "exit 4").Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		busy bool
+	}{
+		{&iptables.Error{ExitError: *exitErr}, true},
+		{errors.New("iptables: Resource temporarily unavailable."), true},
+		{errors.New("Another app is currently holding the xtables lock. Stopped waiting after 5s."), true},
+		{errors.New("iptables: Bad rule (does a matching rule exist in that chain?)."), false},
+		{errors.New("iptables: No chain/target/match by that name."), false},
+	} {
+		if got := isIptablesBusy(tc.err); got != tc.busy {
+			t.Errorf("isIptablesBusy(%q) = %v", tc.err, got)
+		}
+	}
+}
+
+func TestIptablesRetry(t *testing.T) {
+
+	i := newFakeIptablesCtx("", newFakeIptables())
+	i.opts.Retries = 2
+
+	calls := 0
+	busy := errors.New("iptables: Resource temporarily unavailable.")
+	if err := i.retry(func() error { calls++; return busy }); err != busy || calls != 3 {
+		t.Fatalf("busy op got %v after %d calls, want 3", err, calls)
+	}
+
+	calls = 0
+	if err := i.retry(func() error {
+		calls++
+		if calls < 3 {
+			return busy
+		}
+		return nil
+	}); err != nil || calls != 3 {
+		t.Fatalf("op busy twice got %v after %d calls", err, calls)
+	}
+
+	// other errors are not retried
+	calls = 0
+	if err := i.retry(func() error { calls++; return fmt.Errorf("bad rule") }); err == nil || calls != 1 {
+		t.Fatalf("failing op got %v after %d calls", err, calls)
+	}
+
+	// through the ctx, a backend busy for two calls
+	f := newFakeIptables()
+	i = newFakeIptablesCtx("", f)
+	f.busy = 2
+	if err := i.EnsureRuleAppended(IpProtoV4, "filter", "INPUT", "-j", "ACCEPT"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ := f.List("filter", "INPUT"); len(rules) != 2 {
+		t.Fatalf("unexpected rules %q", rules)
+	}
+}
+
+func TestIptablesConcurrentEnsure(t *testing.T) {
+
+	f := newFakeIptables()
+	f.delay = 5 * time.Millisecond
+	i := newFakeIptablesCtx("agent", f)
+
+	// without the table lock every goroutine sees the rule missing and appends it
+	var wg sync.WaitGroup
+	for k := 0; k < 8; k++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			i.EnsureChain(IpProtoV4, "filter", "AGENT")
+			i.EnsureRuleAppended(IpProtoV4, "filter", "AGENT", "-j", "ACCEPT")
+		}()
+		go func() {
+			defer wg.Done()
+			i.EnsureRuleInserted(IpProtoV4, "nat", "POSTROUTING", "-j", "MASQUERADE")
+		}()
+	}
+	wg.Wait()
+
+	// the owner marker and the rule
+	if rules, _ := f.List("filter", "AGENT"); len(rules) != 3 {
+		t.Fatalf("unexpected filter rules %q", rules)
+	}
+	if rules, _ := f.List("nat", "POSTROUTING"); len(rules) != 2 {
+		t.Fatalf("unexpected nat rules %q", rules)
+	}
+}
+
+func TestLockWaitSeconds(t *testing.T) {
+
+	for wait, want := range map[time.Duration]int{0: 0, time.Millisecond: 1, time.Second: 1, 1500 * time.Millisecond: 2} {
+		if got := lockWaitSeconds(wait); got != want {
+			t.Errorf("lockWaitSeconds(%s) = %d, want %d", wait, got, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package network
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+type NetworkCollectorOptions struct {
+	// named network namespaces under /var/run/netns to collect besides the current one,
+	// the current namespace is labelled netns=""
+	Namespaces []string
+	// collect per rule iptables counters of every namespace through Iptables, nil disables.
+	// Named namespaces are read by running iptables-save in them, they are skipped with the
+	// nftables backend whose netlink connection stays in the current namespace.
+	Iptables *IptablesCtx
+	// iptables tables to collect, default every table
+	IptablesTables []string
+}
+
+// NetworkCollector is a prometheus.Collector of nic counters, link state, address counts,
+// default gateway presence and iptables rule counters.
+type NetworkCollector struct {
+	opts NetworkCollectorOptions
+
+	nicRxBytes   *prometheus.Desc
+	nicTxBytes   *prometheus.Desc
+	nicRxPackets *prometheus.Desc
+	nicTxPackets *prometheus.Desc
+	nicRxErrors  *prometheus.Desc
+	nicTxErrors  *prometheus.Desc
+	nicRxDropped *prometheus.Desc
+	nicTxDropped *prometheus.Desc
+	nicUp        *prometheus.Desc
+	nicAddresses *prometheus.Desc
+	gateway      *prometheus.Desc
+	rulePackets  *prometheus.Desc
+	ruleBytes    *prometheus.Desc
+	scrapeError  *prometheus.Desc
+}
+
+func NewNetworkCollector(opts NetworkCollectorOptions) *NetworkCollector {
+	nicLabels := []string{"netns", "nic"}
+	ruleLabels := []string{"netns", "proto", "table", "chain", "rule"}
+
+	return &NetworkCollector{
+		opts:         opts,
+		nicRxBytes:   prometheus.NewDesc("gokit_nic_rx_bytes_total", "Bytes received by the nic.", nicLabels, nil),
+		nicTxBytes:   prometheus.NewDesc("gokit_nic_tx_bytes_total", "Bytes sent by the nic.", nicLabels, nil),
+		nicRxPackets: prometheus.NewDesc("gokit_nic_rx_packets_total", "Packets received by the nic.", nicLabels, nil),
+		nicTxPackets: prometheus.NewDesc("gokit_nic_tx_packets_total", "Packets sent by the nic.", nicLabels, nil),
+		nicRxErrors:  prometheus.NewDesc("gokit_nic_rx_errors_total", "Receive errors of the nic.", nicLabels, nil),
+		nicTxErrors:  prometheus.NewDesc("gokit_nic_tx_errors_total", "Transmit errors of the nic.", nicLabels, nil),
+		nicRxDropped: prometheus.NewDesc("gokit_nic_rx_dropped_total", "Received packets dropped by the nic.", nicLabels, nil),
+		nicTxDropped: prometheus.NewDesc("gokit_nic_tx_dropped_total", "Transmitted packets dropped by the nic.", nicLabels, nil),
+		nicUp:        prometheus.NewDesc("gokit_nic_up", "Whether the operational state of the nic is up.", nicLabels, nil),
+		nicAddresses: prometheus.NewDesc("gokit_nic_addresses", "Number of addresses of the nic.", []string{"netns", "nic", "family"}, nil),
+		gateway:      prometheus.NewDesc("gokit_default_gateway", "Whether the main routing table has a default gateway.", []string{"netns", "family"}, nil),
+		rulePackets:  prometheus.NewDesc("gokit_iptables_rule_packets_total", "Packets matched by the iptables rule.", ruleLabels, nil),
+		ruleBytes:    prometheus.NewDesc("gokit_iptables_rule_bytes_total", "Bytes matched by the iptables rule.", ruleLabels, nil),
+		scrapeError:  prometheus.NewDesc("gokit_network_scrape_error", "Whether collecting the namespace failed.", []string{"netns"}, nil),
+	}
+}
+
+func (c *NetworkCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.nicRxBytes, c.nicTxBytes, c.nicRxPackets, c.nicTxPackets,
+		c.nicRxErrors, c.nicTxErrors, c.nicRxDropped, c.nicTxDropped, c.nicUp, c.nicAddresses,
+		c.gateway, c.rulePackets, c.ruleBytes, c.scrapeError} {
+		ch <- d
+	}
+}
+
+func (c *NetworkCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectNs(ch, "")
+	for _, name := range c.opts.Namespaces {
+		c.collectNs(ch, name)
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *NetworkCollector) collectNs(ch chan<- prometheus.Metric, name string) {
+	if c.opts.Iptables != nil {
+		c.collectIptables(ch, name)
+	}
+
+	if err := c.collectNsLinks(ch, name); err != nil {
+		logger.Errorf("collect network metrics of netns:%s failed! reason:%s", name, err)
+		ch <- prometheus.MustNewConstMetric(c.scrapeError, prometheus.GaugeValue, 1, name)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.scrapeError, prometheus.GaugeValue, 0, name)
+}
+
+func (c *NetworkCollector) collectNsLinks(ch chan<- prometheus.Metric, name string) error {
+	var handle *netlink.Handle
+	var err error
+
+	if name == "" {
+		handle, err = netlink.NewHandle()
+	} else {
+		var ns netns.NsHandle
+		if ns, err = netns.GetFromName(name); err != nil {
+			return err
+		}
+		defer ns.Close()
+		handle, err = netlink.NewHandleAt(ns)
+	}
+	if err != nil {
+		return err
+	}
+	defer handle.Delete()
+
+	links, err := handle.LinkList()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		attrs := link.Attrs()
+		nic := attrs.Name
+
+		if stats := attrs.Statistics; stats != nil {
+			for desc, value := range map[*prometheus.Desc]uint64{
+				c.nicRxBytes:   stats.RxBytes,
+				c.nicTxBytes:   stats.TxBytes,
+				c.nicRxPackets: stats.RxPackets,
+				c.nicTxPackets: stats.TxPackets,
+				c.nicRxErrors:  stats.RxErrors,
+				c.nicTxErrors:  stats.TxErrors,
+				c.nicRxDropped: stats.RxDropped,
+				c.nicTxDropped: stats.TxDropped,
+			} {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), name, nic)
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.nicUp, prometheus.GaugeValue, boolGauge(attrs.OperState == netlink.OperUp), name, nic)
+
+		for family, label := range map[int]string{netlink.FAMILY_V4: string(IpProtoV4), netlink.FAMILY_V6: string(IpProtoV6)} {
+			addrs, err := handle.AddrList(link, family)
+			if err != nil {
+				return err
+			}
+			ch <- prometheus.MustNewConstMetric(c.nicAddresses, prometheus.GaugeValue, float64(len(addrs)), name, nic, label)
+		}
+	}
+
+	for family, label := range map[int]string{netlink.FAMILY_V4: string(IpProtoV4), netlink.FAMILY_V6: string(IpProtoV6)} {
+		routes, err := handle.RouteList(nil, family)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, route := range routes {
+			if route.Table == 254 && route.Gw != nil && route.Dst == nil {
+				found = true
+				break
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.gateway, prometheus.GaugeValue, boolGauge(found), name, label)
+	}
+
+	return nil
+}
+
+func (c *NetworkCollector) collectIptables(ch chan<- prometheus.Metric, name string) {
+	ns := netns.None()
+	if name != "" {
+		if c.opts.Iptables.BackendKind() == IptablesBackendNftables {
+			return
+		}
+
+		var err error
+		if ns, err = netns.GetFromName(name); err != nil {
+			logger.Errorf("collect iptables rule counters of netns:%s failed! reason:%s", name, err)
+			return
+		}
+		defer ns.Close()
+	}
+
+	for _, proto := range []IpProto{IpProtoV4, IpProtoV6} {
+		var counters []IptablesRuleCounter
+		err := RunInNs(ns, func() error {
+			var err error
+			counters, err = c.opts.Iptables.RuleCounters(proto, c.opts.IptablesTables...)
+			return err
+		})
+		if err != nil {
+			logger.Errorf("collect iptables %s rule counters of netns:%s failed! reason:%s", proto, name, err)
+			continue
+		}
+
+		// identical rules in a chain would make duplicated series, sum them up
+		type ruleKey struct{ table, chain, rule string }
+		packets := make(map[ruleKey]uint64)
+		bytes := make(map[ruleKey]uint64)
+		keys := make([]ruleKey, 0)
+		for _, counter := range counters {
+			key := ruleKey{counter.Table, counter.Chain, strings.Join(counter.Specs, " ")}
+			if _, ok := packets[key]; !ok {
+				keys = append(keys, key)
+			}
+			packets[key] += counter.Packets
+			bytes[key] += counter.Bytes
+		}
+
+		for _, key := range keys {
+			ch <- prometheus.MustNewConstMetric(c.rulePackets, prometheus.CounterValue, float64(packets[key]), name, string(proto), key.table, key.chain, key.rule)
+			ch <- prometheus.MustNewConstMetric(c.ruleBytes, prometheus.CounterValue, float64(bytes[key]), name, string(proto), key.table, key.chain, key.rule)
+		}
+	}
+}
+
+// NewNetworkMetricsHandler returns an http.Handler serving the NetworkCollector metrics in
+// the prometheus text exposition format, e.g. http.Handle("/metrics", handler).
+func NewNetworkMetricsHandler(opts NetworkCollectorOptions) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewNetworkCollector(opts))
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: promLogger{}})
+}
+
+type promLogger struct{}
+
+func (promLogger) Println(v ...interface{}) {
+	logger.Errorf("prometheus: %s", fmt.Sprint(v...))
+}
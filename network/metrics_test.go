@@ -0,0 +1,84 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNetworkCollector(t *testing.T) {
+
+	// iptables-save -c prints the counters of the filter table only
+	dir := t.TempDir()
+	saved := `*filter
+:INPUT ACCEPT [0:0]
+[5:300] -A INPUT -p tcp --dport 22 -j ACCEPT
+[2:100] -A INPUT -p tcp --dport 22 -j ACCEPT
+COMMIT
+`
+	for name, script := range map[string]string{
+		"iptables-save":  "#!/bin/sh\n[ \"$3\" = filter ] || exit 1\ncat <<'EOF'\n" + saved + "EOF\n",
+		"ip6tables-save": "#!/bin/sh\nexit 1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewNetworkCollector(NetworkCollectorOptions{Iptables: newFakeIptablesCtx("", newFakeIptables())}))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := make(map[string][]map[string]string)
+	values := make(map[string][]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			l := make(map[string]string)
+			for _, pair := range m.GetLabel() {
+				l[pair.GetName()] = pair.GetValue()
+			}
+			labels[family.GetName()] = append(labels[family.GetName()], l)
+			values[family.GetName()] = append(values[family.GetName()], m.GetCounter().GetValue()+m.GetGauge().GetValue())
+		}
+	}
+
+	found := false
+	for _, l := range labels["gokit_nic_up"] {
+		if l["nic"] == "lo" && l["netns"] == "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no gokit_nic_up of lo in %v", labels["gokit_nic_up"])
+	}
+	for _, name := range []string{"gokit_nic_rx_bytes_total", "gokit_nic_addresses", "gokit_default_gateway"} {
+		if len(labels[name]) == 0 {
+			t.Errorf("no %s metric", name)
+		}
+	}
+	if l := labels["gokit_network_scrape_error"]; len(l) != 1 || values["gokit_network_scrape_error"][0] != 0 {
+		t.Errorf("unexpected scrape errors %v %v", l, values["gokit_network_scrape_error"])
+	}
+
+	// identical rules are summed up into one series
+	want := map[string]string{"netns": "", "proto": "ipv4", "table": "filter", "chain": "INPUT", "rule": "-p tcp --dport 22 -j ACCEPT"}
+	rules := labels["gokit_iptables_rule_packets_total"]
+	if len(rules) != 1 || len(rules[0]) != len(want) || values["gokit_iptables_rule_packets_total"][0] != 7 {
+		t.Fatalf("unexpected rule metrics %v %v", rules, values["gokit_iptables_rule_packets_total"])
+	}
+	for name, value := range want {
+		if rules[0][name] != value {
+			t.Errorf("rule label %s = %q, want %q", name, rules[0][name], value)
+		}
+	}
+	if v := values["gokit_iptables_rule_bytes_total"]; len(v) != 1 || v[0] != 400 {
+		t.Errorf("unexpected rule bytes %v", v)
+	}
+}
@@ -0,0 +1,389 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
+)
+
+type ProbeKind string
+
+const (
+	ProbeIcmp ProbeKind = "icmp"
+	// connect to Addr, a host:port
+	ProbeTcp ProbeKind = "tcp"
+	// ARP request for Addr on Device, for neighbors dropping ICMP
+	ProbeArp ProbeKind = "arp"
+	// datagram to Addr, a host:port, expecting any datagram back
+	ProbeUdp ProbeKind = "udp"
+	// query of Query to the dns server Addr
+	ProbeDns ProbeKind = "dns"
+	// GET of the url Addr, up if the status is below 500
+	ProbeHttp ProbeKind = "http"
+)
+
+type MonitorState string
+
+const (
+	MonitorStateUnknown MonitorState = "unknown"
+	MonitorStateUp      MonitorState = "up"
+	MonitorStateDown    MonitorState = "down"
+)
+
+type MonitorTarget struct {
+	// key of the target in events, default Kind:Addr
+	Name string
+	Kind ProbeKind
+	Addr string
+	// name to resolve for ProbeDns, default "."
+	Query string
+	// nic to probe through, required by ProbeArp
+	Device string
+	// namespace to probe from, 0 or netns.None() for the current one
+	Netns netns.NsHandle
+	// timeout of one probe, default the monitor interval
+	Timeout time.Duration
+	// ProbeIcmp through a raw socket, see PingOptions
+	Privileged bool
+}
+
+type MonitorEvent struct {
+	Target   string
+	State    MonitorState
+	Previous MonitorState
+	Time     time.Time
+	// error of the last probe for a down event
+	Err error
+}
+
+type MonitorOptions struct {
+	// delay between two probes of a target, default 1s
+	Interval time.Duration
+	// consecutive successes to declare a target up, default 2
+	Rise int
+	// consecutive failures to declare a target down, default 3
+	Fall int
+	// flap damping in the BGP way: each state change adds FlapPenalty (default 1000) to the
+	// target penalty, which decays by half every DampingHalfLife. Events are suppressed while
+	// the penalty is above SuppressLimit (default 2000) until it decays under ReuseLimit
+	// (default 750). A zero DampingHalfLife disables damping.
+	DampingHalfLife time.Duration
+	FlapPenalty     float64
+	SuppressLimit   float64
+	ReuseLimit      float64
+}
+
+type monitorTarget struct {
+	MonitorTarget
+	cancel context.CancelFunc
+
+	state     MonitorState
+	reported  MonitorState
+	successes int
+	failures  int
+	lastErr   error
+
+	penalty    float64
+	penaltyAt  time.Time
+	suppressed bool
+}
+
+// Monitor probes its targets continuously and calls the OnChange callbacks when a target
+// goes up or down.
+type Monitor struct {
+	opts MonitorOptions
+
+	mu        sync.Mutex
+	ctx       context.Context
+	targets   map[string]*monitorTarget
+	callbacks []func(MonitorEvent)
+	wg        sync.WaitGroup
+}
+
+func NewMonitor(opts MonitorOptions) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Rise <= 0 {
+		opts.Rise = 2
+	}
+	if opts.Fall <= 0 {
+		opts.Fall = 3
+	}
+	if opts.FlapPenalty <= 0 {
+		opts.FlapPenalty = 1000
+	}
+	if opts.SuppressLimit <= 0 {
+		opts.SuppressLimit = 2000
+	}
+	if opts.ReuseLimit <= 0 {
+		opts.ReuseLimit = 750
+	}
+
+	return &Monitor{opts: opts, targets: make(map[string]*monitorTarget)}
+}
+
+// NsGatewayTarget returns an ICMP target for the default gateway of ns
+func NsGatewayTarget(ns netns.NsHandle) (MonitorTarget, error) {
+	gw, err := GetNsDefaultGateway(ns)
+	if err != nil {
+		return MonitorTarget{}, err
+	}
+
+	return MonitorTarget{Name: "gateway", Kind: ProbeIcmp, Addr: gw, Netns: ns}, nil
+}
+
+// OnChange registers callback, it is called from the probing goroutine of the target
+func (m *Monitor) OnChange(callback func(MonitorEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.callbacks = append(m.callbacks, callback)
+}
+
+// AddTarget starts probing t, right away if the monitor is started
+func (m *Monitor) AddTarget(t MonitorTarget) error {
+	if t.Name == "" {
+		t.Name = string(t.Kind) + ":" + t.Addr
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = m.opts.Interval
+	}
+
+	switch t.Kind {
+	case ProbeIcmp, ProbeTcp, ProbeUdp, ProbeDns, ProbeHttp:
+	case ProbeArp:
+		if t.Device == "" {
+			return fmt.Errorf("arp target %s needs a device", t.Name)
+		}
+	default:
+		return fmt.Errorf("unsupported probe kind %q of target %s", t.Kind, t.Name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.targets[t.Name]; ok {
+		return fmt.Errorf("monitor target %s already exists", t.Name)
+	}
+
+	target := &monitorTarget{MonitorTarget: t, state: MonitorStateUnknown, reported: MonitorStateUnknown}
+	m.targets[t.Name] = target
+
+	if m.ctx != nil {
+		m.startTarget(target)
+	}
+
+	return nil
+}
+
+func (m *Monitor) RemoveTarget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if target, ok := m.targets[name]; ok {
+		if target.cancel != nil {
+			target.cancel()
+		}
+		delete(m.targets, name)
+	}
+}
+
+// State returns the reported state of target name, unknown until enough probes are done
+func (m *Monitor) State(name string) MonitorState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if target, ok := m.targets[name]; ok {
+		return target.reported
+	}
+	return MonitorStateUnknown
+}
+
+// Start probes every target until ctx is done or Stop is called
+func (m *Monitor) Start(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx != nil {
+		return
+	}
+
+	m.ctx = ctx
+	for _, target := range m.targets {
+		m.startTarget(target)
+	}
+}
+
+// Stop stops probing and waits for the probing goroutines to exit
+func (m *Monitor) Stop() {
+	m.mu.Lock()
+	for _, target := range m.targets {
+		if target.cancel != nil {
+			target.cancel()
+			target.cancel = nil
+		}
+	}
+	m.ctx = nil
+	m.mu.Unlock()
+
+	m.wg.Wait()
+}
+
+func (m *Monitor) startTarget(target *monitorTarget) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	target.cancel = cancel
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			err := probeTarget(target.MonitorTarget)
+			if ctx.Err() != nil {
+				return
+			}
+			m.update(target, err, time.Now())
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (t MonitorTarget) pingOptions() PingOptions {
+	return PingOptions{Count: 1, Timeout: t.Timeout, Device: t.Device, Netns: t.Netns, Privileged: t.Privileged}
+}
+
+func probeTarget(t MonitorTarget) error {
+	if t.Kind == ProbeArp {
+		_, _, err := NsArpProbe(t.Netns, t.Device, t.Addr, t.Timeout)
+		return err
+	}
+
+	opts := t.pingOptions()
+
+	var result *PingResult
+	var err error
+	switch t.Kind {
+	case ProbeIcmp:
+		result, err = PingWithOptions(t.Addr, opts)
+	case ProbeTcp:
+		result, err = TcpPing(t.Addr, opts)
+	case ProbeUdp:
+		result, err = UdpPing(t.Addr, opts)
+	case ProbeDns:
+		query := t.Query
+		if query == "" {
+			query = "."
+		}
+		result, err = DnsPing(t.Addr, query, opts)
+	case ProbeHttp:
+		result, err = HttpPing(t.Addr, false, opts)
+	default:
+		return fmt.Errorf("unsupported probe kind %q", t.Kind)
+	}
+
+	if err != nil {
+		return err
+	} else if result.Received == 0 {
+		if len(result.Packets) > 0 && result.Packets[0].Err != nil {
+			return result.Packets[0].Err
+		}
+		return fmt.Errorf("no reply from %s", t.Addr)
+	} else if t.Kind == ProbeHttp && result.Packets[0].Status >= 500 {
+		return fmt.Errorf("%s returned status %d", t.Addr, result.Packets[0].Status)
+	}
+
+	return nil
+}
+
+// update applies the result of a probe to the target state and fires the resulting event
+func (m *Monitor) update(target *monitorTarget, err error, now time.Time) {
+	m.mu.Lock()
+
+	target.lastErr = err
+	state := target.state
+	if err == nil {
+		target.successes, target.failures = target.successes+1, 0
+		if target.successes >= m.opts.Rise {
+			state = MonitorStateUp
+		}
+	} else {
+		target.successes, target.failures = 0, target.failures+1
+		if target.failures >= m.opts.Fall {
+			state = MonitorStateDown
+		}
+	}
+
+	if state != target.state {
+		if target.state != MonitorStateUnknown {
+			m.addPenalty(target, now)
+		}
+		target.state = state
+	}
+
+	var event *MonitorEvent
+	if !m.isSuppressed(target, now) && target.state != target.reported {
+		event = &MonitorEvent{Target: target.Name, State: target.state, Previous: target.reported, Time: now}
+		if target.state == MonitorStateDown {
+			event.Err = target.lastErr
+		}
+		target.reported = target.state
+	}
+
+	callbacks := append([]func(MonitorEvent){}, m.callbacks...)
+	m.mu.Unlock()
+
+	if event != nil {
+		logger.Infof("monitor target %s is %s", event.Target, event.State)
+		for _, callback := range callbacks {
+			callback(*event)
+		}
+	}
+}
+
+func (m *Monitor) decayPenalty(target *monitorTarget, now time.Time) {
+	if target.penalty > 0 && m.opts.DampingHalfLife > 0 {
+		elapsed := now.Sub(target.penaltyAt)
+		target.penalty *= math.Pow(0.5, float64(elapsed)/float64(m.opts.DampingHalfLife))
+	}
+	target.penaltyAt = now
+}
+
+func (m *Monitor) addPenalty(target *monitorTarget, now time.Time) {
+	if m.opts.DampingHalfLife <= 0 {
+		return
+	}
+
+	m.decayPenalty(target, now)
+	target.penalty += m.opts.FlapPenalty
+}
+
+func (m *Monitor) isSuppressed(target *monitorTarget, now time.Time) bool {
+	if m.opts.DampingHalfLife <= 0 {
+		return false
+	}
+
+	m.decayPenalty(target, now)
+	if !target.suppressed && target.penalty > m.opts.SuppressLimit {
+		logger.Infof("monitor target %s is flapping, suppressed", target.Name)
+		target.suppressed = true
+	} else if target.suppressed && target.penalty < m.opts.ReuseLimit {
+		logger.Infof("monitor target %s is stable again, reused", target.Name)
+		target.suppressed = false
+	}
+
+	return target.suppressed
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMonitorRiseFallDamping(t *testing.T) {
+
+	m := NewMonitor(MonitorOptions{Rise: 2, Fall: 2, DampingHalfLife: time.Minute})
+	if err := m.AddTarget(MonitorTarget{Name: "gw", Kind: ProbeIcmp, Addr: "10.0.0.1"}); err != nil {
+		t.Fatalf("AddTarget failed: %s", err)
+	}
+
+	events := make([]MonitorEvent, 0)
+	m.OnChange(func(e MonitorEvent) { events = append(events, e) })
+
+	target := m.targets["gw"]
+	now := time.Now()
+	probe := func(ok bool) {
+		now = now.Add(time.Second)
+		if ok {
+			m.update(target, nil, now)
+		} else {
+			m.update(target, errors.New("timeout"), now)
+		}
+	}
+
+	probe(true)
+	if len(events) != 0 || m.State("gw") != MonitorStateUnknown {
+		t.Fatalf("one success should not rise, got %+v", events)
+	}
+
+	probe(true)
+	probe(false)
+	probe(false)
+	if len(events) != 2 || events[0].State != MonitorStateUp || events[1].State != MonitorStateDown || events[1].Err == nil {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	// down->up->down->up within seconds goes over the suppress limit
+	for k := 0; k < 3; k++ {
+		probe(true)
+		probe(true)
+		probe(false)
+		probe(false)
+	}
+	// the last event before suppression is kept as reported state
+	if target.state != MonitorStateDown || !target.suppressed || m.State("gw") != MonitorStateUp {
+		t.Fatalf("flapping target should be suppressed, state %s events %+v", m.State("gw"), events)
+	}
+	suppressedEvents := len(events)
+
+	probe(true)
+	probe(true)
+	probe(false)
+	probe(false)
+	if len(events) != suppressedEvents {
+		t.Fatalf("suppressed target fired %+v", events[suppressedEvents:])
+	}
+
+	// the penalty decays below the reuse limit after a few half lives
+	now = now.Add(5 * time.Minute)
+	probe(false)
+	if m.State("gw") != MonitorStateDown || len(events) != suppressedEvents+1 {
+		t.Fatalf("reused target should be reported down, events %+v", events)
+	}
+}
+
+func TestMonitorTargetPingOptions(t *testing.T) {
+
+	target := MonitorTarget{Kind: ProbeIcmp, Addr: "10.0.0.1", Device: "eth0", Timeout: time.Second}
+	if opts := target.pingOptions(); opts.Privileged || opts.Count != 1 || opts.Device != "eth0" || opts.Timeout != time.Second {
+		t.Fatalf("unexpected ping options %+v", opts)
+	}
+
+	target.Privileged = true
+	if opts := target.pingOptions(); !opts.Privileged {
+		t.Fatalf("raw socket not requested %+v", opts)
+	}
+}
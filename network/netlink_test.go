@@ -6,10 +6,15 @@ import (
 
 func TestGetNicNetlinkIndex(t *testing.T) {
 
-	index := GetNicNetlinkIndex("ens33")
+	// loopback is the first nic of every namespace
+	index := GetNicNetlinkIndex("lo")
 
-	if index <= 0 {
-		t.Fatalf("get ens33 index:%d less than or equal 0", index)
+	if index != 1 {
+		t.Fatalf("get lo index:%d not equal 1", index)
+	}
+
+	if index := GetNicNetlinkIndex("gokit-nonexistent"); index != 0 {
+		t.Fatalf("get missing nic index:%d not equal 0", index)
 	}
 
 }
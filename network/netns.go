@@ -0,0 +1,76 @@
+package network
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
+)
+
+// isNsSet tells whether ns refers to a namespace, 0 and netns.None() mean the current one
+func isNsSet(ns netns.NsHandle) bool {
+	return ns > 0
+}
+
+// RunInNs runs fn with the calling thread switched to ns. Sockets opened by fn stay in ns
+// after it returns, which is how the Ns* probes reach into a namespace.
+func RunInNs(ns netns.NsHandle, fn func() error) error {
+	if !isNsSet(ns) {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		logger.Errorf("netns.Get() failed! reason:%s", err)
+		return err
+	}
+	defer origin.Close()
+
+	if err := netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		logger.Errorf("netns.Set() failed! reason:%s, ns:%d", err, ns)
+		return err
+	}
+
+	fnErr := fn()
+
+	if err := netns.Set(origin); err != nil {
+		// leave the thread locked, the runtime drops it when the goroutine exits
+		logger.Errorf("restore netns failed! reason:%s", err)
+		return err
+	}
+	runtime.UnlockOSThread()
+
+	return fnErr
+}
+
+// netnsDir is where ip netns add binds the named namespaces, as netns.GetFromName expects
+var netnsDir = "/var/run/netns"
+
+// ListNetns returns the sorted names of the namespaces under /var/run/netns
+func ListNetns() ([]string, error) {
+	entries, err := os.ReadDir(netnsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		logger.Errorf("list %s failed! reason:%s", netnsDir, err)
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/go-ping/ping"
 	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
 )
 
 type IpProto string
@@ -15,31 +15,38 @@ const (
 	IpProtoV6 IpProto = "ipv6"
 )
 
+// Ping sends 2 echo requests to dst from src and fails if none is answered within 2s,
+// see PingWithOptions for the statistics.
 func Ping(dst string, src string) error {
-	pinger, err := ping.NewPinger(dst)
-	if err != nil {
-		logger.Errorf("ping.NewPinger() failed! reason:%s", err)
-		return err
-	}
+	return pingCheck(dst, PingOptions{Source: src})
+}
 
-	pinger.Interval = time.Millisecond * 50
-	pinger.Count = 2
-	pinger.Timeout = time.Second * 2
-	pinger.Source = src
-	pinger.SetPrivileged(true)
+// NsPing is Ping from inside ns, src is looked up in ns
+func NsPing(ns netns.NsHandle, dst string, src string) error {
+	return pingCheck(dst, PingOptions{Source: src, Netns: ns})
+}
 
-	err = pinger.Run()
+// NsNicPing is Ping from inside ns through nic, whatever the routes of ns say
+func NsNicPing(ns netns.NsHandle, nic string, dst string) error {
+	return pingCheck(dst, PingOptions{Device: nic, Netns: ns})
+}
+
+func pingCheck(dst string, opts PingOptions) error {
+	opts.Count = 2
+	opts.Interval = time.Millisecond * 50
+	opts.Timeout = time.Second * 2
+	opts.Privileged = true
+
+	result, err := PingWithOptions(dst, opts)
 	if err != nil {
-		logger.Debugf("ping.Run() failed! reason:%s", err)
+		logger.Debugf("PingWithOptions() failed! reason:%s", err)
 		return err
 	}
 
-	stats := pinger.Statistics()
-
-	if stats.PacketsRecv > 0 {
+	if result.Received > 0 {
 		return nil
 	} else {
-		logger.Debug("ping", dst, "failed with src", src)
+		logger.Debug("ping", dst, "failed with src", opts.Source, "device", opts.Device)
 		return fmt.Errorf("none packets recieved!")
 	}
 }
@@ -0,0 +1,317 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netlink"
+)
+
+// NicCounters is the IFLA_STATS64 counters of a nic
+type NicCounters struct {
+	RxBytes   uint64
+	TxBytes   uint64
+	RxPackets uint64
+	TxPackets uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	RxDropped uint64
+	TxDropped uint64
+	Multicast uint64
+}
+
+type NicStatsSample struct {
+	Time     time.Time
+	Counters NicCounters
+	// driver specific counters of ethtool -S, nil unless NicStatsOptions.Ethtool is set
+	Ethtool map[string]uint64
+}
+
+// NicRates is computed from two samples, bytes are converted to bits per second and the
+// other rates are per second too.
+type NicRates struct {
+	Interval    time.Duration
+	RxBps       float64
+	TxBps       float64
+	RxPps       float64
+	TxPps       float64
+	RxDropRate  float64
+	TxDropRate  float64
+	RxErrorRate float64
+	TxErrorRate float64
+}
+
+type NicThresholdKind string
+
+const (
+	// drops per second, rx plus tx, above the limit
+	NicThresholdDropRate NicThresholdKind = "drop_rate"
+	// errors per second, rx plus tx, above the limit
+	NicThresholdErrorRate NicThresholdKind = "error_rate"
+	// rx bps falling below limit times the previous rx bps, e.g. 0.5 for a sudden drop by half
+	NicThresholdRxBpsFall NicThresholdKind = "rx_bps_fall"
+)
+
+type NicThresholdEvent struct {
+	Nic   string
+	Kind  NicThresholdKind
+	Limit float64
+	Value float64
+	Rates NicRates
+}
+
+type NicStatsOptions struct {
+	// sample interval of Run, default 1s
+	Interval time.Duration
+	// number of samples kept, default 60
+	History int
+	// also collect the driver specific ethtool counters
+	Ethtool bool
+}
+
+type nicThreshold struct {
+	kind     NicThresholdKind
+	limit    float64
+	callback func(NicThresholdEvent)
+	// beyond the limit at the last sample, the callback fires again once back within it
+	beyond bool
+}
+
+// NicStatsCollector samples the counters of a nic and keeps the recent samples in a ring buffer
+type NicStatsCollector struct {
+	nic  string
+	opts NicStatsOptions
+	eth  *Ethtool
+
+	mu         sync.Mutex
+	samples    []NicStatsSample
+	next       int
+	count      int
+	thresholds []nicThreshold
+	lastRates  *NicRates
+}
+
+func NewNicStatsCollector(nic string, opts NicStatsOptions) (*NicStatsCollector, error) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.History < 2 {
+		opts.History = 60
+	}
+
+	c := &NicStatsCollector{
+		nic:     nic,
+		opts:    opts,
+		samples: make([]NicStatsSample, opts.History),
+	}
+
+	if opts.Ethtool {
+		eth, err := NewEthtool()
+		if err != nil {
+			return nil, err
+		}
+		c.eth = eth
+	}
+
+	return c, nil
+}
+
+// Close releases the ethtool handle of the collector
+func (c *NicStatsCollector) Close() {
+	if c.eth != nil {
+		c.eth.Close()
+	}
+}
+
+func (c *NicStatsCollector) Nic() string {
+	return c.nic
+}
+
+// OnThreshold registers callback to be called from Sample when kind goes beyond limit. It
+// fires once per crossing, not on every sample while the rate stays beyond the limit, and is
+// re-armed when the rate gets back within it.
+func (c *NicStatsCollector) OnThreshold(kind NicThresholdKind, limit float64, callback func(NicThresholdEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.thresholds = append(c.thresholds, nicThreshold{kind: kind, limit: limit, callback: callback})
+}
+
+// GetNicCounters reads the IFLA_STATS64 counters of nic
+func GetNicCounters(nic string) (NicCounters, error) {
+	link, err := netlink.LinkByName(nic)
+	if err != nil {
+		logger.Errorf("netlink.LinkByName() for nic:%s failed! reason:%s", nic, err)
+		return NicCounters{}, err
+	}
+
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return NicCounters{}, fmt.Errorf("nic %s has no statistics", nic)
+	}
+
+	return NicCounters{
+		RxBytes:   stats.RxBytes,
+		TxBytes:   stats.TxBytes,
+		RxPackets: stats.RxPackets,
+		TxPackets: stats.TxPackets,
+		RxErrors:  stats.RxErrors,
+		TxErrors:  stats.TxErrors,
+		RxDropped: stats.RxDropped,
+		TxDropped: stats.TxDropped,
+		Multicast: stats.Multicast,
+	}, nil
+}
+
+// Sample takes one sample now, stores it and fires the thresholds crossed since the previous one
+func (c *NicStatsCollector) Sample() (NicStatsSample, error) {
+	counters, err := GetNicCounters(c.nic)
+	if err != nil {
+		return NicStatsSample{}, err
+	}
+
+	sample := NicStatsSample{Time: time.Now(), Counters: counters}
+	if c.eth != nil {
+		if sample.Ethtool, err = c.eth.Stats(c.nic); err != nil {
+			return NicStatsSample{}, err
+		}
+	}
+
+	c.add(sample)
+	return sample, nil
+}
+
+func (c *NicStatsCollector) add(sample NicStatsSample) {
+	c.mu.Lock()
+
+	var prev *NicStatsSample
+	if c.count > 0 {
+		p := c.samples[(c.next+len(c.samples)-1)%len(c.samples)]
+		prev = &p
+	}
+
+	c.samples[c.next] = sample
+	c.next = (c.next + 1) % len(c.samples)
+	if c.count < len(c.samples) {
+		c.count++
+	}
+
+	events := make([]NicThresholdEvent, 0)
+	callbacks := make([]func(NicThresholdEvent), 0)
+	if prev != nil {
+		rates := ComputeNicRates(*prev, sample)
+		for k := range c.thresholds {
+			th := &c.thresholds[k]
+			value, crossed := th.crossed(rates, c.lastRates)
+			if crossed && !th.beyond {
+				events = append(events, NicThresholdEvent{Nic: c.nic, Kind: th.kind, Limit: th.limit, Value: value, Rates: rates})
+				callbacks = append(callbacks, th.callback)
+			}
+			th.beyond = crossed
+		}
+		c.lastRates = &rates
+	}
+
+	c.mu.Unlock()
+
+	for k, callback := range callbacks {
+		callback(events[k])
+	}
+}
+
+func (th nicThreshold) crossed(rates NicRates, last *NicRates) (float64, bool) {
+	switch th.kind {
+	case NicThresholdDropRate:
+		value := rates.RxDropRate + rates.TxDropRate
+		return value, value > th.limit
+	case NicThresholdErrorRate:
+		value := rates.RxErrorRate + rates.TxErrorRate
+		return value, value > th.limit
+	case NicThresholdRxBpsFall:
+		if last == nil || last.RxBps <= 0 {
+			return 0, false
+		}
+		value := rates.RxBps / last.RxBps
+		return value, value < th.limit
+	}
+
+	return 0, false
+}
+
+// Samples returns the stored samples, oldest first
+func (c *NicStatsCollector) Samples() []NicStatsSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	samples := make([]NicStatsSample, 0, c.count)
+	for k := 0; k < c.count; k++ {
+		samples = append(samples, c.samples[(c.next-c.count+k+len(c.samples))%len(c.samples)])
+	}
+
+	return samples
+}
+
+// Rates returns the rates between the two latest samples, false if there are less than two
+func (c *NicStatsCollector) Rates() (NicRates, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lastRates == nil {
+		return NicRates{}, false
+	}
+
+	return *c.lastRates, true
+}
+
+// Run samples every Interval until ctx is done, sample errors are logged and skipped
+func (c *NicStatsCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := c.Sample(); err != nil {
+			logger.Errorf("sample nic:%s stats failed! reason:%s", c.nic, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// counterDelta treats a counter going backwards as reset, e.g. by a driver reload
+func counterDelta(prev uint64, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func ComputeNicRates(prev NicStatsSample, cur NicStatsSample) NicRates {
+	interval := cur.Time.Sub(prev.Time)
+	rates := NicRates{Interval: interval}
+	if interval <= 0 {
+		return rates
+	}
+
+	seconds := interval.Seconds()
+	rate := func(p uint64, c uint64) float64 {
+		return float64(counterDelta(p, c)) / seconds
+	}
+
+	rates.RxBps = rate(prev.Counters.RxBytes, cur.Counters.RxBytes) * 8
+	rates.TxBps = rate(prev.Counters.TxBytes, cur.Counters.TxBytes) * 8
+	rates.RxPps = rate(prev.Counters.RxPackets, cur.Counters.RxPackets)
+	rates.TxPps = rate(prev.Counters.TxPackets, cur.Counters.TxPackets)
+	rates.RxDropRate = rate(prev.Counters.RxDropped, cur.Counters.RxDropped)
+	rates.TxDropRate = rate(prev.Counters.TxDropped, cur.Counters.TxDropped)
+	rates.RxErrorRate = rate(prev.Counters.RxErrors, cur.Counters.RxErrors)
+	rates.TxErrorRate = rate(prev.Counters.TxErrors, cur.Counters.TxErrors)
+
+	return rates
+}
@@ -0,0 +1,67 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNicStatsCollectorRates(t *testing.T) {
+
+	c, err := NewNicStatsCollector("eth0", NicStatsOptions{History: 3})
+	if err != nil {
+		t.Fatalf("NewNicStatsCollector failed: %s", err)
+	}
+
+	events := make([]NicThresholdEvent, 0)
+	c.OnThreshold(NicThresholdDropRate, 5, func(e NicThresholdEvent) { events = append(events, e) })
+	c.OnThreshold(NicThresholdRxBpsFall, 0.5, func(e NicThresholdEvent) { events = append(events, e) })
+
+	now := time.Now()
+	c.add(NicStatsSample{Time: now, Counters: NicCounters{RxBytes: 1000, RxPackets: 10}})
+	c.add(NicStatsSample{Time: now.Add(time.Second), Counters: NicCounters{RxBytes: 2000, RxPackets: 20, RxDropped: 1}})
+
+	rates, ok := c.Rates()
+	if !ok || rates.RxBps != 8000 || rates.RxPps != 10 || rates.RxDropRate != 1 {
+		t.Fatalf("unexpected rates %+v", rates)
+	}
+
+	c.add(NicStatsSample{Time: now.Add(2 * time.Second), Counters: NicCounters{RxBytes: 2100, RxPackets: 21, RxDropped: 11}})
+	c.add(NicStatsSample{Time: now.Add(3 * time.Second), Counters: NicCounters{RxBytes: 100}})
+
+	if len(events) != 2 || events[0].Kind != NicThresholdDropRate || events[1].Kind != NicThresholdRxBpsFall {
+		t.Fatalf("unexpected threshold events %+v", events)
+	}
+
+	samples := c.Samples()
+	if len(samples) != 3 || !samples[0].Time.Equal(now.Add(time.Second)) {
+		t.Fatalf("unexpected samples %+v", samples)
+	}
+
+	// counters reset are not negative rates
+	if rates, _ := c.Rates(); rates.RxBps != 800 {
+		t.Fatalf("unexpected rates after reset %+v", rates)
+	}
+}
+
+func TestNicThresholdEdge(t *testing.T) {
+
+	c, err := NewNicStatsCollector("eth0", NicStatsOptions{History: 3})
+	if err != nil {
+		t.Fatalf("NewNicStatsCollector failed: %s", err)
+	}
+
+	fired := 0
+	c.OnThreshold(NicThresholdErrorRate, 5, func(e NicThresholdEvent) { fired++ })
+
+	// errors per second of each sample: a sustained spike, a calm one, then a new spike
+	now := time.Now()
+	var errors uint64
+	for k, rate := range []uint64{0, 10, 20, 10, 0, 10} {
+		errors += rate
+		c.add(NicStatsSample{Time: now.Add(time.Duration(k) * time.Second), Counters: NicCounters{RxErrors: errors}})
+	}
+
+	if fired != 2 {
+		t.Fatalf("threshold fired %d times, want once per crossing", fired)
+	}
+}
@@ -0,0 +1,504 @@
+package network
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+type PingOptions struct {
+	// number of echo requests, default 3
+	Count int
+	// delay between two echo requests, default 1s
+	Interval time.Duration
+	// deadline of the whole ping, default Count*Interval plus 1s
+	Timeout time.Duration
+	// timeout of one TCP, UDP, DNS or HTTP probe, default until Timeout
+	ProbeTimeout time.Duration
+	// payload size in bytes, default 56 as ping(8)
+	Size int
+	// 0 keeps the system default
+	TTL int
+	// set the DF bit, the request fails with EMSGSIZE if it does not fit the path mtu
+	DontFragment bool
+	// source address, or name of the interface to send through
+	Source string
+	// interface to send through with SO_BINDTODEVICE, e.g. a vlan or macvlan nic
+	Device string
+	// namespace to ping from, 0 or netns.None() for the current one
+	Netns netns.NsHandle
+	// use a raw socket, which needs CAP_NET_RAW, instead of an unprivileged ICMP datagram
+	// socket, which needs net.ipv4.ping_group_range to cover the process group.
+	Privileged bool
+	// resolve the destination to an ipv6 address, implied by an ipv6 literal
+	IPv6 bool
+}
+
+type PingPacket struct {
+	Seq      int
+	Sent     time.Time
+	Received bool
+	Rtt      time.Duration
+	// ttl or hop limit of the reply, -1 if not available
+	TTL   int
+	Bytes int
+	// why a TCP, UDP, DNS or HTTP probe failed
+	Err error
+	// HTTP status code, or DNS rcode
+	Status int
+	// set by HttpPing
+	Timing *HttpTiming
+}
+
+type PingResult struct {
+	Dst      string
+	Addr     net.IP
+	Sent     int
+	Received int
+	// duplicated replies, not counted in Received
+	Duplicates int
+	// percentage of packets without reply
+	Loss      float64
+	MinRtt    time.Duration
+	AvgRtt    time.Duration
+	MaxRtt    time.Duration
+	StdDevRtt time.Duration
+	Packets   []PingPacket
+}
+
+func (o PingOptions) withDefaults() PingOptions {
+	if o.Count <= 0 {
+		o.Count = 3
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Duration(o.Count)*o.Interval + time.Second
+	}
+	if o.Size <= 0 {
+		o.Size = 56
+	}
+	return o
+}
+
+func resolvePingAddr(dst string, v6 bool) (*net.IPAddr, error) {
+	network := "ip4"
+	if v6 || ipProtoOf(dst) == IpProtoV6 {
+		network = "ip6"
+	}
+
+	addr, err := net.ResolveIPAddr(network, dst)
+	if err != nil {
+		logger.Errorf("net.ResolveIPAddr() %s %s failed! reason:%s", network, dst, err)
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+type pingConn struct {
+	conn       net.PacketConn
+	v4         *ipv4.PacketConn
+	v6         *ipv6.PacketConn
+	privileged bool
+}
+
+// newPingConn opens an ICMP socket to addr configured after opts
+func newPingConn(addr *net.IPAddr, opts PingOptions) (*pingConn, error) {
+	v6 := addr.IP.To4() == nil
+
+	family, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	if v6 {
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+
+	sotype := unix.SOCK_DGRAM
+	if opts.Privileged {
+		sotype = unix.SOCK_RAW
+	}
+
+	fd := -1
+	err := RunInNs(opts.Netns, func() error {
+		var err error
+		if fd, err = unix.Socket(family, sotype|unix.SOCK_CLOEXEC, proto); err != nil {
+			logger.Errorf("open icmp socket failed! privileged:%t reason:%s", opts.Privileged, err)
+			return err
+		}
+
+		// devices and source addresses are looked up in the namespace of the socket
+		return setupPingSocket(fd, v6, opts)
+	})
+	if err != nil {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		logger.Errorf("net.FilePacketConn() failed! reason:%s", err)
+		return nil, err
+	}
+
+	c := &pingConn{conn: conn, privileged: opts.Privileged}
+	if v6 {
+		c.v6 = ipv6.NewPacketConn(conn)
+		c.v6.SetControlMessage(ipv6.FlagHopLimit, true)
+		if opts.TTL > 0 {
+			c.v6.SetHopLimit(opts.TTL)
+		}
+	} else {
+		c.v4 = ipv4.NewPacketConn(conn)
+		c.v4.SetControlMessage(ipv4.FlagTTL, true)
+		if opts.TTL > 0 {
+			c.v4.SetTTL(opts.TTL)
+		}
+	}
+
+	return c, nil
+}
+
+func setupPingSocket(fd int, v6 bool, opts PingOptions) error {
+	if opts.DontFragment {
+		var err error
+		if v6 {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		} else {
+			err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		}
+		if err != nil {
+			logger.Errorf("set icmp socket DF failed! reason:%s", err)
+			return err
+		}
+	}
+
+	if opts.Device != "" {
+		if err := unix.BindToDevice(fd, opts.Device); err != nil {
+			logger.Errorf("bind icmp socket to device %s failed! reason:%s", opts.Device, err)
+			return err
+		}
+	}
+
+	if opts.Source == "" {
+		return nil
+	}
+
+	if ip := net.ParseIP(opts.Source); ip != nil {
+		var sa unix.Sockaddr
+		if v6 {
+			sa6 := &unix.SockaddrInet6{}
+			copy(sa6.Addr[:], ip.To16())
+			sa = sa6
+		} else {
+			sa4 := &unix.SockaddrInet4{}
+			copy(sa4.Addr[:], ip.To4())
+			sa = sa4
+		}
+
+		if err := unix.Bind(fd, sa); err != nil {
+			logger.Errorf("bind icmp socket to %s failed! reason:%s", opts.Source, err)
+			return err
+		}
+		return nil
+	}
+
+	if err := unix.BindToDevice(fd, opts.Source); err != nil {
+		logger.Errorf("bind icmp socket to device %s failed! reason:%s", opts.Source, err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *pingConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *pingConn) send(addr *net.IPAddr, id int, seq int, payload []byte) error {
+	msg := icmp.Message{Code: 0, Body: &icmp.Echo{ID: id, Seq: seq, Data: payload}}
+	if c.v6 != nil {
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	} else {
+		msg.Type = ipv4.ICMPTypeEcho
+	}
+
+	// the kernel fills in the icmpv6 checksum
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	var dst net.Addr = addr
+	if !c.privileged {
+		dst = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+
+	_, err = c.conn.WriteTo(b, dst)
+	return err
+}
+
+type pingReply struct {
+	from  net.IP
+	id    int
+	seq   int
+	ttl   int
+	bytes int
+	at    time.Time
+}
+
+type icmpPacket struct {
+	msg   *icmp.Message
+	from  net.IP
+	ttl   int
+	bytes int
+	at    time.Time
+}
+
+// readMessage reads the next icmp message, whatever its type
+func (c *pingConn) readMessage(buf []byte) (icmpPacket, error) {
+	for {
+		var n int
+		var src net.Addr
+		var err error
+
+		pkt := icmpPacket{ttl: -1}
+		proto := 1
+		if c.v6 != nil {
+			var cm *ipv6.ControlMessage
+			n, cm, src, err = c.v6.ReadFrom(buf)
+			if cm != nil {
+				pkt.ttl = cm.HopLimit
+			}
+			proto = 58
+		} else {
+			var cm *ipv4.ControlMessage
+			n, cm, src, err = c.v4.ReadFrom(buf)
+			if cm != nil {
+				pkt.ttl = cm.TTL
+			}
+		}
+		if err != nil {
+			return icmpPacket{}, err
+		}
+		pkt.at, pkt.bytes = time.Now(), n
+
+		if pkt.msg, err = icmp.ParseMessage(proto, buf[:n]); err != nil {
+			continue
+		}
+
+		switch a := src.(type) {
+		case *net.IPAddr:
+			pkt.from = a.IP
+		case *net.UDPAddr:
+			pkt.from = a.IP
+		}
+
+		return pkt, nil
+	}
+}
+
+// receive reads the next echo reply, other icmp messages are skipped
+func (c *pingConn) receive(buf []byte) (pingReply, error) {
+	for {
+		pkt, err := c.readMessage(buf)
+		if err != nil {
+			return pingReply{}, err
+		}
+
+		if pkt.msg.Type != ipv4.ICMPTypeEchoReply && pkt.msg.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+
+		echo, ok := pkt.msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+
+		return pingReply{from: pkt.from, id: echo.ID, seq: echo.Seq, ttl: pkt.ttl, bytes: pkt.bytes, at: pkt.at}, nil
+	}
+}
+
+// PingWithOptions sends opts.Count echo requests to dst and waits for the replies until all
+// of them are received or opts.Timeout expires. An error is returned only if the ping could
+// not be run, a lossy ping is reported in the result.
+func PingWithOptions(dst string, opts PingOptions) (*PingResult, error) {
+	opts = opts.withDefaults()
+
+	addr, err := resolvePingAddr(dst, opts.IPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newPingConn(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return runPing(conn, dst, addr, opts)
+}
+
+func runPing(conn *pingConn, dst string, addr *net.IPAddr, opts PingOptions) (*PingResult, error) {
+	defer conn.Close()
+
+	deadline := time.Now().Add(opts.Timeout)
+	conn.conn.SetReadDeadline(deadline)
+
+	replies := make(chan pingReply, opts.Count)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			reply, err := conn.receive(buf)
+			if err != nil {
+				return
+			}
+
+			select {
+			case replies <- reply:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	result := &PingResult{Dst: dst, Addr: addr.IP, Packets: make([]PingPacket, 0, opts.Count)}
+	id := rand.Intn(0xffff)
+	payload := make([]byte, opts.Size)
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	sendNext := func() error {
+		seq := len(result.Packets)
+		result.Packets = append(result.Packets, PingPacket{Seq: seq, Sent: time.Now(), TTL: -1})
+		result.Sent++
+
+		if err := conn.send(addr, id, seq, payload); err != nil {
+			logger.Errorf("send echo request seq %d to %s failed! reason:%s", seq, dst, err)
+			return err
+		}
+		return nil
+	}
+
+	if err := sendNext(); err != nil {
+		return nil, err
+	}
+
+	for result.Sent < opts.Count || result.Received < result.Sent {
+		select {
+		case <-ticker.C:
+			if result.Sent < opts.Count {
+				// a send failure is a lost packet, e.g. EMSGSIZE with DF set
+				sendNext()
+			}
+		case reply := <-replies:
+			// unprivileged sockets only get their own replies, with the id rewritten by the kernel
+			if (conn.privileged && reply.id != id) || !reply.from.Equal(addr.IP) ||
+				reply.seq < 0 || reply.seq >= len(result.Packets) {
+				continue
+			}
+
+			p := &result.Packets[reply.seq]
+			if p.Received {
+				result.Duplicates++
+				continue
+			}
+
+			p.Received, p.Rtt, p.TTL, p.Bytes = true, reply.at.Sub(p.Sent), reply.ttl, reply.bytes
+			result.Received++
+		case <-timer.C:
+			result.computeStats()
+			return result, nil
+		}
+	}
+
+	result.computeStats()
+	return result, nil
+}
+
+func (r *PingResult) computeStats() {
+	if r.Sent > 0 {
+		r.Loss = float64(r.Sent-r.Received) * 100 / float64(r.Sent)
+	}
+
+	if r.Received == 0 {
+		return
+	}
+
+	var sum time.Duration
+	r.MinRtt = time.Duration(math.MaxInt64)
+	for _, p := range r.Packets {
+		if !p.Received {
+			continue
+		}
+		sum += p.Rtt
+		if p.Rtt < r.MinRtt {
+			r.MinRtt = p.Rtt
+		}
+		if p.Rtt > r.MaxRtt {
+			r.MaxRtt = p.Rtt
+		}
+	}
+	r.AvgRtt = sum / time.Duration(r.Received)
+
+	var variance float64
+	for _, p := range r.Packets {
+		if p.Received {
+			d := float64(p.Rtt - r.AvgRtt)
+			variance += d * d
+		}
+	}
+	r.StdDevRtt = time.Duration(math.Sqrt(variance / float64(r.Received)))
+}
+
+func (r *PingResult) String() string {
+	return fmt.Sprintf("%s (%s): %d sent, %d received, %.1f%% loss, rtt min/avg/max/stddev %s/%s/%s/%s",
+		r.Dst, r.Addr, r.Sent, r.Received, r.Loss, r.MinRtt, r.AvgRtt, r.MaxRtt, r.StdDevRtt)
+}
+
+// PingMany pings every dst with opts, at most parallel at a time (default 16). Results and
+// errors are in the order of dsts.
+func PingMany(dsts []string, opts PingOptions, parallel int) ([]*PingResult, []error) {
+	if parallel <= 0 {
+		parallel = 16
+	}
+
+	results := make([]*PingResult, len(dsts))
+	errs := make([]error, len(dsts))
+
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for k, dst := range dsts {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(k int, dst string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[k], errs[k] = PingWithOptions(dst, opts)
+		}(k, dst)
+	}
+	wg.Wait()
+
+	return results, errs
+}
@@ -0,0 +1,26 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingResultStats(t *testing.T) {
+
+	r := &PingResult{Sent: 4, Received: 3, Packets: []PingPacket{
+		{Seq: 0, Received: true, Rtt: 10 * time.Millisecond},
+		{Seq: 1},
+		{Seq: 2, Received: true, Rtt: 20 * time.Millisecond},
+		{Seq: 3, Received: true, Rtt: 30 * time.Millisecond},
+	}}
+	r.computeStats()
+
+	if r.Loss != 25 || r.MinRtt != 10*time.Millisecond || r.AvgRtt != 20*time.Millisecond || r.MaxRtt != 30*time.Millisecond {
+		t.Fatalf("unexpected stats %s", r)
+	}
+
+	// sqrt(200/3) ms
+	if r.StdDevRtt < 8164*time.Microsecond || r.StdDevRtt > 8165*time.Microsecond {
+		t.Fatalf("unexpected stddev %s", r.StdDevRtt)
+	}
+}
@@ -0,0 +1,330 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+)
+
+// HttpTiming is the timing breakdown of an HTTP probe, DNS is 0 for an address literal
+// and TLS is 0 for plain http.
+type HttpTiming struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+	Total     time.Duration
+}
+
+// probeAttempt is one TCP, UDP, DNS or HTTP probe, it fills in p and returns the peer address
+type probeAttempt func(ctx context.Context, p *PingPacket) (net.IP, error)
+
+// runProbes runs attempt opts.Count times, opts.Interval apart, and collects the results the
+// same way PingWithOptions does.
+func runProbes(dst string, opts PingOptions, attempt probeAttempt) *PingResult {
+	opts = opts.withDefaults()
+
+	result := &PingResult{Dst: dst, Packets: make([]PingPacket, 0, opts.Count)}
+	start := time.Now()
+	deadline := start.Add(opts.Timeout)
+
+	for seq := 0; seq < opts.Count && time.Now().Before(deadline); seq++ {
+		timeout := time.Until(deadline)
+		if opts.ProbeTimeout > 0 && opts.ProbeTimeout < timeout {
+			timeout = opts.ProbeTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		p := PingPacket{Seq: seq, Sent: time.Now(), TTL: -1}
+		addr, err := attempt(ctx, &p)
+		cancel()
+
+		if err != nil {
+			logger.Debugf("probe seq %d to %s failed! reason:%s", seq, dst, err)
+			p.Err = err
+		} else {
+			p.Received = true
+			if p.Rtt == 0 {
+				p.Rtt = time.Since(p.Sent)
+			}
+			result.Received++
+		}
+
+		if addr != nil {
+			result.Addr = addr
+		}
+		result.Packets = append(result.Packets, p)
+		result.Sent++
+
+		if seq+1 < opts.Count {
+			next := start.Add(time.Duration(seq+1) * opts.Interval)
+			if next.After(deadline) {
+				break
+			}
+			time.Sleep(time.Until(next))
+		}
+	}
+
+	result.computeStats()
+	return result
+}
+
+// probeDialer returns a dialer binding to the source address or device of opts
+func probeDialer(network string, opts PingOptions) *net.Dialer {
+	dialer := &net.Dialer{FallbackDelay: -1}
+
+	device := opts.Device
+	if ip := net.ParseIP(opts.Source); ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	} else if opts.Source != "" && device == "" {
+		device = opts.Source
+	}
+
+	if device != "" {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.BindToDevice(int(fd), device)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+
+	return dialer
+}
+
+// probeDial dials addr as configured by opts. The socket is created in opts.Netns, so the
+// dial is serial and stays on the thread switched to the namespace.
+func probeDial(ctx context.Context, network string, addr string, opts PingOptions) (net.Conn, error) {
+	if opts.IPv6 {
+		network += "6"
+	}
+
+	var conn net.Conn
+	err := RunInNs(opts.Netns, func() error {
+		var err error
+		conn, err = probeDialer(network, opts).DialContext(ctx, network, addr)
+		return err
+	})
+
+	return conn, err
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	switch a := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// TcpPing measures the time to connect to addr, a host:port, as a ping does with ICMP
+func TcpPing(addr string, opts PingOptions) (*PingResult, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		logger.Errorf("TcpPing() invalid address %s! reason:%s", addr, err)
+		return nil, err
+	}
+
+	return runProbes(addr, opts, func(ctx context.Context, p *PingPacket) (net.IP, error) {
+		conn, err := probeDial(ctx, "tcp", addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		p.Rtt = time.Since(p.Sent)
+
+		ip := remoteIP(conn)
+		conn.Close()
+		return ip, nil
+	}), nil
+}
+
+// UdpPing sends opts.Size bytes to addr, a host:port, and waits for any datagram back, as
+// from an echo service. An ICMP port unreachable fails the probe right away.
+func UdpPing(addr string, opts PingOptions) (*PingResult, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		logger.Errorf("UdpPing() invalid address %s! reason:%s", addr, err)
+		return nil, err
+	}
+
+	opts = opts.withDefaults()
+	payload := make([]byte, opts.Size)
+
+	return runProbes(addr, opts, func(ctx context.Context, p *PingPacket) (net.IP, error) {
+		conn, err := probeDial(ctx, "udp", addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		p.Sent = time.Now()
+		if _, err := conn.Write(payload); err != nil {
+			return remoteIP(conn), err
+		}
+
+		buf := make([]byte, 65536)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return remoteIP(conn), err
+		}
+		p.Rtt, p.Bytes = time.Since(p.Sent), n
+
+		return remoteIP(conn), nil
+	}), nil
+}
+
+// DnsPing queries server, a host or host:port, for the A record (AAAA with opts.IPv6) of name
+// over UDP. Any response counts as received, its rcode is in PingPacket.Status.
+func DnsPing(server string, name string, opts PingOptions) (*PingResult, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	qname, err := dnsmessage.NewName(dnsName(name))
+	if err != nil {
+		logger.Errorf("DnsPing() invalid name %s! reason:%s", name, err)
+		return nil, err
+	}
+
+	qtype := dnsmessage.TypeA
+	if opts.IPv6 {
+		qtype = dnsmessage.TypeAAAA
+	}
+
+	// the query goes over ipv4 or ipv6 after the server address, not after opts.IPv6
+	dialOpts := opts
+	dialOpts.IPv6 = false
+
+	return runProbes(server, opts, func(ctx context.Context, p *PingPacket) (net.IP, error) {
+		id := uint16(rand.Intn(0xffff))
+		query, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := probeDial(ctx, "udp", server, dialOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		p.Sent = time.Now()
+		if _, err := conn.Write(query); err != nil {
+			return remoteIP(conn), err
+		}
+
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return remoteIP(conn), err
+			}
+
+			var header dnsmessage.Header
+			var parser dnsmessage.Parser
+			if header, err = parser.Start(buf[:n]); err != nil || header.ID != id || !header.Response {
+				continue
+			}
+
+			p.Rtt, p.Bytes, p.Status = time.Since(p.Sent), n, int(header.RCode)
+			return remoteIP(conn), nil
+		}
+	}), nil
+}
+
+func dnsName(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		return name + "."
+	}
+	return name
+}
+
+// HttpPing GETs url, http or https, and reports the status code and timing breakdown of each
+// request in PingPacket.Status and PingPacket.Timing. Any response counts as received whatever
+// its status, TLS certificates are verified unless insecure is set.
+func HttpPing(url string, insecure bool, opts PingOptions) (*PingResult, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		logger.Errorf("HttpPing() invalid url %s! reason:%s", url, err)
+		return nil, err
+	}
+
+	return runProbes(url, opts, func(ctx context.Context, p *PingPacket) (net.IP, error) {
+		var peer net.IP
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := probeDial(ctx, "tcp", addr, opts)
+				if err == nil {
+					peer = remoteIP(conn)
+				}
+				return conn, err
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: insecure},
+			DisableKeepAlives: true,
+		}
+		defer transport.CloseIdleConnections()
+
+		timing := &HttpTiming{}
+		var dnsStart, connectStart, tlsStart time.Time
+		trace := &httptrace.ClientTrace{
+			DNSStart:             func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+			DNSDone:              func(httptrace.DNSDoneInfo) { timing.DNS = time.Since(dnsStart) },
+			ConnectStart:         func(string, string) { connectStart = time.Now() },
+			ConnectDone:          func(string, string, error) { timing.Connect = time.Since(connectStart) },
+			TLSHandshakeStart:    func() { tlsStart = time.Now() },
+			TLSHandshakeDone:     func(tls.ConnectionState, error) { timing.TLS = time.Since(tlsStart) },
+			GotFirstResponseByte: func() { timing.FirstByte = time.Since(p.Sent) },
+		}
+
+		p.Sent = time.Now()
+		resp, err := transport.RoundTrip(req.Clone(httptrace.WithClientTrace(ctx, trace)))
+		if err != nil {
+			return peer, err
+		}
+		defer resp.Body.Close()
+
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err != nil {
+			return peer, err
+		}
+
+		timing.Total = time.Since(p.Sent)
+		p.Rtt, p.Bytes, p.Status, p.Timing = timing.Total, int(n), resp.StatusCode, timing
+
+		return peer, nil
+	}), nil
+}
+
+func (t *HttpTiming) String() string {
+	return fmt.Sprintf("dns %s connect %s tls %s first byte %s total %s", t.DNS, t.Connect, t.TLS, t.FirstByte, t.Total)
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTcpUdpPing(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp failed: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	opts := PingOptions{Count: 2, Interval: 10 * time.Millisecond, Source: "127.0.0.1"}
+	result, err := TcpPing(l.Addr().String(), opts)
+	if err != nil || result.Received != 2 || !result.Addr.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected tcp ping result %v, err %v", result, err)
+	}
+
+	// nobody listens on the port, the icmp port unreachable fails the probes
+	u, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp failed: %s", err)
+	}
+	addr := u.LocalAddr().String()
+	u.Close()
+
+	result, err = UdpPing(addr, opts)
+	if err != nil || result.Sent != 2 || result.Received != 0 || result.Loss != 100 || result.Packets[0].Err == nil {
+		t.Fatalf("unexpected udp ping result %v, err %v", result, err)
+	}
+}
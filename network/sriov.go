@@ -0,0 +1,283 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/running910/gokit/logger"
+	"github.com/running910/gokit/misc"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+type VfLinkState string
+
+const (
+	// the vf link follows the link of the physical function
+	VfLinkStateAuto    VfLinkState = "auto"
+	VfLinkStateEnable  VfLinkState = "enable"
+	VfLinkStateDisable VfLinkState = "disable"
+)
+
+var vfLinkStates = map[VfLinkState]uint32{
+	VfLinkStateAuto:    nl.IFLA_VF_LINK_STATE_AUTO,
+	VfLinkStateEnable:  nl.IFLA_VF_LINK_STATE_ENABLE,
+	VfLinkStateDisable: nl.IFLA_VF_LINK_STATE_DISABLE,
+}
+
+// NicVf is a virtual function of a physical nic, the pci side comes from sysfs and the
+// settings from netlink on the physical nic
+type NicVf struct {
+	Index int
+	Slot  string
+	// driver of the vf, vfio-pci when it is passed to a vm or dpdk
+	Driver  string
+	Netdevs []string
+
+	Mac       net.HardwareAddr
+	Vlan      int
+	Qos       int
+	Spoofchk  bool
+	Trust     bool
+	LinkState VfLinkState
+	// rate limits in Mbps, 0 means unlimited
+	MinTxRate uint32
+	MaxTxRate uint32
+}
+
+func getNicPfSlot(nic string) (string, error) {
+	slot, err := misc.GetNicPciSlotId(nic)
+	if err != nil {
+		logger.Errorf("GetNicPciSlotId() nic %s failed! reason:%s", nic, err)
+		return "", err
+	}
+
+	return slot, nil
+}
+
+// GetNicSriovTotalVfs returns the number of vfs nic supports, 0 if it is not sr-iov capable
+func GetNicSriovTotalVfs(nic string) (int, error) {
+	slot, err := getNicPfSlot(nic)
+	if err != nil {
+		return 0, err
+	}
+
+	dev, err := misc.GetPciDevice(slot)
+	if err != nil {
+		return 0, err
+	}
+
+	return dev.SriovTotalVfs, nil
+}
+
+// GetNicSriovNumVfs returns the number of vfs enabled on nic
+func GetNicSriovNumVfs(nic string) (int, error) {
+	slot, err := getNicPfSlot(nic)
+	if err != nil {
+		return 0, err
+	}
+
+	dev, err := misc.GetPciDevice(slot)
+	if err != nil {
+		return 0, err
+	}
+
+	return dev.SriovNumVfs, nil
+}
+
+// SetNicSriovNumVfs enables numVfs vfs on nic, 0 removes them
+func SetNicSriovNumVfs(nic string, numVfs int) error {
+	slot, err := getNicPfSlot(nic)
+	if err != nil {
+		return err
+	}
+
+	if err := misc.SetPciDevSriovNumVfs(slot, numVfs); err != nil {
+		driver, _ := misc.GetNicDriver(nic)
+		logger.Errorf("set %d vfs on nic %s driver %s failed! reason:%s", numVfs, nic, driver, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListNicVfs returns the vfs of nic ordered by index
+func ListNicVfs(nic string) ([]NicVf, error) {
+	slot, err := getNicPfSlot(nic)
+	if err != nil {
+		return nil, err
+	}
+
+	devs, err := misc.ListPciDevVfs(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := netlink.LinkByName(nic)
+	if err != nil {
+		logger.Errorf("netlink.LinkByName() nic %s failed! reason:%s", nic, err)
+		return nil, err
+	}
+
+	trust, err := getNicVfTrust(link.Attrs().Index)
+	if err != nil {
+		logger.Errorf("get vf trust of nic %s failed! reason:%s", nic, err)
+		return nil, err
+	}
+
+	vfs := make([]NicVf, len(devs))
+	for i, dev := range devs {
+		vfs[i] = NicVf{Index: i, Slot: dev.Slot, Driver: dev.Driver, Netdevs: dev.Netdevs}
+	}
+
+	for _, info := range link.Attrs().Vfs {
+		if info.ID < 0 || info.ID >= len(vfs) {
+			continue
+		}
+
+		vf := &vfs[info.ID]
+		vf.Mac, vf.Vlan, vf.Qos, vf.Spoofchk = info.Mac, info.Vlan, info.Qos, info.Spoofchk
+		vf.MinTxRate, vf.MaxTxRate = info.MinTxRate, info.MaxTxRate
+		vf.Trust = trust[info.ID]
+		for state, value := range vfLinkStates {
+			if value == info.LinkState {
+				vf.LinkState = state
+			}
+		}
+	}
+
+	return vfs, nil
+}
+
+// getNicVfTrust returns the trust setting of the vfs of the link at index by vf number,
+// netlink.VfInfo does not carry it so the vf info list of the link is decoded here
+func getNicVfTrust(index int) (map[int]bool, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(unix.IFLA_EXT_MASK, nl.Uint32Attr(nl.RTEXT_FILTER_VF)))
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 || len(msgs[0]) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("unexpected reply to the link %d request", index)
+	}
+
+	return parseVfTrust(msgs[0][unix.SizeofIfInfomsg:])
+}
+
+// parseVfTrust decodes IFLA_VF_TRUST from the attributes of a link message, a vf whose
+// driver does not report trust is left out
+func parseVfTrust(b []byte) (map[int]bool, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+
+	trust := make(map[int]bool)
+	for _, attr := range attrs {
+		if attr.Attr.Type != unix.IFLA_VFINFO_LIST {
+			continue
+		}
+
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			vfAttrs, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, vfAttr := range vfAttrs {
+				if vfAttr.Attr.Type == nl.IFLA_VF_TRUST && len(vfAttr.Value) >= nl.SizeofVfTrust {
+					// the kernel reports -1 when the driver does not fill it
+					t := nl.DeserializeVfTrust(vfAttr.Value)
+					if t.Setting <= 1 {
+						trust[int(t.Vf)] = t.Setting == 1
+					}
+				}
+			}
+		}
+	}
+
+	return trust, nil
+}
+
+// setNicVf looks nic up and applies set to it
+func setNicVf(nic string, vf int, what string, set func(link netlink.Link) error) error {
+	link, err := netlink.LinkByName(nic)
+	if err != nil {
+		logger.Errorf("netlink.LinkByName() nic %s failed! reason:%s", nic, err)
+		return err
+	}
+
+	if err := set(link); err != nil {
+		logger.Errorf("set %s of nic %s vf %d failed! reason:%s", what, nic, vf, err)
+		return err
+	}
+
+	return nil
+}
+
+func SetNicVfMacaddr(nic string, vf int, macaddr string) error {
+	mac, err := net.ParseMAC(macaddr)
+	if err != nil {
+		logger.Errorf("net.ParseMAC() %s failed! reason:%s", macaddr, err)
+		return err
+	}
+
+	return setNicVf(nic, vf, "mac", func(link netlink.Link) error {
+		return netlink.LinkSetVfHardwareAddr(link, vf, mac)
+	})
+}
+
+// SetNicVfVlan sets the port vlan and 802.1p priority of the vf, vlan 0 removes it
+func SetNicVfVlan(nic string, vf int, vlan int, qos int) error {
+	if vlan < 0 || vlan > 4095 || qos < 0 || qos > 7 {
+		return fmt.Errorf("invalid vlan %d qos %d", vlan, qos)
+	}
+
+	return setNicVf(nic, vf, "vlan", func(link netlink.Link) error {
+		return netlink.LinkSetVfVlanQos(link, vf, vlan, qos)
+	})
+}
+
+func SetNicVfSpoofchk(nic string, vf int, on bool) error {
+	return setNicVf(nic, vf, "spoofchk", func(link netlink.Link) error {
+		return netlink.LinkSetVfSpoofchk(link, vf, on)
+	})
+}
+
+// SetNicVfTrust lets a trusted vf change its mac and enter promiscuous mode
+func SetNicVfTrust(nic string, vf int, on bool) error {
+	return setNicVf(nic, vf, "trust", func(link netlink.Link) error {
+		return netlink.LinkSetVfTrust(link, vf, on)
+	})
+}
+
+func SetNicVfLinkState(nic string, vf int, state VfLinkState) error {
+	value, ok := vfLinkStates[state]
+	if !ok {
+		return fmt.Errorf("invalid vf link state %q", state)
+	}
+
+	return setNicVf(nic, vf, "link state", func(link netlink.Link) error {
+		return netlink.LinkSetVfState(link, vf, value)
+	})
+}
+
+// SetNicVfRate sets the min and max tx rates of the vf in Mbps, 0 means unlimited
+func SetNicVfRate(nic string, vf int, minMbps int, maxMbps int) error {
+	if minMbps < 0 || maxMbps < 0 || (maxMbps > 0 && minMbps > maxMbps) {
+		return fmt.Errorf("invalid vf rate min %d max %d", minMbps, maxMbps)
+	}
+
+	return setNicVf(nic, vf, "rate", func(link netlink.Link) error {
+		return netlink.LinkSetVfRate(link, vf, minMbps, maxMbps)
+	})
+}
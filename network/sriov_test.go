@@ -0,0 +1,30 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseVfTrust(t *testing.T) {
+	list := nl.NewRtAttr(unix.IFLA_VFINFO_LIST, nil)
+	// vf 2 has a driver not reporting trust
+	for vf, setting := range []uint32{1, 0, ^uint32(0)} {
+		info := list.AddRtAttr(nl.IFLA_VF_INFO, nil)
+		info.AddRtAttr(nl.IFLA_VF_SPOOFCHK, (&nl.VfSpoofchk{Vf: uint32(vf), Setting: 1}).Serialize())
+		info.AddRtAttr(nl.IFLA_VF_TRUST, (&nl.VfTrust{Vf: uint32(vf), Setting: setting}).Serialize())
+	}
+
+	b := nl.NewRtAttr(unix.IFLA_MTU, nl.Uint32Attr(1500)).Serialize()
+	b = append(b, list.Serialize()...)
+
+	got, err := parseVfTrust(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]bool{0: true, 1: false}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
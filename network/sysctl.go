@@ -0,0 +1,247 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/running910/gokit/logger"
+	"github.com/running910/gokit/misc"
+	"github.com/vishvananda/netns"
+)
+
+// sysctlFile returns the procfs file of key. Keys are dotted as net.ipv4.ip_forward, or
+// slashed as net/ipv4/conf/eth0.100/rp_filter when a nic name has a dot, as sysctl accepts.
+func sysctlFile(key string) string {
+	if !strings.Contains(key, "/") {
+		key = strings.ReplaceAll(key, ".", "/")
+	}
+	return misc.ProcfsPath("sys", key)
+}
+
+// GetNsSysctl returns the value of key in ns. The net.* keys are per namespace, procfs shows
+// those of the namespace of the reading thread.
+func GetNsSysctl(ns netns.NsHandle, key string) (string, error) {
+	var content []byte
+	err := RunInNs(ns, func() error {
+		var err error
+		content, err = os.ReadFile(sysctlFile(key))
+		return err
+	})
+	if err != nil {
+		logger.Errorf("sysctl %s failed! reason:%s, ns:%d", key, err, ns)
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// SetNsSysctl sets key to value in ns, it does not write a value already set
+func SetNsSysctl(ns netns.NsHandle, key string, value string) error {
+	current, err := GetNsSysctl(ns, key)
+	if err != nil {
+		return err
+	} else if current == value {
+		return nil
+	}
+
+	logger.Infof("sysctl -w %s=%s, ns:%d", key, value, ns)
+	err = RunInNs(ns, func() error {
+		return os.WriteFile(sysctlFile(key), []byte(value), 0644)
+	})
+	if err != nil {
+		logger.Errorf("sysctl -w %s=%s failed! reason:%s, ns:%d", key, value, err, ns)
+		return err
+	}
+
+	return nil
+}
+
+func GetNsSysctlInt(ns netns.NsHandle, key string) (int, error) {
+	value, err := GetNsSysctl(ns, key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("sysctl %s is not an integer: %q", key, value)
+	}
+
+	return n, nil
+}
+
+func SetNsSysctlInt(ns netns.NsHandle, key string, value int) error {
+	return SetNsSysctl(ns, key, strconv.Itoa(value))
+}
+
+func GetSysctl(key string) (string, error) {
+	return GetNsSysctl(netns.None(), key)
+}
+
+func SetSysctl(key string, value string) error {
+	return SetNsSysctl(netns.None(), key, value)
+}
+
+func GetSysctlInt(key string) (int, error) {
+	return GetNsSysctlInt(netns.None(), key)
+}
+
+func SetSysctlInt(key string, value int) error {
+	return SetNsSysctlInt(netns.None(), key, value)
+}
+
+// SysctlSnapshot remembers the values its Set calls overwrite, so Restore can put them back.
+// It keeps the first value seen for each key, the one before any change.
+type SysctlSnapshot struct {
+	ns netns.NsHandle
+
+	mu     sync.Mutex
+	keys   []string
+	values map[string]string
+}
+
+// NewSysctlSnapshot returns a snapshot of the sysctls of ns, which must stay open until Restore
+func NewSysctlSnapshot(ns netns.NsHandle) *SysctlSnapshot {
+	return &SysctlSnapshot{ns: ns, values: make(map[string]string)}
+}
+
+// Set records the current value of key then sets it to value
+func (s *SysctlSnapshot) Set(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.values[key]; !ok {
+		previous, err := GetNsSysctl(s.ns, key)
+		if err != nil {
+			return err
+		}
+		s.keys = append(s.keys, key)
+		s.values[key] = previous
+	}
+
+	return SetNsSysctl(s.ns, key, value)
+}
+
+// Restore sets back the recorded values in the reverse order of the changes and forgets them.
+// It tries every key and returns the first error.
+func (s *SysctlSnapshot) Restore() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for k := len(s.keys) - 1; k >= 0; k-- {
+		key := s.keys[k]
+		if err := SetNsSysctl(s.ns, key, s.values[key]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	s.keys, s.values = nil, make(map[string]string)
+	return firstErr
+}
+
+// SysctlValue returns a pointer to v for the fields of NicIPv4Conf and NicIPv6Conf
+func SysctlValue(v int) *int {
+	return &v
+}
+
+// NicIPv4Conf is the net.ipv4.conf.<nic> sysctls to set, nil fields are left unchanged
+type NicIPv4Conf struct {
+	Forwarding *int
+	// 0 off, 1 strict, 2 loose
+	RpFilter    *int
+	ArpIgnore   *int
+	ArpAnnounce *int
+	ProxyArp    *int
+	// accept packets to 127.0.0.0/8 from the nic, needed to dnat to loopback
+	RouteLocalnet *int
+}
+
+// NicIPv6Conf is the net.ipv6.conf.<nic> sysctls to set, nil fields are left unchanged
+type NicIPv6Conf struct {
+	DisableIPv6 *int
+	Forwarding  *int
+	// 0 never, 1 unless forwarding, 2 even if forwarding
+	AcceptRa *int
+	Autoconf *int
+	// 0 no dad, 1 dad, 2 dad and disable ipv6 on duplicate
+	AcceptDad *int
+}
+
+func sameNs(a netns.NsHandle, b netns.NsHandle) bool {
+	if !isNsSet(a) || !isNsSet(b) {
+		return isNsSet(a) == isNsSet(b)
+	}
+	return a.Equal(b)
+}
+
+type sysctlField struct {
+	name  string
+	value *int
+}
+
+// setNsNicConf sets the fields of conf below net/<family>/conf/<nic>, through snapshot when
+// it is not nil. The nic may be all or default.
+func setNsNicConf(ns netns.NsHandle, family string, nic string, fields []sysctlField, snapshot *SysctlSnapshot) error {
+	if snapshot != nil && !sameNs(snapshot.ns, ns) {
+		return fmt.Errorf("sysctl snapshot of ns %d used for ns %d", snapshot.ns, ns)
+	}
+
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+
+		// slashed, a nic name may have a dot as eth0.100
+		key := strings.Join([]string{"net", family, "conf", nic, field.name}, "/")
+		value := strconv.Itoa(*field.value)
+
+		var err error
+		if snapshot != nil {
+			err = snapshot.Set(key, value)
+		} else {
+			err = SetNsSysctl(ns, key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetNsNicIPv4Conf sets the ipv4 sysctls of nic in ns, recording the previous values in
+// snapshot unless it is nil
+func SetNsNicIPv4Conf(ns netns.NsHandle, nic string, conf NicIPv4Conf, snapshot *SysctlSnapshot) error {
+	return setNsNicConf(ns, "ipv4", nic, []sysctlField{
+		{"forwarding", conf.Forwarding},
+		{"rp_filter", conf.RpFilter},
+		{"arp_ignore", conf.ArpIgnore},
+		{"arp_announce", conf.ArpAnnounce},
+		{"proxy_arp", conf.ProxyArp},
+		{"route_localnet", conf.RouteLocalnet},
+	}, snapshot)
+}
+
+// SetNsNicIPv6Conf sets the ipv6 sysctls of nic in ns, recording the previous values in
+// snapshot unless it is nil
+func SetNsNicIPv6Conf(ns netns.NsHandle, nic string, conf NicIPv6Conf, snapshot *SysctlSnapshot) error {
+	return setNsNicConf(ns, "ipv6", nic, []sysctlField{
+		{"disable_ipv6", conf.DisableIPv6},
+		{"forwarding", conf.Forwarding},
+		{"accept_ra", conf.AcceptRa},
+		{"autoconf", conf.Autoconf},
+		{"accept_dad", conf.AcceptDad},
+	}, snapshot)
+}
+
+func SetNicIPv4Conf(nic string, conf NicIPv4Conf, snapshot *SysctlSnapshot) error {
+	return SetNsNicIPv4Conf(netns.None(), nic, conf, snapshot)
+}
+
+func SetNicIPv6Conf(nic string, conf NicIPv6Conf, snapshot *SysctlSnapshot) error {
+	return SetNsNicIPv6Conf(netns.None(), nic, conf, snapshot)
+}
@@ -0,0 +1,57 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/running910/gokit/misc"
+	"github.com/running910/gokit/misc/sysfstest"
+)
+
+func TestSysctlSnapshot(t *testing.T) {
+	tree := sysfstest.New(t)
+	tree.SetSysctl("net.ipv4.ip_forward", "0")
+	tree.WriteProc("sys/net/ipv4/conf/eth0.100/rp_filter", "1")
+	tree.WriteProc("sys/net/ipv4/conf/eth0.100/arp_ignore", "0")
+	tree.WriteProc("sys/net/ipv6/conf/eth0.100/accept_ra", "1")
+
+	defer func(old string) { misc.ProcfsRoot = old }(misc.ProcfsRoot)
+	misc.ProcfsRoot = tree.Proc
+
+	if err := SetSysctlInt("net.ipv4.ip_forward", 1); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := GetSysctlInt("net.ipv4.ip_forward"); err != nil || value != 1 {
+		t.Fatalf("ip_forward %d %v", value, err)
+	}
+
+	snapshot := NewSysctlSnapshot(0)
+	if err := SetNicIPv4Conf("eth0.100", NicIPv4Conf{RpFilter: SysctlValue(2), ArpIgnore: SysctlValue(1)}, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNicIPv4Conf("eth0.100", NicIPv4Conf{RpFilter: SysctlValue(0)}, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetNicIPv6Conf("eth0.100", NicIPv6Conf{AcceptRa: SysctlValue(2)}, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{"ipv4/conf/eth0.100/rp_filter": "0", "ipv4/conf/eth0.100/arp_ignore": "1", "ipv6/conf/eth0.100/accept_ra": "2"} {
+		if value := tree.ReadProc("sys/net/" + file); value != want {
+			t.Errorf("%s is %s, want %s", file, value, want)
+		}
+	}
+
+	// a nil field is left alone, a missing sysctl fails
+	if err := SetNicIPv4Conf("eth0.100", NicIPv4Conf{ProxyArp: SysctlValue(1)}, nil); err == nil {
+		t.Fatal("expect an error for a missing sysctl")
+	}
+
+	if err := snapshot.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]string{"ipv4/conf/eth0.100/rp_filter": "1", "ipv4/conf/eth0.100/arp_ignore": "0", "ipv6/conf/eth0.100/accept_ra": "1"} {
+		if value := tree.ReadProc("sys/net/" + file); value != want {
+			t.Errorf("restored %s is %s, want %s", file, value, want)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/running910/gokit/logger"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+type TracerouteMode string
+
+const (
+	TracerouteIcmp TracerouteMode = "icmp"
+	TracerouteUdp  TracerouteMode = "udp"
+	// SYN to Port, the destination answers with SYN-ACK or RST
+	TracerouteTcp TracerouteMode = "tcp"
+)
+
+type TracerouteOptions struct {
+	// default TracerouteIcmp
+	Mode TracerouteMode
+	// default 30
+	MaxHops int
+	// default 1
+	FirstHop int
+	// probes per hop, default 3
+	Probes int
+	// wait for the answer of one probe, default 1s
+	Timeout time.Duration
+	// first destination port of udp probes, incremented for each probe, default 33434.
+	// Destination port of tcp probes, default 80.
+	Port int
+	// source address, or name of the interface to send through
+	Source string
+	// interface to send through with SO_BINDTODEVICE
+	Device string
+	// namespace to trace from, 0 or netns.None() for the current one
+	Netns netns.NsHandle
+	// resolve the destination to an ipv6 address, implied by an ipv6 literal
+	IPv6 bool
+}
+
+type TracerouteProbe struct {
+	Received bool
+	Addr     net.IP
+	Rtt      time.Duration
+	// the answer is a destination unreachable from a router, !H !N !P... in traceroute(8)
+	Unreachable bool
+}
+
+type TracerouteHop struct {
+	TTL    int
+	Probes []TracerouteProbe
+}
+
+// Addrs returns the distinct addresses that answered at this hop
+func (h TracerouteHop) Addrs() []net.IP {
+	addrs := make([]net.IP, 0)
+	for _, p := range h.Probes {
+		if !p.Received {
+			continue
+		}
+
+		found := false
+		for _, a := range addrs {
+			found = found || a.Equal(p.Addr)
+		}
+		if !found {
+			addrs = append(addrs, p.Addr)
+		}
+	}
+	return addrs
+}
+
+type TracerouteResult struct {
+	Dst  string
+	Addr net.IP
+	Hops []TracerouteHop
+	// the destination answered
+	Reached bool
+}
+
+func (r *TracerouteResult) String() string {
+	s := fmt.Sprintf("traceroute to %s (%s), %d hops", r.Dst, r.Addr, len(r.Hops))
+	for _, hop := range r.Hops {
+		s += fmt.Sprintf("\n%2d ", hop.TTL)
+		for _, p := range hop.Probes {
+			if !p.Received {
+				s += " *"
+				continue
+			}
+			s += fmt.Sprintf(" %s %s", p.Addr, p.Rtt)
+			if p.Unreachable {
+				s += " !"
+			}
+		}
+	}
+	return s
+}
+
+func (o TracerouteOptions) withDefaults() TracerouteOptions {
+	if o.Mode == "" {
+		o.Mode = TracerouteIcmp
+	}
+	if o.MaxHops <= 0 {
+		o.MaxHops = 30
+	}
+	if o.FirstHop <= 0 {
+		o.FirstHop = 1
+	}
+	if o.Probes <= 0 {
+		o.Probes = 3
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Port <= 0 {
+		o.Port = 33434
+		if o.Mode == TracerouteTcp {
+			o.Port = 80
+		}
+	}
+	return o
+}
+
+func (o TracerouteOptions) pingOptions() PingOptions {
+	return PingOptions{Source: o.Source, Device: o.Device, Netns: o.Netns, IPv6: o.IPv6, Privileged: true}
+}
+
+// tracerouteProbe is a probe in flight, match tells whether an icmp message answers it
+type tracerouteProbe struct {
+	sent  time.Time
+	match func(pkt icmpPacket) (answered bool, reached bool)
+	// tcp probes only, the connect result of the probe socket
+	connected chan bool
+	fd        int
+}
+
+func (p *tracerouteProbe) close() {
+	if p.fd >= 0 {
+		unix.Close(p.fd)
+	}
+}
+
+// quotedTransport returns the transport protocol and header quoted in an icmp error
+func quotedTransport(data []byte, v6 bool) (int, []byte) {
+	if v6 {
+		if len(data) < 40 {
+			return -1, nil
+		}
+		return int(data[6]), data[40:]
+	}
+
+	if len(data) < 20 {
+		return -1, nil
+	}
+	ihl := int(data[0]&0x0f) * 4
+	if len(data) < ihl {
+		return -1, nil
+	}
+	return int(data[9]), data[ihl:]
+}
+
+// icmpErrorData returns the datagram quoted by an icmp error, and whether it is a
+// destination unreachable rather than a time exceeded
+func icmpErrorData(msg *icmp.Message) ([]byte, bool, bool) {
+	switch body := msg.Body.(type) {
+	case *icmp.TimeExceeded:
+		return body.Data, false, true
+	case *icmp.DstUnreach:
+		return body.Data, true, true
+	case *icmp.PacketTooBig:
+		return body.Data, true, true
+	}
+	return nil, false, false
+}
+
+// Traceroute sends probes to dst with increasing ttl and reports the routers answering
+// with ICMP time exceeded, until dst answers or MaxHops is reached. It needs CAP_NET_RAW
+// for the raw ICMP socket receiving the answers.
+func Traceroute(dst string, opts TracerouteOptions) (*TracerouteResult, error) {
+	opts = opts.withDefaults()
+
+	addr, err := resolvePingAddr(dst, opts.IPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := newPingConn(addr, opts.pingOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	packets := make(chan icmpPacket, 64)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			pkt, err := conn.readMessage(buf)
+			if err != nil {
+				return
+			}
+
+			select {
+			case packets <- pkt:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	result := &TracerouteResult{Dst: dst, Addr: addr.IP, Hops: make([]TracerouteHop, 0)}
+	id := rand.Intn(0xffff)
+	seq := 0
+
+	for ttl := opts.FirstHop; ttl <= opts.MaxHops && !result.Reached; ttl++ {
+		hop := TracerouteHop{TTL: ttl, Probes: make([]TracerouteProbe, 0, opts.Probes)}
+		stop := false
+
+		for k := 0; k < opts.Probes; k++ {
+			var probe *tracerouteProbe
+			switch opts.Mode {
+			case TracerouteIcmp:
+				probe, err = sendIcmpTraceProbe(conn, addr, ttl, id, seq)
+			case TracerouteUdp:
+				probe, err = sendUdpTraceProbe(addr, ttl, opts.Port+seq, opts)
+			case TracerouteTcp:
+				probe, err = sendTcpTraceProbe(addr, ttl, opts.Port, opts)
+			default:
+				err = fmt.Errorf("unsupported traceroute mode %q", opts.Mode)
+			}
+			seq++
+
+			if err != nil {
+				logger.Errorf("send traceroute probe ttl %d to %s failed! reason:%s", ttl, dst, err)
+				return nil, err
+			}
+
+			p := waitTraceProbe(probe, packets, addr.IP, opts.Timeout)
+			probe.close()
+
+			hop.Probes = append(hop.Probes, p)
+			if p.Received && (p.Addr.Equal(addr.IP) || p.Unreachable) {
+				result.Reached = result.Reached || p.Addr.Equal(addr.IP)
+				stop = true
+			}
+		}
+
+		result.Hops = append(result.Hops, hop)
+		if stop {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func waitTraceProbe(probe *tracerouteProbe, packets chan icmpPacket, dst net.IP, timeout time.Duration) TracerouteProbe {
+	timer := time.NewTimer(time.Until(probe.sent.Add(timeout)))
+	defer timer.Stop()
+
+	for {
+		select {
+		case pkt := <-packets:
+			if answered, reached := probe.match(pkt); answered {
+				_, unreachable, _ := icmpErrorData(pkt.msg)
+				return TracerouteProbe{
+					Received:    true,
+					Addr:        pkt.from,
+					Rtt:         pkt.at.Sub(probe.sent),
+					Unreachable: unreachable && !reached,
+				}
+			}
+		case ok := <-probe.connected:
+			if ok {
+				return TracerouteProbe{Received: true, Addr: dst, Rtt: time.Since(probe.sent)}
+			}
+			// the connect failed with an icmp error, which is matched from packets
+			probe.connected = nil
+		case <-timer.C:
+			return TracerouteProbe{}
+		}
+	}
+}
+
+func (c *pingConn) setTTL(ttl int) error {
+	if c.v6 != nil {
+		return c.v6.SetHopLimit(ttl)
+	}
+	return c.v4.SetTTL(ttl)
+}
+
+func sendIcmpTraceProbe(conn *pingConn, addr *net.IPAddr, ttl int, id int, seq int) (*tracerouteProbe, error) {
+	if err := conn.setTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	seq &= 0xffff
+	v6 := addr.IP.To4() == nil
+	probe := &tracerouteProbe{sent: time.Now(), fd: -1}
+	probe.match = func(pkt icmpPacket) (bool, bool) {
+		if echo, ok := pkt.msg.Body.(*icmp.Echo); ok {
+			reply := pkt.msg.Type == ipv4.ICMPTypeEchoReply || pkt.msg.Type == ipv6.ICMPTypeEchoReply
+			return reply && echo.ID == id && echo.Seq == seq, true
+		}
+
+		data, _, ok := icmpErrorData(pkt.msg)
+		if !ok {
+			return false, false
+		}
+
+		proto, header := quotedTransport(data, v6)
+		if (proto != unix.IPPROTO_ICMP && proto != unix.IPPROTO_ICMPV6) || len(header) < 8 {
+			return false, false
+		}
+		return int(binary.BigEndian.Uint16(header[4:6])) == id && int(binary.BigEndian.Uint16(header[6:8])) == seq, false
+	}
+
+	return probe, conn.send(addr, id, seq, make([]byte, 32))
+}
+
+func setSocketTTL(fd int, v6 bool, ttl int) error {
+	if v6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+}
+
+// openTraceSocket opens a socket of sotype in the namespace of opts, bound to its source
+// and device, and returns it with its local port.
+func openTraceSocket(v6 bool, sotype int, ttl int, opts TracerouteOptions) (int, int, error) {
+	family := unix.AF_INET
+	if v6 {
+		family = unix.AF_INET6
+	}
+
+	fd, port := -1, 0
+	err := RunInNs(opts.Netns, func() error {
+		var err error
+		if fd, err = unix.Socket(family, sotype|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0); err != nil {
+			return err
+		}
+
+		if err := setSocketTTL(fd, v6, ttl); err != nil {
+			return err
+		}
+
+		device := opts.Device
+		source := net.ParseIP(opts.Source)
+		if source == nil && device == "" {
+			device = opts.Source
+		}
+		if device != "" {
+			if err := unix.BindToDevice(fd, device); err != nil {
+				return err
+			}
+		}
+
+		var sa unix.Sockaddr
+		if v6 {
+			sa6 := &unix.SockaddrInet6{}
+			if source != nil {
+				copy(sa6.Addr[:], source.To16())
+			}
+			sa = sa6
+		} else {
+			sa4 := &unix.SockaddrInet4{}
+			if source != nil {
+				copy(sa4.Addr[:], source.To4())
+			}
+			sa = sa4
+		}
+		if err := unix.Bind(fd, sa); err != nil {
+			return err
+		}
+
+		local, err := unix.Getsockname(fd)
+		if err != nil {
+			return err
+		}
+		switch a := local.(type) {
+		case *unix.SockaddrInet4:
+			port = a.Port
+		case *unix.SockaddrInet6:
+			port = a.Port
+		}
+		return nil
+	})
+	if err != nil && fd >= 0 {
+		unix.Close(fd)
+		fd = -1
+	}
+
+	return fd, port, err
+}
+
+func traceSockaddr(ip net.IP, port int) unix.Sockaddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa
+	}
+
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return sa
+}
+
+func sendUdpTraceProbe(addr *net.IPAddr, ttl int, port int, opts TracerouteOptions) (*tracerouteProbe, error) {
+	v6 := addr.IP.To4() == nil
+	port = 1 + (port-1)%65535
+
+	fd, _, err := openTraceSocket(v6, unix.SOCK_DGRAM, ttl, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	probe := &tracerouteProbe{sent: time.Now(), fd: fd}
+	probe.match = func(pkt icmpPacket) (bool, bool) {
+		data, _, ok := icmpErrorData(pkt.msg)
+		if !ok {
+			return false, false
+		}
+
+		proto, header := quotedTransport(data, v6)
+		if proto != unix.IPPROTO_UDP || len(header) < 4 || int(binary.BigEndian.Uint16(header[2:4])) != port {
+			return false, false
+		}
+		return true, pkt.from.Equal(addr.IP)
+	}
+
+	if err := unix.Sendto(fd, make([]byte, 32), 0, traceSockaddr(addr.IP, port)); err != nil {
+		probe.close()
+		return nil, err
+	}
+
+	return probe, nil
+}
+
+func sendTcpTraceProbe(addr *net.IPAddr, ttl int, port int, opts TracerouteOptions) (*tracerouteProbe, error) {
+	v6 := addr.IP.To4() == nil
+
+	fd, localPort, err := openTraceSocket(v6, unix.SOCK_STREAM, ttl, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket is closed by the connect goroutine, not to poll a reused fd
+	probe := &tracerouteProbe{sent: time.Now(), fd: -1, connected: make(chan bool, 1)}
+	probe.match = func(pkt icmpPacket) (bool, bool) {
+		data, _, ok := icmpErrorData(pkt.msg)
+		if !ok {
+			return false, false
+		}
+
+		proto, header := quotedTransport(data, v6)
+		if proto != unix.IPPROTO_TCP || len(header) < 4 || int(binary.BigEndian.Uint16(header[0:2])) != localPort {
+			return false, false
+		}
+		return true, pkt.from.Equal(addr.IP)
+	}
+
+	if err := unix.Connect(fd, traceSockaddr(addr.IP, port)); err != nil && err != unix.EINPROGRESS {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// SYN-ACK completes the connect and RST refuses it, both come from the destination
+	go func() {
+		defer unix.Close(fd)
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		if n, err := unix.Poll(fds, int(opts.Timeout/time.Millisecond)); err != nil || n == 0 {
+			return
+		}
+
+		soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		probe.connected <- err == nil && (soErr == 0 || unix.Errno(soErr) == unix.ECONNREFUSED)
+	}()
+
+	return probe, nil
+}
+
+// PathMtu discovers the path mtu to dst by binary search of the largest ICMP echo request
+// with the DF bit set that gets a reply. The search starts from the mtu the kernel knows for
+// the route to dst, opts selects the source, device and namespace and opts.Timeout bounds
+// each attempt, 1s by default. It needs CAP_NET_RAW unless opts.Privileged is false.
+func PathMtu(dst string, opts PingOptions) (int, error) {
+	addr, err := resolvePingAddr(dst, opts.IPv6)
+	if err != nil {
+		return 0, err
+	}
+	v6 := addr.IP.To4() == nil
+
+	// ip header plus icmp header
+	overhead, lo := 28, 68
+	if v6 {
+		overhead, lo = 48, 1280
+	}
+
+	hi, err := routeMtu(addr.IP, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	opts.Count = 2
+	opts.Interval = 100 * time.Millisecond
+	opts.DontFragment = true
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second
+	}
+
+	fits := func(mtu int) (bool, error) {
+		opts.Size = mtu - overhead
+		result, err := PingWithOptions(addr.IP.String(), opts)
+		if errors.Is(err, unix.EMSGSIZE) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return result.Received > 0, nil
+	}
+
+	ok, err := fits(hi)
+	if err != nil {
+		return 0, err
+	} else if ok {
+		return hi, nil
+	}
+
+	ok, err = fits(lo)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("%s does not answer to ping of the minimum mtu %d", dst, lo)
+	}
+
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ok, err = fits(mid); err != nil {
+			return 0, err
+		} else if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	logger.Debugf("path mtu to %s is %d", dst, lo)
+	return lo, nil
+}
+
+// routeMtu returns the mtu the kernel uses for the route to ip, the path mtu if it is cached
+func routeMtu(ip net.IP, opts PingOptions) (int, error) {
+	v6 := ip.To4() == nil
+	tracerouteOpts := TracerouteOptions{Source: opts.Source, Device: opts.Device, Netns: opts.Netns}
+
+	fd, _, err := openTraceSocket(v6, unix.SOCK_DGRAM, 64, tracerouteOpts)
+	if err != nil {
+		logger.Errorf("open udp socket to %s failed! reason:%s", ip, err)
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	if err := unix.Connect(fd, traceSockaddr(ip, 9)); err != nil {
+		logger.Errorf("connect udp socket to %s failed! reason:%s", ip, err)
+		return 0, err
+	}
+
+	if v6 {
+		return unix.GetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MTU)
+	}
+	return unix.GetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU)
+}
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestTracerouteQuotedProbe(t *testing.T) {
+
+	// ipv4 header with options, then the udp header of a probe to port 33435
+	quoted := make([]byte, 24+8)
+	quoted[0] = 0x46
+	quoted[9] = 17
+	binary.BigEndian.PutUint16(quoted[24+2:], 33435)
+
+	msg := &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	data, unreachable, ok := icmpErrorData(msg)
+	if !ok || unreachable {
+		t.Fatalf("time exceeded not recognized")
+	}
+
+	proto, header := quotedTransport(data, false)
+	if proto != 17 || len(header) != 8 || binary.BigEndian.Uint16(header[2:4]) != 33435 {
+		t.Fatalf("unexpected quoted transport %d %v", proto, header)
+	}
+
+	hop := TracerouteHop{TTL: 1, Probes: []TracerouteProbe{
+		{Received: true, Addr: net.ParseIP("10.0.0.1")},
+		{},
+		{Received: true, Addr: net.ParseIP("10.0.0.1")},
+	}}
+	if addrs := hop.Addrs(); len(addrs) != 1 {
+		t.Fatalf("unexpected hop addresses %v", addrs)
+	}
+}